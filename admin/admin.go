@@ -0,0 +1,172 @@
+// Package admin serves the operator api of the tracker, it runs in the tracker
+// process so that changes reach the provider chooser immediately.
+package admin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"nebula-tracker/api/jsonapi"
+	"nebula-tracker/config"
+	"nebula-tracker/db"
+	chooser "nebula-tracker/metadata/provider_chooser"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StartServer serves the operator api unless the AuthToken of the Admin config
+// is left unset or the well-known test one.
+func StartServer() {
+	conf := config.GetTrackerConfig().Admin
+	if conf.AuthToken == "" || conf.AuthToken == "test" {
+		log.Error("admin server not started, set AuthToken of the Admin config to a secret")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/provider/suspend/", providerStatusHandler(db.ProviderStatusSuspended))
+	mux.HandleFunc("/api/provider/drain/", providerStatusHandler(db.ProviderStatusDraining))
+	mux.HandleFunc("/api/provider/ban/", providerStatusHandler(db.ProviderStatusBanned))
+	mux.HandleFunc("/api/provider/resume/", providerStatusHandler(db.ProviderStatusNormal))
+	mux.HandleFunc("/api/provider/status/", providerStatus)
+	mux.HandleFunc("/api/provider/storage/", providerStorage)
+	mux.HandleFunc("/api/order/refund/", orderRefund)
+	go func() {
+		fmt.Printf("Admin listening on %s:%d\n", conf.ListenIp, conf.ListenPort)
+		err := http.ListenAndServe(fmt.Sprintf("%s:%d", conf.ListenIp, conf.ListenPort), mux)
+		if err != nil {
+			log.Errorf("admin ListenAndServe Error: %s", err)
+		}
+	}()
+}
+
+type providerStatusReq struct {
+	NodeId   string `json:"nodeId"`
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+}
+
+func providerStatusHandler(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer jsonapi.RecoverErr(w, r)
+		if !checkAuthHeader(w, r) {
+			return
+		}
+		req := &providerStatusReq{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if !jsonapi.CheckJsonErr(err, w, r) {
+			return
+		}
+		req.Operator, req.Reason = strings.TrimSpace(req.Operator), strings.TrimSpace(req.Reason)
+		if len(req.NodeId) == 0 || len(req.Operator) == 0 || len(req.Reason) == 0 {
+			json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 6, ErrMsg: "nodeId, operator and reason are required"})
+			return
+		}
+		if len(req.Operator) > 64 || len(req.Reason) > 512 {
+			json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 6, ErrMsg: "operator or reason too long"})
+			return
+		}
+		previous, err := db.ProviderChangeStatus(req.NodeId, status, req.Operator, req.Reason)
+		if err != nil {
+			json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 7, ErrMsg: err.Error()})
+			return
+		}
+		if status == db.ProviderStatusNormal {
+			chooser.Reload()
+		} else {
+			chooser.Exclude(req.NodeId)
+		}
+		log.Infof("provider [%s] status changed from %d to %d by %s, reason: %s", req.NodeId, previous, status, req.Operator, req.Reason)
+		jsonapi.Success(w, r)
+	}
+}
+
+type providerStatusResp struct {
+	Status          int                    `json:"status"`
+	RemainingBlocks int                    `json:"remainingBlocks"`
+	Logs            []*db.ProviderAdminLog `json:"logs"`
+}
+
+func providerStatus(w http.ResponseWriter, r *http.Request) {
+	defer jsonapi.RecoverErr(w, r)
+	if !checkAuthHeader(w, r) {
+		return
+	}
+	nodeId := r.URL.Query().Get("nodeId")
+	found, status := db.ProviderGetStatus(nodeId)
+	if !found {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 7, ErrMsg: "provider not found"})
+		return
+	}
+	json.NewEncoder(w).Encode(&jsonapi.JsonObj{Data: &providerStatusResp{Status: status,
+		RemainingBlocks: db.BlockCountByProvider(nodeId),
+		Logs:            db.ProviderAdminLogs(nodeId)}})
+}
+
+// providerStorage returns the declared and used storage volume of one provider,
+// or of every provider without nodeId.
+func providerStorage(w http.ResponseWriter, r *http.Request) {
+	defer jsonapi.RecoverErr(w, r)
+	if !checkAuthHeader(w, r) {
+		return
+	}
+	nodeId := r.URL.Query().Get("nodeId")
+	if len(nodeId) == 0 {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Data: db.ProviderStorageUsages()})
+		return
+	}
+	su := db.ProviderStorageUsage(nodeId)
+	if su == nil {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 7, ErrMsg: "provider not found"})
+		return
+	}
+	json.NewEncoder(w).Encode(&jsonapi.JsonObj{Data: []*db.StorageUsage{su}})
+}
+
+type orderRefundReq struct {
+	NodeId   string `json:"nodeId"`
+	OrderId  string `json:"orderId"` // hex
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+}
+
+// orderRefund refunds a paid client order whose period has not begun to the
+// balance of the client.
+func orderRefund(w http.ResponseWriter, r *http.Request) {
+	defer jsonapi.RecoverErr(w, r)
+	if !checkAuthHeader(w, r) {
+		return
+	}
+	req := &orderRefundReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if !jsonapi.CheckJsonErr(err, w, r) {
+		return
+	}
+	req.Operator, req.Reason = strings.TrimSpace(req.Operator), strings.TrimSpace(req.Reason)
+	if len(req.NodeId) == 0 || len(req.OrderId) == 0 || len(req.Operator) == 0 || len(req.Reason) == 0 {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 6, ErrMsg: "nodeId, orderId, operator and reason are required"})
+		return
+	}
+	if len(req.Operator) > 64 || len(req.Reason) > 512 {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 6, ErrMsg: "operator or reason too long"})
+		return
+	}
+	orderId, err := hex.DecodeString(req.OrderId)
+	if err != nil {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 6, ErrMsg: "invalid orderId: " + err.Error()})
+		return
+	}
+	amount, err := db.OrderRefund(req.NodeId, orderId, req.Operator, req.Reason)
+	if err != nil {
+		json.NewEncoder(w).Encode(&jsonapi.JsonObj{Code: 7, ErrMsg: err.Error()})
+		return
+	}
+	log.Infof("order %s of client [%s] refunded %d by %s, reason: %s", req.OrderId, req.NodeId, amount, req.Operator, req.Reason)
+	jsonapi.Success(w, r)
+}
+
+func checkAuthHeader(w http.ResponseWriter, r *http.Request) bool {
+	conf := config.GetTrackerConfig().Admin
+	return jsonapi.CheckAuthHeader(w, r, conf.AuthToken, conf.AuthValidSec)
+}
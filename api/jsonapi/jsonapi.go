@@ -0,0 +1,70 @@
+// Package jsonapi holds the response format and request checks shared by the
+// json http apis of the tracker, the teller api and the admin api.
+package jsonapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type JsonObj struct {
+	Code   int8        `json:"code"`
+	ErrMsg string      `json:"errmsg"`
+	Data   interface{} `json:"data"`
+}
+
+func RecoverErr(w http.ResponseWriter, r *http.Request) {
+	if err := recover(); err != nil {
+		log.Warn(string(debug.Stack()))
+		json.NewEncoder(w).Encode(&JsonObj{Code: 9, ErrMsg: fmt.Sprint(err)})
+	}
+}
+
+func CheckJsonErr(err error, w http.ResponseWriter, r *http.Request) bool {
+	if err != nil {
+		json.NewEncoder(w).Encode(&JsonObj{Code: 1, ErrMsg: "cannot parse request to JSON:" + err.Error()})
+		return false
+	}
+	return true
+}
+
+// CheckAuthHeader checks the timestamp header is at most validSec old and the
+// auth header is its HMAC-SHA256 with authToken.
+func CheckAuthHeader(w http.ResponseWriter, r *http.Request, authToken string, validSec int) bool {
+	tsStr := r.Header.Get("timestamp")
+	ts, err := strconv.Atoi(tsStr)
+	if err != nil {
+		json.NewEncoder(w).Encode(&JsonObj{Code: 2, ErrMsg: "invalid header timestamp: " + err.Error()})
+		return false
+	}
+	timestamp := int64(ts)
+	current := time.Now().Unix()
+	if timestamp-current > 3 {
+		json.NewEncoder(w).Encode(&JsonObj{Code: 3, ErrMsg: "client time error"})
+		return false
+	}
+	if current-timestamp > int64(validSec) {
+		json.NewEncoder(w).Encode(&JsonObj{Code: 4, ErrMsg: "timestamp expired"})
+		return false
+	}
+	hash := hmac.New(sha256.New, []byte(authToken))
+	hash.Write([]byte(tsStr))
+	if !hmac.Equal([]byte(hex.EncodeToString(hash.Sum(nil))), []byte(r.Header.Get("auth"))) {
+		json.NewEncoder(w).Encode(&JsonObj{Code: 5, ErrMsg: "auth verify error"})
+		return false
+	}
+	return true
+}
+
+func Success(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(&JsonObj{})
+}
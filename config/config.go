@@ -15,6 +15,19 @@ type TrackerConfig struct {
 	Db                   Db
 	Server               Server
 	Smtps                Smtps
+	Mail                 Mail
+	Chooser              Chooser
+	Admin                Admin
+	Repair               Repair
+	Discovery            Discovery
+	SpeedTest            SpeedTest
+	Billing              Billing
+	VerifyCode           VerifyCode
+	Notify               Notify
+	Retention            Retention
+	AutoRenew            AutoRenew
+	PlanChange           PlanChange
+	OrderState           OrderState
 	AddressChecksumToken string `default:"test-checksum-token"` // for testing convenience, must be specified other string in config.toml
 	TestMode             bool   `default:"false"`
 }
@@ -46,6 +59,112 @@ type Smtps struct {
 	Password string `default:"adminsilver"`
 }
 
+// Mail chooses how emails are delivered, smtp through Smtps or outbox writing
+// them as files under OutboxDir for tests and running without network.
+type Mail struct {
+	Sender         string `default:"smtp"` // smtp or outbox
+	OutboxDir      string `default:"outbox"`
+	TemplateDir    string // <locale>/<name>.tmpl overriding the built-in templates, empty for the built-in ones only
+	Locale         string `default:"en"`
+	RetryCronSpec  string `default:"0 * * * * *"`
+	RetryBatchSize int    `default:"50"`
+	MaxAttempts    int    `default:"10"` // given up after, with the retries backing off from a minute to an hour
+}
+
+type Chooser struct {
+	DomainDbFile         string // csv of network,key used to group providers into failure domains, empty for ip subnet only
+	ProbeWorkers         int    `default:"32"`
+	ProbeIntervalSec     int    `default:"180"`
+	ProbeJitterSec       int    `default:"60"`
+	HeartbeatIntervalSec int    `default:"60"`
+}
+
+type Admin struct {
+	ListenIp     string `default:"127.0.0.1"`
+	ListenPort   int    `default:"6688"`
+	AuthValidSec int    `default:"15"`
+	AuthToken    string // the admin server is not started unless it is set, and not to test
+}
+
+type Repair struct {
+	CronSpec    string `default:"0 */5 * * * *"`
+	BatchSize   int    `default:"100"`
+	MaxFailures int    `default:"5"` // a block failed to migrate this many times is skipped, till an operator resets its MIGRATE_FAILURES
+}
+
+type Discovery struct {
+	Trackers   string // comma separated host:port served besides the TRACKER table
+	Collectors string // comma separated host:port served besides the TRACKER table
+	MaxServers int    `default:"5"`
+}
+
+// SpeedTest bandwidths are in bits per second.
+type SpeedTest struct {
+	CronSpec         string `default:"0 0 3 * * *"`
+	PayloadSize      int    `default:"4194304"`
+	TimeoutSec       int    `default:"60"`
+	MinUpBandwidth   int    `default:"500000"`  // a provider measured below it is not registered
+	MinDownBandwidth int    `default:"2000000"` // a provider measured below it is not registered
+}
+
+// Billing prices are in the smallest unit of the coin.
+type Billing struct {
+	CronSpec             string `default:"0 10 0 * * *"`
+	PayoutCronSpec       string `default:"0 0 4 * * 1"`
+	CollectorDbName      string `default:"collector"` // database of the collector in the same cluster, for the retrieve traffic
+	StoragePricePerTbDay int    `default:"1000000"`
+	TrafficPricePerGb    int    `default:"100000"`
+	HoldbackPercent      int    `default:"25"` // kept back from every earning until the provider exits
+	MinPayout            int    `default:"1000000"`
+	PayoutEnabled        bool   `default:"false"` // earnings are not backed by proof of storage yet, only accrued unless enabled
+}
+
+// VerifyCode limits the guesses of the codes emailed to clients and providers,
+// per node and per email.
+type VerifyCode struct {
+	MaxFailures       int `default:"5"` // wrong codes within FailureWindowMin before locking out
+	FailureWindowMin  int `default:"60"`
+	LockoutMin        int `default:"60"`
+	ResendCooldownSec int `default:"60"`
+}
+
+// Notify emails clients once per package period at each threshold reached.
+type Notify struct {
+	CronSpec      string `default:"0 30 * * * *"`
+	ExpiryDays    string `default:"7,1"`   // comma separated days before the end of the package, 0 for once expired
+	UsagePercents string `default:"80,95"` // comma separated percents of volume and netflow of the package used
+}
+
+// Retention keeps the files of a client whose package ended read only for
+// GraceDays, then frozen for FrozenDays, then removes them.
+type Retention struct {
+	CronSpec   string `default:"0 20 1 * * *"`
+	GraceDays  int    `default:"15"`
+	FrozenDays int    `default:"30"`
+	BatchSize  int    `default:"100"`
+}
+
+// AutoRenew renews the packages of the clients turned it on, BeforeHours
+// before they end.
+type AutoRenew struct {
+	CronSpec    string `default:"0 40 * * * *"`
+	BeforeHours int    `default:"24"`
+}
+
+// PlanChange puts the downgraded packages into service once the current ones
+// end.
+type PlanChange struct {
+	CronSpec string `default:"0 */5 * * * *"`
+}
+
+// OrderState cancels the orders unpaid for UnpaidTimeoutHours, and moves the
+// paid ones to active and expired along their periods.
+type OrderState struct {
+	CronSpec           string `default:"0 */10 * * * *"`
+	UnpaidTimeoutHours int    `default:"24"`
+	BatchSize          int    `default:"100"`
+}
+
 func GetTrackerConfig() *TrackerConfig {
 	if initTrackerConfig {
 		return trackerConfig
@@ -0,0 +1,61 @@
+// Package cronjob runs the periodic jobs of the tracker. The jobs of a runner
+// run one at a time, a job due while another is still running is skipped, and
+// a panic in a job is logged instead of stopping the tracker.
+package cronjob
+
+import (
+	"runtime/debug"
+
+	gosync "github.com/lrita/gosync"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+)
+
+type Runner struct {
+	cron    *cron.Cron
+	running gosync.Mutex
+}
+
+func New() *Runner {
+	return &Runner{cron: cron.New(), running: gosync.NewMutex()}
+}
+
+// Start runs job on the cron spec, name is used in the log of a panic.
+func Start(spec string, name string, job func()) *Runner {
+	r := New()
+	r.Add(spec, name, job)
+	r.Start()
+	return r
+}
+
+func (self *Runner) Add(spec string, name string, job func()) {
+	self.cron.AddFunc(spec, func() {
+		self.Run(name, job)
+	})
+}
+
+func (self *Runner) Start() {
+	self.cron.Start()
+}
+
+func (self *Runner) Stop() {
+	self.cron.Stop()
+}
+
+// Run runs job now unless a job of the runner is running, it returns whether
+// job was run.
+func (self *Runner) Run(name string, job func()) (ran bool) {
+	if self.running.TryLock() {
+		defer self.running.UnLock()
+	} else {
+		return false
+	}
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("%s Panic Error: %s, detail: %s", name, er, string(debug.Stack()))
+		}
+	}()
+	ran = true
+	job()
+	return
+}
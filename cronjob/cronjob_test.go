@@ -0,0 +1,25 @@
+package cronjob
+
+import (
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	r := New()
+	count := 0
+	if !r.Run("count", func() { count++ }) || count != 1 {
+		t.Errorf("failed: %d", count)
+	}
+	if !r.Run("panic", func() { panic("test") }) {
+		t.Error("failed")
+	}
+	// a job started while another runs is skipped
+	r.Run("outer", func() {
+		if r.Run("inner", func() { count++ }) {
+			t.Error("failed")
+		}
+	})
+	if count != 1 {
+		t.Errorf("failed: %d", count)
+	}
+}
@@ -3,6 +3,8 @@ package db
 import (
 	"database/sql"
 	"encoding/base64"
+	"errors"
+	"strings"
 	"time"
 
 	pb "github.com/samoslab/nebula/tracker/metadata/pb"
@@ -22,6 +24,196 @@ func saveBlocks(tx *sql.Tx, fileId []byte, creation time.Time, partitions []*pb.
 	}
 }
 
+// BlockLocation is a block stored on a provider, with the file it belongs to.
+type BlockLocation struct {
+	Id         []byte
+	Hash       string
+	Size       uint64
+	FileId     []byte
+	FileHash   string
+	FileSize   uint64
+	ProviderId string
+}
+
+// blocksOnProvider selects the blocks of files not removed stored on the
+// provider of the column or placeholder given. The used volume, the blocks to
+// migrate and the ones remaining on a provider all count these.
+func blocksOnProvider(providerId string) string {
+	return " FROM BLOCK b join FILE f on b.FILE_ID=f.ID where b.PROVIDER_ID=" + providerId + " and b.REMOVED=false and f.REMOVED=false"
+}
+
+// BlockFindByProvider returns at most limit blocks stored on the provider which
+// failed to be migrated fewer than maxFailures times.
+func BlockFindByProvider(providerId string, maxFailures int, limit int) (slice []*BlockLocation) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	slice = blockFindByProvider(tx, providerId, maxFailures, limit)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func blockFindByProvider(tx *sql.Tx, providerId string, maxFailures int, limit int) []*BlockLocation {
+	rows, err := tx.Query("SELECT b.ID,b.HASH,b.SIZE,b.FILE_ID,f.HASH,f.SIZE"+blocksOnProvider("$1")+" and b.MIGRATE_FAILURES<$2 limit $3", providerId, maxFailures, limit)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*BlockLocation, 0, limit)
+	for rows.Next() {
+		bl := &BlockLocation{ProviderId: providerId}
+		err = rows.Scan(&bl.Id, &bl.Hash, &bl.Size, &bl.FileId, &bl.FileHash, &bl.FileSize)
+		checkErr(err)
+		res = append(res, bl)
+	}
+	return res
+}
+
+func BlockCountByProvider(providerId string) (count int) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	count = blockCountByProvider(tx, providerId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func blockCountByProvider(tx *sql.Tx, providerId string) (count int) {
+	err := tx.QueryRow("SELECT count(*)"+blocksOnProvider("$1"), providerId).Scan(&count)
+	checkErr(err)
+	return
+}
+
+// BlockRemainingOnProvider counts the blocks of files not removed stored on the
+// provider and their size.
+func BlockRemainingOnProvider(providerId string) (count uint64, size uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	count, size = blockRemainingOnProvider(tx, providerId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func blockRemainingOnProvider(tx *sql.Tx, providerId string) (count uint64, size uint64) {
+	err := tx.QueryRow("SELECT count(*),COALESCE(sum(b.SIZE),0)"+blocksOnProvider("$1"), providerId).Scan(&count, &size)
+	checkErr(err)
+	return
+}
+
+// BlockMigrateFailed counts a failed attempt to migrate the block off its
+// provider, and returns the attempts failed so far.
+func BlockMigrateFailed(bl *BlockLocation) (failures int) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("update BLOCK set MIGRATE_FAILURES=MIGRATE_FAILURES+1 where ID=$1 and PROVIDER_ID=$2 RETURNING MIGRATE_FAILURES", bl.Id, bl.ProviderId).Scan(&failures)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// BlockStuckOnProvider counts the blocks of files not removed stored on the
+// provider which failed to be migrated maxFailures times or more.
+func BlockStuckOnProvider(providerId string, maxFailures int) (count int) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT count(*)"+blocksOnProvider("$1")+" and b.MIGRATE_FAILURES>=$2", providerId, maxFailures).Scan(&count)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// BlockProvidersOfFile returns the providers holding any block of the file.
+func BlockProvidersOfFile(fileId []byte) (providerIds []string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerIds = blockProvidersOfFile(tx, fileId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func blockProvidersOfFile(tx *sql.Tx, fileId []byte) []string {
+	rows, err := tx.Query("SELECT distinct PROVIDER_ID FROM BLOCK where FILE_ID=$1 and REMOVED=false", fileId)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]string, 0, 16)
+	for rows.Next() {
+		var pid string
+		err = rows.Scan(&pid)
+		checkErr(err)
+		res = append(res, pid)
+	}
+	return res
+}
+
+// BlockMigrate moves a block to another provider after its data has been
+// copied there, in both BLOCK and the BLOCKS of the file. The placement on the
+// provider it leaves is kept in BLOCK_PLACEMENT, so that each provider is
+// billed for the time it stored the block.
+func BlockMigrate(bl *BlockLocation, toProviderId string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	blockMigrate(tx, bl, toProviderId)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func blockMigrate(tx *sql.Tx, bl *BlockLocation, toProviderId string) {
+	rs, err := tx.Exec("insert into BLOCK_PLACEMENT(BLOCK_ID,PROVIDER_ID,SIZE,START_TIME,END_TIME) select ID,PROVIDER_ID,SIZE,COALESCE(PLACED_TIME,CREATION),now() from BLOCK where ID=$1 and PROVIDER_ID=$2 and REMOVED=false", bl.Id, bl.ProviderId)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	_, err = tx.Exec("update BLOCK set PROVIDER_ID=$3,MIGRATE_FAILURES=0,PLACED_TIME=now() where ID=$1 and PROVIDER_ID=$2 and REMOVED=false", bl.Id, bl.ProviderId, toProviderId)
+	checkErr(err)
+	var blocks NullStrSlice
+	err = tx.QueryRow("SELECT BLOCKS FROM FILE where ID=$1", bl.FileId).Scan(&blocks)
+	checkErr(err)
+	if !blocks.Valid || !replaceBlockNodeId(blocks.StrSlice, bl.Hash, bl.ProviderId, toProviderId) {
+		panic(errors.New("block not found in file"))
+	}
+	updateFileBlocks(tx, bl.FileId, blocks.StrSlice)
+}
+
+// replaceBlockNodeId replaces the node id of the provider storing the block of
+// hash in blocks, the format is the one built by fromPartitions.
+func replaceBlockNodeId(blocks []string, hash string, from string, to string) bool {
+	for i, blk := range blocks {
+		arr := strings.Split(blk, BlockSep)
+		if len(arr) != 5 || arr[0] != hash {
+			continue
+		}
+		nodeIds := strings.Split(arr[4], BlockNodeIdSep)
+		for j, nodeId := range nodeIds {
+			if nodeId == from {
+				nodeIds[j] = to
+				arr[4] = strings.Join(nodeIds, BlockNodeIdSep)
+				blocks[i] = strings.Join(arr, BlockSep)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func updateFileBlocks(tx *sql.Tx, fileId []byte, blocks []string) {
+	stmt, err := tx.Prepare("update FILE set BLOCKS=" + arrayClause(len(blocks), 2) + ",LAST_MODIFIED=now() where ID=$1")
+	defer stmt.Close()
+	checkErr(err)
+	args := make([]interface{}, 1, len(blocks)+1)
+	args[0] = fileId
+	for _, str := range blocks {
+		args = append(args, str)
+	}
+	_, err = stmt.Exec(args...)
+	checkErr(err)
+}
+
 // func saveBlock(tx *sql.Tx, fileId []byte, creation time.Time, hash string, size int, pid string) {
 // 	stmt, err := tx.Prepare("insert into BLOCK(HASH,SIZE,FILE_ID,CREATION,REMOVED,PROVIDER_ID) values($1,$2,$3,$4,false,$5)")
 // 	defer stmt.Close()
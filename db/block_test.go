@@ -0,0 +1,21 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestReplaceBlockNodeId(t *testing.T) {
+	blocks := []string{"hash-1;100;0;0;node-1,node-2", "hash-2;100;1;0;node-2"}
+	if !replaceBlockNodeId(blocks, "hash-2", "node-2", "node-3") {
+		t.Error("failed")
+	}
+	if blocks[0] != "hash-1;100;0;0;node-1,node-2" || blocks[1] != "hash-2;100;1;0;node-3" {
+		t.Errorf("failed: %v", blocks)
+	}
+	if !replaceBlockNodeId(blocks, "hash-1", "node-2", "node-4") || blocks[0] != "hash-1;100;0;0;node-1,node-4" {
+		t.Errorf("failed: %v", blocks)
+	}
+	if replaceBlockNodeId(blocks, "hash-1", "node-5", "node-6") || replaceBlockNodeId(blocks, "hash-3", "node-1", "node-6") {
+		t.Error("failed")
+	}
+}
@@ -14,15 +14,33 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func ClientRegister(nodeId string, pubKeyBytes []byte, pubKey *rsa.PublicKey, contactEmail string, randomCode string) {
+func ClientRegister(nodeId string, pubKeyBytes []byte, pubKey *rsa.PublicKey, contactEmail string, randomCode string, locale string) {
 	tx, commit := beginTx()
 	defer rollback(tx, &commit)
 	saveClient(tx, nodeId, pubKeyBytes, contactEmail, randomCode)
+	if locale != "" {
+		_, err := tx.Exec("update CLIENT set LOCALE=$2 where NODE_ID=$1", nodeId, locale)
+		checkErr(err)
+	}
 	checkErr(tx.Commit())
 	commit = true
 	pubKeyCache.Set(nodeId, pubKey, cache.DefaultExpiration)
 }
 
+// ClientGetLocale returns the locale of the emails to the client, empty for
+// the Locale of the Mail config.
+func ClientGetLocale(nodeId string) (locale string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT COALESCE(LOCALE,'') FROM CLIENT where NODE_ID=$1", nodeId).Scan(&locale)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
 func ClientExistsNodeId(nodeId string) bool {
 	tx, commit := beginTx()
 	defer rollback(tx, &commit)
@@ -51,7 +69,7 @@ func getPublicKeyBytes(nodeId string) []byte {
 }
 
 func getPubKeyBytes(tx *sql.Tx, nodeId string) []byte {
-	rows, err := tx.Query("SELECT PUBLIC_KEY FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId)
+	rows, err := tx.Query("SELECT PUBLIC_KEY FROM CLIENT where NODE_ID=$1 and REMOVED=false and KEY_REVOKED=false", nodeId)
 	checkErr(err)
 	defer rows.Close()
 	for rows.Next() {
@@ -60,7 +78,19 @@ func getPubKeyBytes(tx *sql.Tx, nodeId string) []byte {
 		checkErr(err)
 		return pubKey
 	}
-	return nil
+	return getDevicePubKeyBytes(tx, nodeId)
+}
+
+func clientKeyInUse(nodeId string) bool {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT 1 FROM CLIENT where NODE_ID=$1 and REMOVED=false and KEY_REVOKED=false UNION ALL SELECT 1 FROM CLIENT_DEVICE d join CLIENT c on d.ACCOUNT_ID=c.NODE_ID where d.NODE_ID=$1 and d.APPROVED=true and d.REVOKED=false and c.REMOVED=false", nodeId)
+	checkErr(err)
+	inUse := rows.Next()
+	rows.Close()
+	checkErr(tx.Commit())
+	commit = true
+	return inUse
 }
 
 func saveClient(tx *sql.Tx, nodeId string, pubKeyBytes []byte, contactEmail string, randomCode string) {
@@ -78,7 +108,7 @@ func existsNodeId(tx *sql.Tx, nodeId string) bool {
 	for rows.Next() {
 		return true
 	}
-	return false
+	return existsDevice(tx, nodeId)
 }
 
 func existsContactEmail(tx *sql.Tx, contactEmail string) bool {
@@ -164,6 +194,10 @@ func updateVerifyCode(tx *sql.Tx, nodeId string, randomCode string) {
 
 var pubKeyCache = cache.New(20*time.Minute, 10*time.Minute)
 
+// ClientGetPubKey returns the key of the account or device in use, nil if
+// revoked or removed. The cache only saves parsing the key, whether it is in
+// use is checked every time so that a revocation on any tracker takes effect
+// at once.
 func ClientGetPubKey(nodeIdStr string) *rsa.PublicKey {
 	pubKey, found := pubKeyCache.Get(nodeIdStr)
 	if found {
@@ -171,6 +205,11 @@ func ClientGetPubKey(nodeIdStr string) *rsa.PublicKey {
 		if !ok {
 			panic(errors.New("Error type get from cache"))
 		}
+		if !clientKeyInUse(nodeIdStr) {
+			pubKeyCache.Delete(nodeIdStr)
+			accountCache.Delete(nodeIdStr)
+			return nil
+		}
 		return b
 	} else {
 		pubKeyBytes := getPublicKeyBytes(nodeIdStr)
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ClientUpdateDeleteCode saves the code sent to the contact email to confirm
+// the deletion of the account.
+func ClientUpdateDeleteCode(nodeId string, code string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update CLIENT set DELETE_CODE=$2,DELETE_CODE_TIME=now(),LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, code)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func ClientGetDeleteCode(nodeId string) (found bool, code string, sendTime time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var codeNullable sql.NullString
+	var sendTimeNullable NullTime
+	err := tx.QueryRow("SELECT DELETE_CODE,DELETE_CODE_TIME FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&codeNullable, &sendTimeNullable)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		found = true
+		if codeNullable.Valid {
+			code = codeNullable.String
+		}
+		if sendTimeNullable.Valid {
+			sendTime = sendTimeNullable.Time
+		}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ClientDeleteAccount removes the client with all its devices, all its files
+// and folders so their blocks can be collected, and cancels its unpaid orders.
+// The recharge address is retired with the client rather than given back to
+// the pool, so that nothing sent to it later is credited to another client. It
+// is refused while balance is left unless forfeitBalance, the balance left is
+// returned either way.
+func ClientDeleteAccount(nodeId string, forfeitBalance bool) (deleted bool, balance uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT BALANCE FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&balance)
+	if err == sql.ErrNoRows {
+		panic(errors.New("no record found"))
+	}
+	checkErr(err)
+	if balance > 0 && !forfeitBalance {
+		return false, balance
+	}
+	_, err = tx.Exec("update FILE_OWNER set REMOVED=true,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false", nodeId)
+	checkErr(err)
+	cancelUnpaidOrder(tx, nodeId)
+	devices := revokeAllDevice(tx, nodeId)
+	_, err = tx.Exec("update CLIENT set REMOVED=true,ACTIVE=false,REMOVE_TIME=now(),LAST_MODIFIED=now(),DELETE_CODE=NULL,DELETE_CODE_TIME=NULL,RANDOM_CODE=NULL,SEND_TIME=NULL where NODE_ID=$1", nodeId)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	evictClientKey(nodeId)
+	evictClientKey(devices...)
+	return true, balance
+}
+
+type ExportedFile struct {
+	Id       []byte    `json:"id"`
+	ParentId []byte    `json:"parentId,omitempty"`
+	SpaceNo  uint32    `json:"spaceNo"`
+	Folder   bool      `json:"folder"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+	Size     uint64    `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Creation time.Time `json:"creation"`
+}
+
+type AccountExport struct {
+	NodeId       string           `json:"nodeId"`
+	ContactEmail string           `json:"contactEmail"`
+	Creation     time.Time        `json:"creation"`
+	Balance      uint64           `json:"balance"`
+	Files        []*ExportedFile  `json:"files"`
+	Orders       []*OrderInfo     `json:"orders"`
+	Deposits     []*DepositRecord `json:"deposits"`
+}
+
+// ClientExportAccount collects the metadata tree, the orders and the deposits
+// of the client, files refer to their folder by parentId.
+func ClientExportAccount(nodeId string) (ae *AccountExport) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	ae = &AccountExport{NodeId: nodeId}
+	var address sql.NullString
+	err := tx.QueryRow("SELECT CONTACT_EMAIL,CREATION,BALANCE,RECHARGE_ADDRESS FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&ae.ContactEmail, &ae.Creation, &ae.Balance, &address)
+	if err == sql.ErrNoRows {
+		panic(errors.New("no record found"))
+	}
+	checkErr(err)
+	ae.Files = exportFiles(tx, nodeId)
+	ae.Orders = myAllOrder(tx, nodeId, false)
+	if address.Valid {
+		ae.Deposits = depositRecordsOfAddress(tx, address.String)
+	} else {
+		ae.Deposits = []*DepositRecord{}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func exportFiles(tx *sql.Tx, nodeId string) []*ExportedFile {
+	rows, err := tx.Query("SELECT ID,PARENT_ID,SPACE_NO,FOLDER,NAME,TYPE,HASH,SIZE,MOD_TIME,CREATION FROM FILE_OWNER where NODE_ID=$1 and REMOVED=false order by SPACE_NO,CREATION", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*ExportedFile, 0, 64)
+	for rows.Next() {
+		ef := &ExportedFile{}
+		var fileType, hash sql.NullString
+		err = rows.Scan(&ef.Id, &ef.ParentId, &ef.SpaceNo, &ef.Folder, &ef.Name, &fileType, &hash, &ef.Size, &ef.ModTime, &ef.Creation)
+		checkErr(err)
+		if fileType.Valid {
+			ef.Type = fileType.String
+		}
+		if hash.Valid {
+			ef.Hash = hash.String
+		}
+		res = append(res, ef)
+	}
+	return res
+}
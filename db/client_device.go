@@ -0,0 +1,205 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+type ClientDevice struct {
+	NodeId   string
+	Name     string
+	Primary  bool // the device registered the account
+	Approved bool
+	Revoked  bool
+	Creation time.Time
+}
+
+func getDevicePubKeyBytes(tx *sql.Tx, nodeId string) []byte {
+	rows, err := tx.Query("SELECT d.PUBLIC_KEY FROM CLIENT_DEVICE d join CLIENT c on d.ACCOUNT_ID=c.NODE_ID where d.NODE_ID=$1 and d.APPROVED=true and d.REVOKED=false and c.REMOVED=false", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var pubKey []byte
+		err = rows.Scan(&pubKey)
+		checkErr(err)
+		return pubKey
+	}
+	return nil
+}
+
+func existsDevice(tx *sql.Tx, nodeId string) bool {
+	rows, err := tx.Query("SELECT APPROVED FROM CLIENT_DEVICE where NODE_ID=$1", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		return true
+	}
+	return false
+}
+
+var accountCache = cache.New(20*time.Minute, 10*time.Minute)
+
+// ClientAccountOf returns the node id of the account the device belongs to,
+// files, packages and usage are all kept under it, a node id not belonging to
+// any device is returned as it is.
+func ClientAccountOf(nodeId string) string {
+	if accountId, found := accountCache.Get(nodeId); found {
+		return accountId.(string)
+	}
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var accountId string
+	err := tx.QueryRow("SELECT ACCOUNT_ID FROM CLIENT_DEVICE where NODE_ID=$1 and APPROVED=true and REVOKED=false UNION ALL SELECT NODE_ID FROM CLIENT where NODE_ID=$1", nodeId).Scan(&accountId)
+	found := err != sql.ErrNoRows
+	if found {
+		checkErr(err)
+	} else {
+		accountId = nodeId
+	}
+	checkErr(tx.Commit())
+	commit = true
+	if found {
+		accountCache.Set(nodeId, accountId, cache.DefaultExpiration)
+	}
+	return accountId
+}
+
+// ClientAccountOfContactEmail returns the account registered with the
+// verified contact email.
+func ClientAccountOfContactEmail(contactEmail string) (found bool, accountId string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT NODE_ID FROM CLIENT where CONTACT_EMAIL=$1 and EMAIL_VERIFIED=true and REMOVED=false", contactEmail).Scan(&accountId)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		found = true
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ClientAddDevice saves a device waiting for the approval of the account, it
+// replaces the pending request of the same device.
+func ClientAddDevice(accountId string, nodeId string, pubKeyBytes []byte, name string, randomCode string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("UPSERT INTO CLIENT_DEVICE(NODE_ID,ACCOUNT_ID,PUBLIC_KEY,NAME,CREATION,LAST_MODIFIED,APPROVED,RANDOM_CODE,SEND_TIME,REVOKED) values ($1,$2,$3,$4,now(),now(),false,$5,now(),false)")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, accountId, pubKeyBytes, name, randomCode)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func ClientGetPendingDevice(nodeId string) (found bool, accountId string, pubKeyBytes []byte, name string, randomCode string, sendTime time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var randomCodeNullable sql.NullString
+	var sendTimeNullable NullTime
+	err := tx.QueryRow("SELECT ACCOUNT_ID,PUBLIC_KEY,NAME,RANDOM_CODE,SEND_TIME FROM CLIENT_DEVICE where NODE_ID=$1 and APPROVED=false and REVOKED=false", nodeId).Scan(&accountId, &pubKeyBytes, &name, &randomCodeNullable, &sendTimeNullable)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		found = true
+		if randomCodeNullable.Valid {
+			randomCode = randomCodeNullable.String
+		}
+		if sendTimeNullable.Valid {
+			sendTime = sendTimeNullable.Time
+		}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func ClientApproveDevice(accountId string, nodeId string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update CLIENT_DEVICE set APPROVED=true,RANDOM_CODE=NULL,SEND_TIME=NULL,LAST_MODIFIED=now() where NODE_ID=$1 and ACCOUNT_ID=$2 and APPROVED=false and REVOKED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, accountId)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// ClientListDevice returns the devices of the account, the one registered the
+// account first.
+func ClientListDevice(accountId string) []*ClientDevice {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	res := make([]*ClientDevice, 0, 4)
+	cd := &ClientDevice{NodeId: accountId, Name: "primary", Primary: true, Approved: true}
+	err := tx.QueryRow("SELECT KEY_REVOKED,CREATION FROM CLIENT where NODE_ID=$1 and REMOVED=false", accountId).Scan(&cd.Revoked, &cd.Creation)
+	checkErr(err)
+	res = append(res, cd)
+	rows, err := tx.Query("SELECT NODE_ID,NAME,APPROVED,REVOKED,CREATION FROM CLIENT_DEVICE where ACCOUNT_ID=$1 order by CREATION", accountId)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		cd = &ClientDevice{}
+		err = rows.Scan(&cd.NodeId, &cd.Name, &cd.Approved, &cd.Revoked, &cd.Creation)
+		checkErr(err)
+		res = append(res, cd)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return res
+}
+
+// ClientRevokeDevice revokes a device of the account, or rejects it if not
+// approved yet, unless it is the last one in use. The device registered the
+// account can be revoked as well.
+func ClientRevokeDevice(accountId string, nodeId string) (lastDevice bool) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var others int
+	err := tx.QueryRow("SELECT (SELECT count(1) FROM CLIENT where NODE_ID=$1 and NODE_ID<>$2 and REMOVED=false and KEY_REVOKED=false)+(SELECT count(1) FROM CLIENT_DEVICE where ACCOUNT_ID=$1 and NODE_ID<>$2 and APPROVED=true and REVOKED=false)", accountId, nodeId).Scan(&others)
+	checkErr(err)
+	if others == 0 {
+		return true
+	}
+	revokeKey(tx, accountId, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+	evictClientKey(nodeId)
+	return false
+}
+
+// evictClientKey drops the cached key and account of the node ids revoked on
+// this tracker, the others find them revoked by ClientGetPubKey.
+func evictClientKey(nodeIds ...string) {
+	for _, nodeId := range nodeIds {
+		pubKeyCache.Delete(nodeId)
+		accountCache.Delete(nodeId)
+	}
+}
+
+// revokeAllDevice revokes all the devices of the account, returning their
+// node ids.
+func revokeAllDevice(tx *sql.Tx, accountId string) []string {
+	rows, err := tx.Query("SELECT NODE_ID FROM CLIENT_DEVICE where ACCOUNT_ID=$1 and REVOKED=false", accountId)
+	checkErr(err)
+	nodeIds := make([]string, 0, 4)
+	for rows.Next() {
+		var nodeId string
+		err = rows.Scan(&nodeId)
+		checkErr(err)
+		nodeIds = append(nodeIds, nodeId)
+	}
+	rows.Close()
+	_, err = tx.Exec("update CLIENT_DEVICE set REVOKED=true,REVOKE_TIME=now(),LAST_MODIFIED=now() where ACCOUNT_ID=$1 and REVOKED=false", accountId)
+	checkErr(err)
+	return nodeIds
+}
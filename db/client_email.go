@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ClientEmailChangeAttempt counts an attempt to change the contact email,
+// returns false without counting it if limit attempts were made since the
+// given time already.
+func ClientEmailChangeAttempt(nodeId string, since time.Time, limit int) bool {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update CLIENT set EMAIL_CHANGE_ATTEMPTS=CASE WHEN EMAIL_CHANGE_SINCE is null or EMAIL_CHANGE_SINCE<$2 THEN 1 ELSE EMAIL_CHANGE_ATTEMPTS+1 END,EMAIL_CHANGE_SINCE=CASE WHEN EMAIL_CHANGE_SINCE is null or EMAIL_CHANGE_SINCE<$2 THEN now() ELSE EMAIL_CHANGE_SINCE END where NODE_ID=$1 and REMOVED=false and (EMAIL_CHANGE_SINCE is null or EMAIL_CHANGE_SINCE<$2 or EMAIL_CHANGE_ATTEMPTS<$3)")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, since, limit)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return cnt > 0
+}
+
+// ClientChangeContactEmail keeps the new contact email aside until it is
+// verified with the code, the current one stays in use till then.
+func ClientChangeContactEmail(nodeId string, contactEmail string, code string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update CLIENT set NEW_CONTACT_EMAIL=$2,NEW_EMAIL_CODE=$3,NEW_EMAIL_SEND_TIME=now(),LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, contactEmail, code)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func ClientGetNewContactEmail(nodeId string) (found bool, contactEmail string, newContactEmail string, code string, sendTime time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var newEmailNullable, codeNullable sql.NullString
+	var sendTimeNullable NullTime
+	err := tx.QueryRow("SELECT CONTACT_EMAIL,NEW_CONTACT_EMAIL,NEW_EMAIL_CODE,NEW_EMAIL_SEND_TIME FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&contactEmail, &newEmailNullable, &codeNullable, &sendTimeNullable)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		found = true
+		if newEmailNullable.Valid {
+			newContactEmail = newEmailNullable.String
+		}
+		if codeNullable.Valid {
+			code = codeNullable.String
+		}
+		if sendTimeNullable.Valid {
+			sendTime = sendTimeNullable.Time
+		}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ClientConfirmNewContactEmail replaces the contact email with the verified
+// new one, unless another client registered it in the meantime.
+func ClientConfirmNewContactEmail(nodeId string) (taken bool) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var newContactEmail string
+	err := tx.QueryRow("SELECT NEW_CONTACT_EMAIL FROM CLIENT where NODE_ID=$1 and REMOVED=false and NEW_CONTACT_EMAIL is not null", nodeId).Scan(&newContactEmail)
+	if err == sql.ErrNoRows {
+		panic(errors.New("no record found"))
+	}
+	checkErr(err)
+	if existsContactEmail(tx, newContactEmail) {
+		taken = true
+	} else {
+		_, err = tx.Exec("update CLIENT set CONTACT_EMAIL=NEW_CONTACT_EMAIL,EMAIL_VERIFIED=true,RANDOM_CODE=NULL,SEND_TIME=NULL,LAST_MODIFIED=now() where NODE_ID=$1", nodeId)
+		checkErr(err)
+	}
+	_, err = tx.Exec("update CLIENT set NEW_CONTACT_EMAIL=NULL,NEW_EMAIL_CODE=NULL,NEW_EMAIL_SEND_TIME=NULL where NODE_ID=$1", nodeId)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
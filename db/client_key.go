@@ -0,0 +1,134 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ClientRotateKey puts the new key of a device in use for the account and
+// revokes the old one. The encrypt keys of files are kept by the tracker in
+// plain and encrypted with the key of the requesting node on retrieval, so
+// there is nothing to re-encrypt.
+func ClientRotateKey(accountId string, oldNodeId string, newNodeId string, pubKeyBytes []byte, name string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	addApprovedDevice(tx, accountId, newNodeId, pubKeyBytes, name)
+	revokeKey(tx, accountId, oldNodeId)
+	checkErr(tx.Commit())
+	commit = true
+	evictClientKey(oldNodeId)
+}
+
+func addApprovedDevice(tx *sql.Tx, accountId string, nodeId string, pubKeyBytes []byte, name string) {
+	stmt, err := tx.Prepare("insert into CLIENT_DEVICE(NODE_ID,ACCOUNT_ID,PUBLIC_KEY,NAME,CREATION,LAST_MODIFIED,APPROVED,REVOKED) values ($1,$2,$3,$4,now(),now(),true,false)")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, accountId, pubKeyBytes, name)
+	checkErr(err)
+}
+
+func revokeKey(tx *sql.Tx, accountId string, nodeId string) {
+	var rs sql.Result
+	var err error
+	if nodeId == accountId {
+		rs, err = tx.Exec("update CLIENT set KEY_REVOKED=true,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false and KEY_REVOKED=false", nodeId)
+	} else {
+		rs, err = tx.Exec("update CLIENT_DEVICE set REVOKED=true,REVOKE_TIME=now(),LAST_MODIFIED=now() where NODE_ID=$1 and ACCOUNT_ID=$2 and REVOKED=false", nodeId, accountId)
+	}
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+}
+
+// ClientDeviceName returns the name of the device, the device registered the
+// account is named primary.
+func ClientDeviceName(accountId string, nodeId string) (name string) {
+	if nodeId == accountId {
+		return "primary"
+	}
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT NAME FROM CLIENT_DEVICE where NODE_ID=$1 and ACCOUNT_ID=$2", nodeId, accountId).Scan(&name)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ClientSetRecoveryCode saves the hash of the recovery code of the account,
+// replacing the former one.
+func ClientSetRecoveryCode(accountId string, codeHash string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update CLIENT set RECOVERY_CODE_HASH=$2,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(accountId, codeHash)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func ClientGetRecovery(accountId string) (found bool, codeHash string, emailCode string, sendTime time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var codeHashNullable, emailCodeNullable sql.NullString
+	var sendTimeNullable NullTime
+	err := tx.QueryRow("SELECT RECOVERY_CODE_HASH,RECOVERY_EMAIL_CODE,RECOVERY_SEND_TIME FROM CLIENT where NODE_ID=$1 and REMOVED=false", accountId).Scan(&codeHashNullable, &emailCodeNullable, &sendTimeNullable)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		found = true
+		if codeHashNullable.Valid {
+			codeHash = codeHashNullable.String
+		}
+		if emailCodeNullable.Valid {
+			emailCode = emailCodeNullable.String
+		}
+		if sendTimeNullable.Valid {
+			sendTime = sendTimeNullable.Time
+		}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ClientUpdateRecoveryEmailCode saves the code sent to the contact email for
+// recovering the account, an empty code clears it.
+func ClientUpdateRecoveryEmailCode(accountId string, code string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var err error
+	if code == "" {
+		_, err = tx.Exec("update CLIENT set RECOVERY_EMAIL_CODE=NULL,LAST_MODIFIED=now() where NODE_ID=$1", accountId)
+	} else {
+		_, err = tx.Exec("update CLIENT set RECOVERY_EMAIL_CODE=$2,RECOVERY_SEND_TIME=now(),LAST_MODIFIED=now() where NODE_ID=$1", accountId, code)
+	}
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// ClientRecoverKey puts the new key in use for the account, revoking all the
+// others, and replaces the recovery code which is used up.
+func ClientRecoverKey(accountId string, nodeId string, pubKeyBytes []byte, name string, codeHash string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	revoked := revokeAllDevice(tx, accountId)
+	_, err := tx.Exec("update CLIENT set KEY_REVOKED=true,RECOVERY_CODE_HASH=$2,RECOVERY_EMAIL_CODE=NULL,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false", accountId, codeHash)
+	checkErr(err)
+	addApprovedDevice(tx, accountId, nodeId, pubKeyBytes, name)
+	checkErr(tx.Commit())
+	commit = true
+	evictClientKey(accountId)
+	evictClientKey(revoked...)
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// NoticeCandidate is a client whose package ends after the time given to
+// ClientNoticeCandidates, limits and usage are in MB.
+type NoticeCandidate struct {
+	NodeId           string
+	ContactEmail     string
+	Locale           string
+	EndTime          time.Time
+	Volume           uint64
+	Netflow          uint64
+	UpNetflow        uint64
+	DownNetflow      uint64
+	UsageVolume      uint64
+	UsageNetflow     uint64
+	UsageUpNetflow   uint64
+	UsageDownNetflow uint64
+}
+
+// ClientNoticeCandidates returns the verified clients whose package ends after
+// endAfter.
+func ClientNoticeCandidates(endAfter time.Time) []*NoticeCandidate {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT c.NODE_ID,c.CONTACT_EMAIL,COALESCE(c.LOCALE,''),c.END_TIME,c.VOLUME,c.NETFLOW,c.UP_NETFLOW,c.DOWN_NETFLOW,(a.VOLUME/1048576)::INT,(a.NETFLOW/1048576)::INT,(a.UP_NETFLOW/1048576)::INT,(a.DOWN_NETFLOW/1048576)::INT FROM CLIENT c LEFT OUTER JOIN CLIENT_USAGE_AMOUNT a on c.NODE_ID=a.NODE_ID where c.REMOVED=false and c.EMAIL_VERIFIED=true and c.END_TIME is not null and c.END_TIME>$1", endAfter)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*NoticeCandidate, 0, 64)
+	for rows.Next() {
+		nc := &NoticeCandidate{}
+		var usageVolume, usageNetflow, usageUpNetflow, usageDownNetflow sql.NullInt64
+		err = rows.Scan(&nc.NodeId, &nc.ContactEmail, &nc.Locale, &nc.EndTime, &nc.Volume, &nc.Netflow, &nc.UpNetflow, &nc.DownNetflow, &usageVolume, &usageNetflow, &usageUpNetflow, &usageDownNetflow)
+		checkErr(err)
+		// package volume and netflow are in GB
+		nc.Volume, nc.Netflow, nc.UpNetflow, nc.DownNetflow = nc.Volume*1024, nc.Netflow*1024, nc.UpNetflow*1024, nc.DownNetflow*1024
+		if usageVolume.Valid {
+			nc.UsageVolume = uint64(usageVolume.Int64)
+		}
+		if usageNetflow.Valid {
+			nc.UsageNetflow = uint64(usageNetflow.Int64)
+		}
+		if usageUpNetflow.Valid {
+			nc.UsageUpNetflow = uint64(usageUpNetflow.Int64)
+		}
+		if usageDownNetflow.Valid {
+			nc.UsageDownNetflow = uint64(usageDownNetflow.Int64)
+		}
+		res = append(res, nc)
+	}
+	checkErr(rows.Err())
+	checkErr(tx.Commit())
+	commit = true
+	return res
+}
+
+// ClientNoticeRecord records the notice of the kind at the threshold for the
+// package ending at periodEnd, false if it was recorded already.
+func ClientNoticeRecord(nodeId string, kind string, threshold int, periodEnd time.Time) bool {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rs, err := tx.Exec("insert into CLIENT_NOTICE(NODE_ID,KIND,THRESHOLD,PERIOD_END,CREATION) values ($1,$2,$3,$4,now()) ON CONFLICT (NODE_ID,KIND,THRESHOLD,PERIOD_END) DO NOTHING", nodeId, kind, threshold, periodEnd)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return cnt > 0
+}
+
+// ClientNoticeClean removes the notices of the packages ended before the time
+// and sent before it as well, the retention notices of long ended packages are
+// sent late and needed till the files are removed.
+func ClientNoticeClean(before time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	_, err := tx.Exec("delete from CLIENT_NOTICE where PERIOD_END<$1 and CREATION<$1", before)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
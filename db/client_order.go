@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"time"
@@ -31,12 +32,30 @@ type OrderInfo struct {
 	Paid         bool
 	PayTime      uint64
 	Remark       string
+	// a downgraded package takes effect when the current one ends
+	Downgraded bool
+	// package in service when ordered, 0 if none
+	FromPackageId int64
+	// TotalAmount is BaseAmount - DiscountAmount + UpgradeAmount, the upgrade
+	// amount is the price difference from UpgradeStart to UpgradeEnd
+	BaseAmount     uint64
+	DiscountAmount uint64
+	UpgradeAmount  uint64
+	UpgradeStart   uint64
+	UpgradeEnd     uint64
+	State          int
+	// filled by GetOrderInfo and MyAllOrder only
+	Events []*OrderEvent
 }
 
 func MyAllOrder(nodeId string, onlyNotExpired bool) (res []*OrderInfo) {
 	tx, commit := beginTx()
 	defer rollback(tx, &commit)
 	res = myAllOrder(tx, nodeId, onlyNotExpired)
+	events := clientOrderEvents(tx, nodeId)
+	for _, oi := range res {
+		oi.Events = events[hex.EncodeToString(oi.Id)]
+	}
 	checkErr(tx.Commit())
 	commit = true
 	return
@@ -46,6 +65,9 @@ func GetOrderInfo(nodeId string, id []byte) (oi *OrderInfo) {
 	tx, commit := beginTx()
 	defer rollback(tx, &commit)
 	oi = getOrderInfo(tx, nodeId, id)
+	if oi != nil {
+		oi.Events = orderEvents(tx, id)
+	}
 	checkErr(tx.Commit())
 	commit = true
 	return
@@ -60,17 +82,11 @@ func RemoveOrder(nodeId string, id []byte) {
 }
 
 func removeOrder(tx *sql.Tx, nodeId string, id []byte) {
-	stmt, err := tx.Prepare("update CLIENT_ORDER set REMOVED=true,LAST_MODIFIED=now() where NODE_ID=$1 and ID=$2 and REMOVED=false and PAY_TIME is null")
-	defer stmt.Close()
-	checkErr(err)
-	rs, err := stmt.Exec(nodeId, id)
-	checkErr(err)
-	_, err = rs.RowsAffected()
-	checkErr(err)
+	cancelOrders(tx, nodeId, " and ID=$4", OrderOperatorClient, "removed by client", id)
 }
 
 func myAllOrder(tx *sql.Tx, nodeId string, onlyNotExpired bool) []*OrderInfo {
-	sqlStr := "select o.ID,o.REMOVED,o.CREATION,o.LAST_MODIFIED,o.NODE_ID,o.PACKAGE_ID,o.QUANTITY,o.TOTAL_AMOUNT,o.UPGRADED,o.DISCOUNT,o.VOLUME,o.NETFLOW,o.UP_NETFLOW,o.DOWN_NETFLOW,o.VALID_DAYS,o.START_TIME,o.END_TIME,o.PAY_TIME,o.REMARK,p.ID,p.NAME,p.PRICE,p.CREATION,p.LAST_MODIFIED,p.REMOVED,p.VOLUME,p.NETFLOW,p.UP_NETFLOW,p.DOWN_NETFLOW,p.VALID_DAYS,p.REMARK from CLIENT_ORDER o,PACKAGE p where o.NODE_ID=$1 and o.PACKAGE_ID=p.ID and o.REMOVED=false"
+	sqlStr := "select o.ID,o.REMOVED,o.CREATION,o.LAST_MODIFIED,o.NODE_ID,o.PACKAGE_ID,o.QUANTITY,o.TOTAL_AMOUNT,o.UPGRADED,o.DISCOUNT,o.VOLUME,o.NETFLOW,o.UP_NETFLOW,o.DOWN_NETFLOW,o.VALID_DAYS,o.START_TIME,o.END_TIME,o.PAY_TIME,o.REMARK,o.DOWNGRADED,o.FROM_PACKAGE_ID,o.BASE_AMOUNT,o.DISCOUNT_AMOUNT,o.UPGRADE_AMOUNT,o.UPGRADE_START,o.UPGRADE_END,o.STATE,p.ID,p.NAME,p.PRICE,p.CREATION,p.LAST_MODIFIED,p.REMOVED,p.VOLUME,p.NETFLOW,p.UP_NETFLOW,p.DOWN_NETFLOW,p.VALID_DAYS,p.REMARK from CLIENT_ORDER o,PACKAGE p where o.NODE_ID=$1 and o.PACKAGE_ID=p.ID and o.REMOVED=false"
 	if onlyNotExpired {
 		sqlStr += " and (END_TIME is null or END_TIME>now())"
 	}
@@ -85,7 +101,7 @@ func myAllOrder(tx *sql.Tx, nodeId string, onlyNotExpired bool) []*OrderInfo {
 }
 
 func getOrderInfo(tx *sql.Tx, nodeId string, id []byte) (oi *OrderInfo) {
-	rows, err := tx.Query("select o.ID,o.REMOVED,o.CREATION,o.LAST_MODIFIED,o.NODE_ID,o.PACKAGE_ID,o.QUANTITY,o.TOTAL_AMOUNT,o.UPGRADED,o.DISCOUNT,o.VOLUME,o.NETFLOW,o.UP_NETFLOW,o.DOWN_NETFLOW,o.VALID_DAYS,o.START_TIME,o.END_TIME,o.PAY_TIME,o.REMARK,p.ID,p.NAME,p.PRICE,p.CREATION,p.LAST_MODIFIED,p.REMOVED,p.VOLUME,p.NETFLOW,p.UP_NETFLOW,p.DOWN_NETFLOW,p.VALID_DAYS,p.REMARK from CLIENT_ORDER o,PACKAGE p where o.ID=$2 and o.NODE_ID=$1 and o.PACKAGE_ID=p.ID and o.REMOVED=false", nodeId, id)
+	rows, err := tx.Query("select o.ID,o.REMOVED,o.CREATION,o.LAST_MODIFIED,o.NODE_ID,o.PACKAGE_ID,o.QUANTITY,o.TOTAL_AMOUNT,o.UPGRADED,o.DISCOUNT,o.VOLUME,o.NETFLOW,o.UP_NETFLOW,o.DOWN_NETFLOW,o.VALID_DAYS,o.START_TIME,o.END_TIME,o.PAY_TIME,o.REMARK,o.DOWNGRADED,o.FROM_PACKAGE_ID,o.BASE_AMOUNT,o.DISCOUNT_AMOUNT,o.UPGRADE_AMOUNT,o.UPGRADE_START,o.UPGRADE_END,o.STATE,p.ID,p.NAME,p.PRICE,p.CREATION,p.LAST_MODIFIED,p.REMOVED,p.VOLUME,p.NETFLOW,p.UP_NETFLOW,p.DOWN_NETFLOW,p.VALID_DAYS,p.REMARK from CLIENT_ORDER o,PACKAGE p where o.ID=$2 and o.NODE_ID=$1 and o.PACKAGE_ID=p.ID and o.REMOVED=false", nodeId, id)
 	checkErr(err)
 	defer rows.Close()
 	for rows.Next() {
@@ -97,11 +113,13 @@ func getOrderInfo(tx *sql.Tx, nodeId string, id []byte) (oi *OrderInfo) {
 func buildOrderInfo(rows *sql.Rows) *OrderInfo {
 	oi := OrderInfo{}
 	pi := PackageInfo{}
-	var startTime, endTime, payTime NullTime
+	var startTime, endTime, payTime, upgradeStart, upgradeEnd NullTime
 	var orderRemarkNullable, packageRemarkNullable sql.NullString
+	var fromPackageIdNullable sql.NullInt64
 	err := rows.Scan(&oi.Id, &oi.Removed, &oi.Creation, &oi.LastModified, &oi.NodeId, &oi.PackageId, &oi.Quanlity, &oi.TotalAmount,
 		&oi.Upgraded, &oi.Discount, &oi.Volume, &oi.Netflow, &oi.UpNetflow, &oi.DownNetflow, &oi.ValidDays, &startTime, &endTime,
-		&payTime, &orderRemarkNullable, &pi.Id, &pi.Name, &pi.Price, &pi.Creation, &pi.LastModified, &pi.Removed, &pi.Volume,
+		&payTime, &orderRemarkNullable, &oi.Downgraded, &fromPackageIdNullable, &oi.BaseAmount, &oi.DiscountAmount, &oi.UpgradeAmount,
+		&upgradeStart, &upgradeEnd, &oi.State, &pi.Id, &pi.Name, &pi.Price, &pi.Creation, &pi.LastModified, &pi.Removed, &pi.Volume,
 		&pi.Netflow, &pi.UpNetflow, &pi.DownNetflow, &pi.ValidDays, &packageRemarkNullable)
 	checkErr(err)
 	if startTime.Valid {
@@ -117,6 +135,15 @@ func buildOrderInfo(rows *sql.Rows) *OrderInfo {
 	if orderRemarkNullable.Valid {
 		oi.Remark = orderRemarkNullable.String
 	}
+	if fromPackageIdNullable.Valid {
+		oi.FromPackageId = fromPackageIdNullable.Int64
+	}
+	if upgradeStart.Valid {
+		oi.UpgradeStart = uint64(upgradeStart.Time.Unix())
+	}
+	if upgradeEnd.Valid {
+		oi.UpgradeEnd = uint64(upgradeEnd.Time.Unix())
+	}
 	if packageRemarkNullable.Valid {
 		pi.Remark = packageRemarkNullable.String
 	}
@@ -124,11 +151,15 @@ func buildOrderInfo(rows *sql.Rows) *OrderInfo {
 	return &oi
 }
 
-func BuyPackage(nodeId string, packageId int64, quanlity uint32, cancelUnpaid bool, renew bool, endTime time.Time, upgrade bool, oldPackageId int64) (oi *OrderInfo) {
+// BuyPackage creates an order of the package, an upgrade or a downgrade
+// supersedes the unpaid ones of the client.
+func BuyPackage(nodeId string, packageId int64, quanlity uint32, cancelUnpaid bool, renew bool, endTime time.Time, upgrade bool, downgrade bool, oldPackageId int64) (oi *OrderInfo) {
 	tx, commit := beginTx()
 	defer rollback(tx, &commit)
 	if cancelUnpaid {
 		cancelUnpaidOrder(tx, nodeId)
+	} else if upgrade || downgrade {
+		cancelUnpaidPlanChange(tx, nodeId)
 	}
 	pi := getPackageInfo(tx, packageId)
 	var priceOffset uint64
@@ -139,7 +170,7 @@ func BuyPackage(nodeId string, packageId int64, quanlity uint32, cancelUnpaid bo
 		}
 	}
 	discount := getPackageQuantityDiscount(tx, pi.Id, quanlity)
-	id := buyPackage(tx, nodeId, pi, quanlity, discount, renew, endTime, upgrade, oldPackageId, priceOffset)
+	id := buyPackage(tx, nodeId, pi, quanlity, discount, renew, endTime, upgrade, downgrade, oldPackageId, priceOffset, OrderOperatorClient)
 	oi = getOrderInfo(tx, nodeId, id)
 	checkErr(tx.Commit())
 	commit = true
@@ -147,50 +178,75 @@ func BuyPackage(nodeId string, packageId int64, quanlity uint32, cancelUnpaid bo
 }
 
 func cancelUnpaidOrder(tx *sql.Tx, nodeId string) {
-	stmt, err := tx.Prepare("update CLIENT_ORDER set REMOVED=true,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false and PAY_TIME is null")
-	defer stmt.Close()
-	checkErr(err)
-	rs, err := stmt.Exec(nodeId)
-	checkErr(err)
-	_, err = rs.RowsAffected()
-	checkErr(err)
+	cancelOrders(tx, nodeId, "", OrderOperatorClient, "cancelled by a new order")
+}
+
+func cancelUnpaidPlanChange(tx *sql.Tx, nodeId string) {
+	cancelOrders(tx, nodeId, " and (UPGRADED=true or DOWNGRADED=true)", OrderOperatorClient, "superseded by a new plan change")
+}
+
+// cancelUnpaidFromPackage cancels the unpaid orders of the client but the one
+// given which were priced against the package in service then.
+func cancelUnpaidFromPackage(tx *sql.Tx, nodeId string, exceptId []byte, operator string) {
+	cancelOrders(tx, nodeId, " and ID<>$4 and FROM_PACKAGE_ID is not null", operator, "package changed by order "+hex.EncodeToString(exceptId), exceptId)
 }
 
-func updatePayTime(tx *sql.Tx, nodeId string, id []byte, startTime time.Time, endTime time.Time, payTime time.Time) {
-	stmt, err := tx.Prepare("update CLIENT_ORDER set START_TIME=$3,END_TIME=$4,PAY_TIME=$5,LAST_MODIFIED=$6 where NODE_ID=$1 and ID=$2 and PAY_TIME is null")
+// updatePayTime changes the order to paid, or to active if its period begins
+// at payTime.
+func updatePayTime(tx *sql.Tx, nodeId string, id []byte, startTime time.Time, endTime time.Time, payTime time.Time, operator string) {
+	state := OrderStatePaid
+	if !startTime.After(payTime) {
+		state = OrderStateActive
+	}
+	stmt, err := tx.Prepare("update CLIENT_ORDER set START_TIME=$3,END_TIME=$4,PAY_TIME=$5,LAST_MODIFIED=$6,STATE=$7 where NODE_ID=$1 and ID=$2 and PAY_TIME is null and STATE=$8")
 	defer stmt.Close()
 	checkErr(err)
-	rs, err := stmt.Exec(nodeId, id, startTime, endTime, payTime, payTime)
+	rs, err := stmt.Exec(nodeId, id, startTime, endTime, payTime, payTime, state, OrderStateCreated)
 	checkErr(err)
 	rowsAffected, err := rs.RowsAffected()
 	checkErr(err)
 	if rowsAffected == 0 {
 		panic(fmt.Errorf("update order pay time failed, nodeId: %s, id: %x", nodeId, id))
 	}
+	saveOrderEvent(tx, id, OrderStateCreated, state, operator, "paid")
 }
 
-func buyPackage(tx *sql.Tx, nodeId string, pi *PackageInfo, quanlity uint32, discount decimal.Decimal, renew bool, endTime time.Time, upgrade bool, oldPackageId int64, priceOffset uint64) (id []byte) {
-	totalAmount := uint64(decimal.New(int64(uint64(quanlity)*pi.Price), 0).Mul(discount).IntPart())
-	remark := ""
+func buyPackage(tx *sql.Tx, nodeId string, pi *PackageInfo, quanlity uint32, discount decimal.Decimal, renew bool, endTime time.Time, upgrade bool, downgrade bool, oldPackageId int64, priceOffset uint64, operator string) (id []byte) {
+	baseAmount := uint64(quanlity) * pi.Price
+	discountAmount := baseAmount - uint64(decimal.New(int64(baseAmount), 0).Mul(discount).IntPart())
+	var upgradeAmount uint64
+	var upgradeStart, upgradeEnd NullTime
 	if upgrade {
 		now := time.Now().UTC()
-		offset := endTime.Sub(now)
-		offsetAmount := uint64(offset.Hours()) * priceOffset / 30 / 24
-		totalAmount += offsetAmount
-		remark = fmt.Sprintf("%s~%s upgrade price: %d", now.Format("2006-01-02 15:04:05 -0700"), endTime.Format("2006-01-02 15:04:05 -0700"), offsetAmount)
-
+		upgradeAmount = uint64(endTime.Sub(now).Hours()) * priceOffset / 30 / 24
+		upgradeStart, upgradeEnd = NullTime{Time: now, Valid: true}, NullTime{Time: endTime, Valid: true}
+	}
+	var fromPackageId sql.NullInt64
+	if renew || upgrade || downgrade {
+		fromPackageId = sql.NullInt64{Int64: oldPackageId, Valid: true}
 	}
-	err := tx.QueryRow("insert into CLIENT_ORDER(REMOVED,CREATION,LAST_MODIFIED,NODE_ID,PACKAGE_ID,QUANTITY,TOTAL_AMOUNT,UPGRADED,DISCOUNT,VOLUME,NETFLOW,UP_NETFLOW,DOWN_NETFLOW,VALID_DAYS,REMARK) values (false,now(),now(),$1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12) RETURNING ID",
-		nodeId, pi.Id, quanlity, totalAmount, upgrade, discount, pi.Volume, quanlity*pi.Netflow, quanlity*pi.UpNetflow, quanlity*pi.DownNetflow, quanlity*pi.ValidDays, remark).Scan(&id)
+	err := tx.QueryRow("insert into CLIENT_ORDER(REMOVED,CREATION,LAST_MODIFIED,NODE_ID,PACKAGE_ID,QUANTITY,TOTAL_AMOUNT,UPGRADED,DISCOUNT,VOLUME,NETFLOW,UP_NETFLOW,DOWN_NETFLOW,VALID_DAYS,DOWNGRADED,FROM_PACKAGE_ID,BASE_AMOUNT,DISCOUNT_AMOUNT,UPGRADE_AMOUNT,UPGRADE_START,UPGRADE_END) values (false,now(),now(),$1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18) RETURNING ID",
+		nodeId, pi.Id, quanlity, baseAmount-discountAmount+upgradeAmount, upgrade, discount, pi.Volume, quanlity*pi.Netflow, quanlity*pi.UpNetflow, quanlity*pi.DownNetflow, quanlity*pi.ValidDays,
+		downgrade, fromPackageId, baseAmount, discountAmount, upgradeAmount, upgradeStart, upgradeEnd).Scan(&id)
 	checkErr(err)
+	saveOrderCreatedEvent(tx, id, operator)
 	return
 }
 
-func PayOrder(nodeId string, orderId []byte, amount uint64, validDays uint32, packageId int64, volume uint32, netflow uint32, upNetflow uint32, downNetflow uint32) {
-	payTime := time.Now().UTC()
-	startTime := payTime
+func PayOrder(nodeId string, orderId []byte, amount uint64, validDays uint32, packageId int64, volume uint32, netflow uint32, upNetflow uint32, downNetflow uint32, upgraded bool, downgraded bool) {
 	tx, commit := beginTx()
 	defer rollback(tx, &commit)
+	payOrder(tx, nodeId, orderId, amount, validDays, packageId, volume, netflow, upNetflow, downNetflow, upgraded, downgraded, OrderOperatorClient)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// payOrder pays the order from the balance, a downgraded package is scheduled
+// to take effect when the one in service ends, any other takes effect now.
+func payOrder(tx *sql.Tx, nodeId string, orderId []byte, amount uint64, validDays uint32, packageId int64, volume uint32, netflow uint32, upNetflow uint32, downNetflow uint32, upgraded bool, downgraded bool, operator string) {
+	payTime := time.Now().UTC()
+	startTime := payTime
 	reduceBalanceToPayOrder(tx, nodeId, amount)
 	inService, _, _, _, _, _, _, endServiceTime := getCurrentPackage(tx, nodeId)
 	if inService {
@@ -198,13 +254,16 @@ func PayOrder(nodeId string, orderId []byte, amount uint64, validDays uint32, pa
 	}
 	dd, _ := time.ParseDuration(strconv.Itoa(24*int(validDays)) + "h")
 	endTime := startTime.Add(dd)
-	updatePayTime(tx, nodeId, orderId, startTime, endTime, payTime)
-	updateCurrentPackage(tx, nodeId, packageId, volume, netflow, upNetflow, downNetflow, endTime, inService)
+	updatePayTime(tx, nodeId, orderId, startTime, endTime, payTime, operator)
+	if downgraded && inService {
+		scheduleNextPackage(tx, nodeId, orderId, endTime)
+	} else {
+		updateCurrentPackage(tx, nodeId, packageId, volume, netflow, upNetflow, downNetflow, endTime, inService)
+	}
 	if !inService {
 		resetClientUsageAmountNetflow(tx, nodeId)
 	}
-	// TODO remove other upgrade order
-	checkErr(tx.Commit())
-	commit = true
-	return
+	if upgraded || downgraded {
+		cancelUnpaidFromPackage(tx, nodeId, orderId, operator)
+	}
 }
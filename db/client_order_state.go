@@ -0,0 +1,239 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	OrderStateCreated   = 0 // waiting for payment
+	OrderStatePaid      = 1 // paid, its period has not begun
+	OrderStateActive    = 2 // its period has begun
+	OrderStateExpired   = 3 // its period has ended
+	OrderStateCancelled = 4 // by the client, a newer order or the unpaid timeout
+	OrderStateRefunded  = 5 // by an operator before its period began
+)
+
+// the operators of the order events other than admin
+const (
+	OrderOperatorClient  = "client"
+	OrderOperatorTracker = "tracker"
+)
+
+// the states an order may change to from each state
+var orderTransitions = map[int][]int{
+	OrderStateCreated: {OrderStatePaid, OrderStateActive, OrderStateCancelled},
+	OrderStatePaid:    {OrderStateActive, OrderStateRefunded},
+	OrderStateActive:  {OrderStateExpired},
+}
+
+func orderTransitionValid(from int, to int) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderEvent is a change of the state of an order, FromState is nil for the
+// event creating the order.
+type OrderEvent struct {
+	FromState *int      `json:"fromState"`
+	ToState   int       `json:"toState"`
+	Operator  string    `json:"operator"`
+	Reason    string    `json:"reason"`
+	Creation  time.Time `json:"creation"`
+}
+
+// changeOrderState changes the state of an order of the client and records
+// the event, it panics if the order is not in the state from any more.
+func changeOrderState(tx *sql.Tx, nodeId string, id []byte, from int, to int, operator string, reason string) {
+	if !orderTransitionValid(from, to) {
+		panic(fmt.Errorf("invalid order state transition from %d to %d, id: %x", from, to, id))
+	}
+	rs, err := tx.Exec("update CLIENT_ORDER set STATE=$4,LAST_MODIFIED=now() where NODE_ID=$1 and ID=$2 and STATE=$3", nodeId, id, from, to)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(fmt.Errorf("change order state from %d to %d failed, nodeId: %s, id: %x", from, to, nodeId, id))
+	}
+	saveOrderEvent(tx, id, from, to, operator, reason)
+}
+
+// transitOrders changes the state of at most limit orders matching the
+// condition, which refers to arg as $4, from one state to another.
+func transitOrders(tx *sql.Tx, from int, to int, cond string, arg interface{}, limit int, operator string, reason string) int {
+	if !orderTransitionValid(from, to) {
+		panic(fmt.Errorf("invalid order state transition from %d to %d", from, to))
+	}
+	sqlStr := "update CLIENT_ORDER set STATE=$2,LAST_MODIFIED=now()"
+	if to == OrderStateCancelled {
+		sqlStr += ",REMOVED=true"
+	}
+	rows, err := tx.Query(sqlStr+" where STATE=$1 and "+cond+" limit $3 RETURNING ID", from, to, limit, arg)
+	checkErr(err)
+	ids := scanOrderIds(rows)
+	for _, id := range ids {
+		saveOrderEvent(tx, id, from, to, operator, reason)
+	}
+	return len(ids)
+}
+
+// cancelOrders cancels the unpaid orders of the client matching the
+// condition, which refers to args from $4.
+func cancelOrders(tx *sql.Tx, nodeId string, cond string, operator string, reason string, args ...interface{}) {
+	rows, err := tx.Query("update CLIENT_ORDER set STATE=$3,REMOVED=true,LAST_MODIFIED=now() where NODE_ID=$1 and STATE=$2 and PAY_TIME is null"+cond+" RETURNING ID",
+		append([]interface{}{nodeId, OrderStateCreated, OrderStateCancelled}, args...)...)
+	checkErr(err)
+	for _, id := range scanOrderIds(rows) {
+		saveOrderEvent(tx, id, OrderStateCreated, OrderStateCancelled, operator, reason)
+	}
+}
+
+// scanOrderIds reads and closes the rows, so that statements can be executed
+// in the transaction afterwards.
+func scanOrderIds(rows *sql.Rows) [][]byte {
+	defer rows.Close()
+	ids := make([][]byte, 0, 16)
+	for rows.Next() {
+		var id []byte
+		checkErr(rows.Scan(&id))
+		ids = append(ids, id)
+	}
+	checkErr(rows.Err())
+	return ids
+}
+
+func saveOrderEvent(tx *sql.Tx, id []byte, from int, to int, operator string, reason string) {
+	_, err := tx.Exec("insert into CLIENT_ORDER_EVENT(ORDER_ID,FROM_STATE,TO_STATE,OPERATOR,REASON,CREATION) values($1,$2,$3,$4,$5,now())", id, from, to, operator, reason)
+	checkErr(err)
+}
+
+// saveOrderCreatedEvent records the creation of an order, which has no state
+// to change from.
+func saveOrderCreatedEvent(tx *sql.Tx, id []byte, operator string) {
+	_, err := tx.Exec("insert into CLIENT_ORDER_EVENT(ORDER_ID,FROM_STATE,TO_STATE,OPERATOR,REASON,CREATION) values($1,NULL,$2,$3,'created',now())", id, OrderStateCreated, operator)
+	checkErr(err)
+}
+
+// scanOrderEvent reads the columns FROM_STATE,TO_STATE,OPERATOR,REASON,CREATION
+// following the ones given in dest.
+func scanOrderEvent(rows *sql.Rows, dest ...interface{}) *OrderEvent {
+	e := &OrderEvent{}
+	var fromState sql.NullInt64
+	checkErr(rows.Scan(append(dest, &fromState, &e.ToState, &e.Operator, &e.Reason, &e.Creation)...))
+	if fromState.Valid {
+		from := int(fromState.Int64)
+		e.FromState = &from
+	}
+	return e
+}
+
+func orderEvents(tx *sql.Tx, id []byte) []*OrderEvent {
+	rows, err := tx.Query("SELECT FROM_STATE,TO_STATE,OPERATOR,REASON,CREATION FROM CLIENT_ORDER_EVENT where ORDER_ID=$1 order by CREATION,SEQ", id)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*OrderEvent, 0, 4)
+	for rows.Next() {
+		res = append(res, scanOrderEvent(rows))
+	}
+	checkErr(rows.Err())
+	return res
+}
+
+// clientOrderEvents returns the events of all the orders of the client keyed
+// by the hex order id.
+func clientOrderEvents(tx *sql.Tx, nodeId string) map[string][]*OrderEvent {
+	rows, err := tx.Query("SELECT e.ORDER_ID,e.FROM_STATE,e.TO_STATE,e.OPERATOR,e.REASON,e.CREATION FROM CLIENT_ORDER_EVENT e,CLIENT_ORDER o where o.NODE_ID=$1 and o.REMOVED=false and e.ORDER_ID=o.ID order by e.CREATION,e.SEQ", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	res := make(map[string][]*OrderEvent)
+	for rows.Next() {
+		var id []byte
+		e := scanOrderEvent(rows, &id)
+		key := hex.EncodeToString(id)
+		res[key] = append(res[key], e)
+	}
+	checkErr(rows.Err())
+	return res
+}
+
+// OrderCancelUnpaid cancels at most limit orders created before the time and
+// still unpaid, it returns the count cancelled.
+func OrderCancelUnpaid(createdBefore time.Time, limit int) int {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	cnt := transitOrders(tx, OrderStateCreated, OrderStateCancelled, "CREATION<$4 and PAY_TIME is null", createdBefore, limit, OrderOperatorTracker, "unpaid timeout")
+	checkErr(tx.Commit())
+	commit = true
+	return cnt
+}
+
+// OrderActivate changes at most limit paid orders whose period has begun to
+// active, it returns the count changed.
+func OrderActivate(limit int) int {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	cnt := transitOrders(tx, OrderStatePaid, OrderStateActive, "START_TIME<=$4", time.Now(), limit, OrderOperatorTracker, "period began")
+	checkErr(tx.Commit())
+	commit = true
+	return cnt
+}
+
+// OrderExpire changes at most limit active orders whose period has ended to
+// expired, it returns the count changed.
+func OrderExpire(limit int) int {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	cnt := transitOrders(tx, OrderStateActive, OrderStateExpired, "END_TIME<=$4", time.Now(), limit, OrderOperatorTracker, "period ended")
+	checkErr(tx.Commit())
+	commit = true
+	return cnt
+}
+
+// OrderRefund refunds a paid order whose period has not begun to the balance
+// of the client and takes the period back. Only the last period of the client
+// can be refunded, and not an upgrade as its package is in service already.
+func OrderRefund(nodeId string, id []byte, operator string, reason string) (amount uint64, err error) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	oi := getOrderInfo(tx, nodeId, id)
+	if oi == nil {
+		return 0, errors.New("order not found")
+	}
+	if oi.State != OrderStatePaid {
+		return 0, fmt.Errorf("order state is %d, only a paid order not begun can be refunded", oi.State)
+	}
+	if oi.Upgraded {
+		return 0, errors.New("upgrade order can not be refunded")
+	}
+	var endTime time.Time
+	checkErr(tx.QueryRow("SELECT END_TIME FROM CLIENT where NODE_ID=$1", nodeId).Scan(&endTime))
+	if uint64(endTime.Unix()) != oi.EndTime {
+		return 0, errors.New("only the last period of the client can be refunded")
+	}
+	var rs sql.Result
+	if oi.Downgraded {
+		// the package downgraded to is not in service yet
+		rs, err = tx.Exec("update CLIENT set BALANCE=BALANCE+$2,END_TIME=$3,NEXT_ORDER_ID=NULL,LAST_MODIFIED=now() where NODE_ID=$1 and NEXT_ORDER_ID=$4",
+			nodeId, oi.TotalAmount, time.Unix(int64(oi.StartTime), 0), id)
+	} else {
+		rs, err = tx.Exec("update CLIENT set BALANCE=BALANCE+$2,END_TIME=$3,NETFLOW=NETFLOW-$4,UP_NETFLOW=UP_NETFLOW-$5,DOWN_NETFLOW=DOWN_NETFLOW-$6,LAST_MODIFIED=now() where NODE_ID=$1",
+			nodeId, oi.TotalAmount, time.Unix(int64(oi.StartTime), 0), oi.Netflow, oi.UpNetflow, oi.DownNetflow)
+	}
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		return 0, errors.New("refund failed, client changed meanwhile")
+	}
+	changeOrderState(tx, nodeId, id, OrderStatePaid, OrderStateRefunded, operator, reason)
+	checkErr(tx.Commit())
+	commit = true
+	return oi.TotalAmount, nil
+}
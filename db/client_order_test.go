@@ -29,7 +29,7 @@ func TestClientOrder(t *testing.T) {
 		t.Errorf("Failed.")
 	}
 	count := len(myAllOrder(tx, nodeId, false))
-	orderId := buyPackage(tx, nodeId, pi, 3, decimal.New(1, 0), false, time.Now(), false, 0, 0)
+	orderId := buyPackage(tx, nodeId, pi, 3, decimal.New(1, 0), false, time.Now(), false, false, 0, 0, OrderOperatorClient)
 	if len(orderId) == 0 {
 		t.Error("failed")
 	}
@@ -37,8 +37,29 @@ func TestClientOrder(t *testing.T) {
 	if oi == nil {
 		t.Error("failed")
 	}
+	if oi.BaseAmount != 3*pi.Price || oi.DiscountAmount != 0 || oi.UpgradeAmount != 0 || oi.TotalAmount != oi.BaseAmount || oi.FromPackageId != 0 || oi.State != OrderStateCreated {
+		t.Errorf("Failed.")
+	}
 	if len(myAllOrder(tx, nodeId, false)) != count+1 {
 		t.Errorf("Failed.")
 	}
 	myAllOrder(tx, nodeId, true)
+	if events := orderEvents(tx, orderId); len(events) != 1 || events[0].ToState != OrderStateCreated {
+		t.Errorf("Failed.")
+	}
+	removeOrder(tx, nodeId, orderId)
+	if getOrderInfo(tx, nodeId, orderId) != nil || len(orderEvents(tx, orderId)) != 2 {
+		t.Errorf("Failed.")
+	}
+}
+
+func TestOrderTransition(t *testing.T) {
+	if !orderTransitionValid(OrderStateCreated, OrderStatePaid) || !orderTransitionValid(OrderStatePaid, OrderStateRefunded) ||
+		!orderTransitionValid(OrderStateActive, OrderStateExpired) {
+		t.Errorf("Failed.")
+	}
+	if orderTransitionValid(OrderStateCreated, OrderStateRefunded) || orderTransitionValid(OrderStateActive, OrderStateRefunded) ||
+		orderTransitionValid(OrderStateExpired, OrderStateActive) || orderTransitionValid(OrderStateCancelled, OrderStatePaid) {
+		t.Errorf("Failed.")
+	}
 }
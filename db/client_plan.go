@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// scheduleNextPackage keeps the package in service till it ends and then the
+// one of the paid downgrade order, which ends at endTime.
+func scheduleNextPackage(tx *sql.Tx, nodeId string, orderId []byte, endTime time.Time) {
+	rs, err := tx.Exec("update CLIENT set NEXT_ORDER_ID=$2,END_TIME=$3,LAST_MODIFIED=now() where NODE_ID=$1 and NEXT_ORDER_ID is null", nodeId, orderId, endTime)
+	checkErr(err)
+	rowsAffected, err := rs.RowsAffected()
+	checkErr(err)
+	if rowsAffected == 0 {
+		panic(fmt.Errorf("schedule next package failed, nodeId: %s, order id: %x", nodeId, orderId))
+	}
+}
+
+func getNextPackage(tx *sql.Tx, nodeId string) (packageId int64, startTime time.Time) {
+	err := tx.QueryRow("SELECT o.PACKAGE_ID,o.START_TIME FROM CLIENT c,CLIENT_ORDER o where c.NODE_ID=$1 and c.NEXT_ORDER_ID=o.ID", nodeId).Scan(&packageId, &startTime)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}
+	}
+	checkErr(err)
+	return
+}
+
+// ClientNextPackage returns the package downgraded to and when it takes
+// effect, 0 if none is scheduled.
+func ClientNextPackage(nodeId string) (packageId int64, startTime time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	packageId, startTime = getNextPackage(tx, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ClientNextPackageDue returns the clients whose downgraded package should
+// have taken effect by now.
+func ClientNextPackageDue() []string {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT c.NODE_ID FROM CLIENT c,CLIENT_ORDER o where c.REMOVED=false and c.NEXT_ORDER_ID=o.ID and o.START_TIME<=now()")
+	checkErr(err)
+	defer rows.Close()
+	res := make([]string, 0, 16)
+	for rows.Next() {
+		var nodeId string
+		checkErr(rows.Scan(&nodeId))
+		res = append(res, nodeId)
+	}
+	checkErr(rows.Err())
+	checkErr(tx.Commit())
+	commit = true
+	return res
+}
+
+// ClientApplyNextPackage replaces the package of the client with the
+// downgraded one if it is due, the netflow is added as a renewal does. The
+// usage is not checked again, uploads beyond the volume are refused as usual.
+func ClientApplyNextPackage(nodeId string) (oi *OrderInfo) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var orderId []byte
+	err := tx.QueryRow("SELECT NEXT_ORDER_ID FROM CLIENT where NODE_ID=$1 and NEXT_ORDER_ID is not null", nodeId).Scan(&orderId)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	checkErr(err)
+	oi = getOrderInfo(tx, nodeId, orderId)
+	if oi == nil || oi.StartTime > uint64(time.Now().Unix()) {
+		return nil
+	}
+	_, err = tx.Exec("update CLIENT set PACKAGE_ID=$2,VOLUME=$3,NETFLOW=NETFLOW+$4,UP_NETFLOW=UP_NETFLOW+$5,DOWN_NETFLOW=DOWN_NETFLOW+$6,NEXT_ORDER_ID=NULL,LAST_MODIFIED=now() where NODE_ID=$1",
+		nodeId, oi.PackageId, oi.Volume, oi.Netflow, oi.UpNetflow, oi.DownNetflow)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The results of ClientAutoRenew.
+const (
+	AutoRenewDone         = iota
+	AutoRenewSkipped      // renewed, downgraded or turned off meanwhile
+	AutoRenewNoPackage    // the package is not sold any more
+	AutoRenewInsufficient // the balance does not cover the order
+)
+
+func ClientSetAutoRenew(nodeId string, autoRenew bool) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rs, err := tx.Exec("update CLIENT set AUTO_RENEW=$2,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false", nodeId, autoRenew)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func ClientGetAutoRenew(nodeId string) (autoRenew bool) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT AUTO_RENEW FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&autoRenew)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+type RenewCandidate struct {
+	NodeId       string
+	ContactEmail string
+	Locale       string
+	EndTime      time.Time
+}
+
+// ClientAutoRenewDue returns the clients turned auto renew on whose package is
+// in service and ends before endBefore.
+func ClientAutoRenewDue(endBefore time.Time) []*RenewCandidate {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT NODE_ID,CONTACT_EMAIL,COALESCE(LOCALE,''),END_TIME FROM CLIENT where REMOVED=false and AUTO_RENEW=true and PACKAGE_ID is not null and END_TIME>now() and END_TIME<$1", endBefore)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*RenewCandidate, 0, 16)
+	for rows.Next() {
+		rc := &RenewCandidate{}
+		checkErr(rows.Scan(&rc.NodeId, &rc.ContactEmail, &rc.Locale, &rc.EndTime))
+		res = append(res, rc)
+	}
+	checkErr(rows.Err())
+	checkErr(tx.Commit())
+	commit = true
+	return res
+}
+
+// ClientAutoRenew buys the current package of the client once more as a
+// renewal and pays it from the balance, unless the package no longer ends at
+// endTime. The order is not kept if the balance does not cover it, it is
+// returned for its amount then.
+func ClientAutoRenew(nodeId string, endTime time.Time) (result int, oi *OrderInfo, balance uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var autoRenew bool
+	err := tx.QueryRow("SELECT AUTO_RENEW FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&autoRenew)
+	if err == sql.ErrNoRows {
+		return AutoRenewSkipped, nil, 0
+	}
+	checkErr(err)
+	inService, _, packageId, _, _, _, _, currentEndTime := getCurrentPackage(tx, nodeId)
+	if !autoRenew || !inService || !currentEndTime.Equal(endTime) {
+		return AutoRenewSkipped, nil, 0
+	}
+	if nextPackageId, _ := getNextPackage(tx, nodeId); nextPackageId != 0 {
+		return AutoRenewSkipped, nil, 0
+	}
+	pi := getPackageInfo(tx, packageId)
+	if pi == nil {
+		return AutoRenewNoPackage, nil, 0
+	}
+	id := buyPackage(tx, nodeId, pi, 1, getPackageQuantityDiscount(tx, pi.Id, 1), true, endTime, false, false, packageId, 0, OrderOperatorTracker)
+	oi = getOrderInfo(tx, nodeId, id)
+	balance = getBalance(tx, nodeId)
+	if balance < oi.TotalAmount {
+		return AutoRenewInsufficient, oi, balance
+	}
+	payOrder(tx, nodeId, id, oi.TotalAmount, oi.ValidDays, oi.PackageId, oi.Volume, oi.Netflow, oi.UpNetflow, oi.DownNetflow, false, false, OrderOperatorTracker)
+	oi = getOrderInfo(tx, nodeId, id)
+	checkErr(tx.Commit())
+	commit = true
+	return AutoRenewDone, oi, balance - oi.TotalAmount
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"database/sql"
+	"nebula-tracker/config"
+	"time"
+)
+
+// The states of the files of a client along its package, see the Retention
+// config.
+const (
+	RetentionNone    = iota // never bought any package
+	RetentionActive         // package in service
+	RetentionGrace          // package ended, files can be listed and retrieved only
+	RetentionFrozen         // files can not be accessed, kept till renewed or removed
+	RetentionRemoved        // files removed, or to be removed by the next run
+)
+
+// RetentionStateAt returns the state of the files at now of a package ending
+// at endTime, zero endTime for no package.
+func RetentionStateAt(endTime time.Time, now time.Time, grace time.Duration, frozen time.Duration) int {
+	switch {
+	case endTime.IsZero():
+		return RetentionNone
+	case now.Before(endTime):
+		return RetentionActive
+	case now.Before(endTime.Add(grace)):
+		return RetentionGrace
+	case now.Before(endTime.Add(grace + frozen)):
+		return RetentionFrozen
+	default:
+		return RetentionRemoved
+	}
+}
+
+func retentionPeriods() (grace time.Duration, frozen time.Duration) {
+	conf := config.GetTrackerConfig().Retention
+	return time.Duration(conf.GraceDays) * 24 * time.Hour, time.Duration(conf.FrozenDays) * 24 * time.Hour
+}
+
+// ClientRetentionState returns the state of the files of the client now.
+func ClientRetentionState(nodeId string) int {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var endTime NullTime
+	err := tx.QueryRow("SELECT END_TIME FROM CLIENT where NODE_ID=$1 and REMOVED=false", nodeId).Scan(&endTime)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	grace, frozen := retentionPeriods()
+	if !endTime.Valid {
+		return RetentionNone
+	}
+	return RetentionStateAt(endTime.Time, time.Now(), grace, frozen)
+}
+
+type RetentionCandidate struct {
+	NodeId       string
+	ContactEmail string
+	Locale       string
+	EndTime      time.Time
+}
+
+// ClientRetentionExpired returns at most limit clients whose package ended
+// before endBefore and who still have files, and who were sent the frozen
+// notice of the kind for that package before noticedBefore.
+func ClientRetentionExpired(endBefore time.Time, kind string, noticedBefore time.Time, limit int) []*RetentionCandidate {
+	return clientRetentionQuery("SELECT c.NODE_ID,c.CONTACT_EMAIL,COALESCE(c.LOCALE,''),c.END_TIME FROM CLIENT c where c.REMOVED=false and c.END_TIME<$1 and exists (SELECT 1 FROM FILE_OWNER f where f.NODE_ID=c.NODE_ID and f.REMOVED=false) and exists (SELECT 1 FROM CLIENT_NOTICE n where n.NODE_ID=c.NODE_ID and n.KIND=$2 and n.THRESHOLD=$3 and n.PERIOD_END=c.END_TIME and n.CREATION<$4) limit $5",
+		endBefore, kind, RetentionFrozen, noticedBefore, limit)
+}
+
+// ClientRetentionUnnoticed returns at most limit clients whose package ended
+// before endBefore and who still have files, but were never sent the frozen
+// notice of the kind for that package, as their package ended before the
+// retention was rolled out or the notice was skipped.
+func ClientRetentionUnnoticed(endBefore time.Time, kind string, limit int) []*RetentionCandidate {
+	return clientRetentionQuery("SELECT c.NODE_ID,c.CONTACT_EMAIL,COALESCE(c.LOCALE,''),c.END_TIME FROM CLIENT c where c.REMOVED=false and c.END_TIME<$1 and exists (SELECT 1 FROM FILE_OWNER f where f.NODE_ID=c.NODE_ID and f.REMOVED=false) and not exists (SELECT 1 FROM CLIENT_NOTICE n where n.NODE_ID=c.NODE_ID and n.KIND=$2 and n.THRESHOLD=$3 and n.PERIOD_END=c.END_TIME) limit $4",
+		endBefore, kind, RetentionFrozen, limit)
+}
+
+func clientRetentionQuery(sqlStr string, args ...interface{}) []*RetentionCandidate {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query(sqlStr, args...)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*RetentionCandidate, 0, 16)
+	for rows.Next() {
+		rc := &RetentionCandidate{}
+		checkErr(rows.Scan(&rc.NodeId, &rc.ContactEmail, &rc.Locale, &rc.EndTime))
+		res = append(res, rc)
+	}
+	checkErr(rows.Err())
+	checkErr(tx.Commit())
+	commit = true
+	return res
+}
+
+// ClientRetentionRemove removes all the files and folders of the client so
+// their blocks can be collected, unless the package was renewed to end at or
+// after endBefore meanwhile. It returns the contact email and the end of the
+// package of the client if removed.
+func ClientRetentionRemove(nodeId string, endBefore time.Time) (removed bool, contactEmail string, endTime time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	err := tx.QueryRow("SELECT CONTACT_EMAIL,END_TIME FROM CLIENT where NODE_ID=$1 and REMOVED=false and END_TIME<$2", nodeId, endBefore).Scan(&contactEmail, &endTime)
+	if err == sql.ErrNoRows {
+		checkErr(tx.Commit())
+		commit = true
+		return
+	}
+	checkErr(err)
+	_, err = tx.Exec("update FILE_OWNER set REMOVED=true,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false", nodeId)
+	checkErr(err)
+	_, err = tx.Exec("update CLIENT_USAGE_AMOUNT set VOLUME=0,LAST_MODIFIED=now() where NODE_ID=$1", nodeId)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	removed = true
+	return
+}
+
+// GraceNetflow returns the netflow and download netflow of the ended package
+// of the client and the usage of them, in the units of UsageAmount, so the
+// grace period is bounded by what is left of the package.
+func GraceNetflow(nodeId string) (netflow uint32, downNetflow uint32, usageNetflow uint32, usageDownNetflow uint32) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var netflowNullable, downNetflowNullable sql.NullInt64
+	err := tx.QueryRow("SELECT NETFLOW,DOWN_NETFLOW FROM CLIENT where NODE_ID=$1", nodeId).Scan(&netflowNullable, &downNetflowNullable)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	if netflowNullable.Valid {
+		netflow = uint32(netflowNullable.Int64) * 1024
+	}
+	if downNetflowNullable.Valid {
+		downNetflow = uint32(downNetflowNullable.Int64) * 1024
+	}
+	_, usageNetflow, _, usageDownNetflow, _ = getClientUsageAmount(tx, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionStateAt(t *testing.T) {
+	day := 24 * time.Hour
+	end := time.Now()
+	for _, c := range []struct {
+		now   time.Time
+		state int
+	}{{end.Add(-time.Hour), RetentionActive},
+		{end, RetentionGrace},
+		{end.Add(2 * day), RetentionGrace},
+		{end.Add(3 * day), RetentionFrozen},
+		{end.Add(12 * day), RetentionRemoved}} {
+		if state := RetentionStateAt(end, c.now, 3*day, 9*day); state != c.state {
+			t.Errorf("failed at %s: %d", c.now.Sub(end), state)
+		}
+	}
+	if RetentionStateAt(time.Time{}, end, 3*day, 9*day) != RetentionNone {
+		t.Error("failed")
+	}
+}
@@ -40,3 +40,20 @@ func saveDepositRecord(tx *sql.Tx, batch []*DepositRecord) {
 		checkErr(err)
 	}
 }
+
+// depositRecordsOfAddress returns the deposits to the address since it was
+// assigned last, addresses were given back to the pool on account deletion
+// before.
+func depositRecordsOfAddress(tx *sql.Tx, address string) []*DepositRecord {
+	rows, err := tx.Query("SELECT d.ID,d.CREATION,d.ADDRESS,d.SEQ,d.TRANSACTION_TIME,d.TRANSACTION_ID,d.AMOUNT,d.HEIGHT FROM DEPOSIT_RECORD d,AVAILABLE_ADDRESS a where d.ADDRESS=$1 and a.ADDRESS=d.ADDRESS and (a.USAGE_TIME is null or d.CREATION>=a.USAGE_TIME) order by d.SEQ", address)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*DepositRecord, 0, 8)
+	for rows.Next() {
+		dr := &DepositRecord{}
+		err = rows.Scan(&dr.Id, &dr.Creation, &dr.Address, &dr.Seq, &dr.TransactionTime, &dr.TransactionId, &dr.Amount, &dr.Height)
+		checkErr(err)
+		res = append(res, dr)
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type QueuedMail struct {
+	Id        int64
+	Recipient string
+	Subject   string
+	TextBody  string
+	HtmlBody  string
+	Attempts  int
+}
+
+// MailEnqueue keeps an email failed to be delivered, to be retried at nextTry
+// and, unless expire is zero, dropped after expire.
+func MailEnqueue(recipient string, subject string, textBody string, htmlBody string, lastError string, nextTry time.Time, expire time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var html sql.NullString
+	if htmlBody != "" {
+		html = sql.NullString{String: htmlBody, Valid: true}
+	}
+	var expireTime NullTime
+	if !expire.IsZero() {
+		expireTime = NullTime{Time: expire, Valid: true}
+	}
+	_, err := tx.Exec("insert into MAIL_QUEUE(RECIPIENT,SUBJECT,TEXT_BODY,HTML_BODY,CREATION,LAST_MODIFIED,ATTEMPTS,NEXT_TRY,LAST_ERROR,EXPIRE_TIME) values ($1,$2,$3,$4,now(),now(),1,$5,$6,$7)",
+		recipient, subject, textBody, html, nextTry, lastError, expireTime)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// MailClaimDue takes at most limit emails due for retrying, they are not due
+// again within lease, so the other trackers leave them alone meanwhile. The
+// expired emails are dropped undelivered.
+func MailClaimDue(limit int, lease time.Duration) []*QueuedMail {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	_, err := tx.Exec("delete from MAIL_QUEUE where EXPIRE_TIME<=now()")
+	checkErr(err)
+	rows, err := tx.Query("update MAIL_QUEUE set NEXT_TRY=$2,LAST_MODIFIED=now() where ID in (SELECT ID FROM MAIL_QUEUE where NEXT_TRY<=now() order by NEXT_TRY limit $1) RETURNING ID,RECIPIENT,SUBJECT,TEXT_BODY,HTML_BODY,ATTEMPTS",
+		limit, time.Now().Add(lease))
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*QueuedMail, 0, limit)
+	for rows.Next() {
+		qm := &QueuedMail{}
+		var html sql.NullString
+		checkErr(rows.Scan(&qm.Id, &qm.Recipient, &qm.Subject, &qm.TextBody, &html, &qm.Attempts))
+		if html.Valid {
+			qm.HtmlBody = html.String
+		}
+		res = append(res, qm)
+	}
+	checkErr(rows.Err())
+	checkErr(tx.Commit())
+	commit = true
+	return res
+}
+
+// MailRetryLater counts a failed attempt of the email.
+func MailRetryLater(id int64, lastError string, nextTry time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rs, err := tx.Exec("update MAIL_QUEUE set ATTEMPTS=ATTEMPTS+1,NEXT_TRY=$2,LAST_ERROR=$3,LAST_MODIFIED=now() where ID=$1", id, nextTry, lastError)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// MailDequeue removes the email once delivered or given up, nothing is kept.
+func MailDequeue(id int64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	_, err := tx.Exec("delete from MAIL_QUEUE where ID=$1", id)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
@@ -114,14 +114,18 @@ func ProviderGetRandomCode(nodeId string) (found bool, email string, emailVerifi
 }
 
 func getProviderRandomCode(tx *sql.Tx, nodeId string) (found bool, email string, emailVerified bool, randomCode string, sendTime time.Time) {
-	rows, err := tx.Query("SELECT EMAIL_VERIFIED,BILL_EMAIL,RANDOM_CODE,SEND_TIME FROM PROVIDER where NODE_ID=$1 and REMOVED=false", nodeId)
+	rows, err := tx.Query("SELECT EMAIL_VERIFIED,BILL_EMAIL,NEW_BILL_EMAIL,RANDOM_CODE,SEND_TIME FROM PROVIDER where NODE_ID=$1 and REMOVED=false", nodeId)
 	checkErr(err)
 	defer rows.Close()
 	for rows.Next() {
 		var sendTimeNullable NullTime
-		var randomCodeNullable sql.NullString
-		err = rows.Scan(&emailVerified, &email, &randomCodeNullable, &sendTimeNullable)
+		var randomCodeNullable, newEmailNullable sql.NullString
+		err = rows.Scan(&emailVerified, &email, &newEmailNullable, &randomCodeNullable, &sendTimeNullable)
 		checkErr(err)
+		// a changed bill email waits for verification, the old one stays in use till then
+		if newEmailNullable.Valid {
+			email, emailVerified = newEmailNullable.String, false
+		}
 		if randomCodeNullable.Valid {
 			randomCode = randomCodeNullable.String
 		}
@@ -142,7 +146,7 @@ func ProviderUpdateEmailVerified(nodeId string) {
 }
 
 func updateProviderEmailVerified(tx *sql.Tx, nodeId string) {
-	stmt, err := tx.Prepare("update PROVIDER set EMAIL_VERIFIED=true,LAST_MODIFIED=now(),SEND_TIME=NULL,RANDOM_CODE=NULL where NODE_ID=$1 and REMOVED=false")
+	stmt, err := tx.Prepare("update PROVIDER set EMAIL_VERIFIED=true,BILL_EMAIL=COALESCE(NEW_BILL_EMAIL,BILL_EMAIL),NEW_BILL_EMAIL=NULL,LAST_MODIFIED=now(),SEND_TIME=NULL,RANDOM_CODE=NULL where NODE_ID=$1 and REMOVED=false")
 	defer stmt.Close()
 	checkErr(err)
 	rs, err := stmt.Exec(nodeId)
@@ -163,7 +167,7 @@ func ProviderUpdateVerifyCode(nodeId string, randomCode string) {
 }
 
 func updateProviderVerifyCode(tx *sql.Tx, nodeId string, randomCode string) {
-	stmt, err := tx.Prepare("update PROVIDER set LAST_MODIFIED=now(),SEND_TIME=now(),RANDOM_CODE=$2 where NODE_ID=$1 and REMOVED=false and EMAIL_VERIFIED=false")
+	stmt, err := tx.Prepare("update PROVIDER set LAST_MODIFIED=now(),SEND_TIME=now(),RANDOM_CODE=$2 where NODE_ID=$1 and REMOVED=false and (EMAIL_VERIFIED=false or NEW_BILL_EMAIL is not null)")
 	defer stmt.Close()
 	checkErr(err)
 	rs, err := stmt.Exec(nodeId, randomCode)
@@ -211,11 +215,14 @@ type ProviderInfo struct {
 	DownBandwidth     uint64
 	TestUpBandwidth   uint64
 	TestDownBandwidth uint64
-	Availability      float64
-	Port              uint32
-	Host              string
-	DynamicDomain     string
-	StorageVolume     []uint64
+	// measured by the speed test of the tracker, zero until tested
+	MeasuredUpBandwidth   uint64
+	MeasuredDownBandwidth uint64
+	Availability          float64
+	Port                  uint32
+	Host                  string
+	DynamicDomain         string
+	StorageVolume         []uint64
 }
 
 func (self ProviderInfo) Server() string {
@@ -236,7 +243,7 @@ func ProviderFindOne(nodeId string) (p *ProviderInfo) {
 }
 
 func providerFindOne(tx *sql.Tx, nodeId string) *ProviderInfo {
-	rows, err := tx.Query("SELECT NODE_ID,PUBLIC_KEY,BILL_EMAIL,ENCRYPT_KEY,WALLET_ADDRESS,UP_BANDWIDTH,DOWN_BANDWIDTH,TEST_UP_BANDWIDTH,TEST_DOWN_BANDWIDTH,AVAILABILITY,PORT,HOST,DYNAMIC_DOMAIN,STORAGE_VOLUME from PROVIDER where NODE_ID=$1", nodeId)
+	rows, err := tx.Query("SELECT NODE_ID,PUBLIC_KEY,BILL_EMAIL,ENCRYPT_KEY,WALLET_ADDRESS,UP_BANDWIDTH,DOWN_BANDWIDTH,TEST_UP_BANDWIDTH,TEST_DOWN_BANDWIDTH,MEASURED_UP_BANDWIDTH,MEASURED_DOWN_BANDWIDTH,AVAILABILITY,PORT,HOST,DYNAMIC_DOMAIN,STORAGE_VOLUME from PROVIDER where NODE_ID=$1", nodeId)
 	checkErr(err)
 	defer rows.Close()
 	for rows.Next() {
@@ -249,8 +256,9 @@ func scanProviderInfo(rows *sql.Rows) *ProviderInfo {
 	var pi ProviderInfo
 	var host, dynamicDomain sql.NullString
 	var storageVolume NullUint64Slice
+	var measuredUp, measuredDown sql.NullInt64
 	err := rows.Scan(&pi.NodeId, &pi.PublicKey, &pi.BillEmail, &pi.EncryptKey, &pi.WalletAddress, &pi.UpBandwidth, &pi.DownBandwidth, &pi.TestUpBandwidth, &pi.TestDownBandwidth,
-		&pi.Availability, &pi.Port, &host, &dynamicDomain, &storageVolume)
+		&measuredUp, &measuredDown, &pi.Availability, &pi.Port, &host, &dynamicDomain, &storageVolume)
 	checkErr(err)
 	if host.Valid {
 		pi.Host = host.String
@@ -261,6 +269,12 @@ func scanProviderInfo(rows *sql.Rows) *ProviderInfo {
 	if storageVolume.Valid {
 		pi.StorageVolume = storageVolume.Uint64Slice
 	}
+	if measuredUp.Valid {
+		pi.MeasuredUpBandwidth = uint64(measuredUp.Int64)
+	}
+	if measuredDown.Valid {
+		pi.MeasuredDownBandwidth = uint64(measuredDown.Int64)
+	}
 	pi.NodeIdBytes, err = base64.StdEncoding.DecodeString(pi.NodeId)
 	if err != nil {
 		panic(err)
@@ -278,7 +292,7 @@ func ProviderFindAll() (slice []ProviderInfo) {
 }
 
 func providerFindAll(tx *sql.Tx) []ProviderInfo {
-	rows, err := tx.Query("SELECT NODE_ID,PUBLIC_KEY,BILL_EMAIL,ENCRYPT_KEY,WALLET_ADDRESS,UP_BANDWIDTH,DOWN_BANDWIDTH,TEST_UP_BANDWIDTH,TEST_DOWN_BANDWIDTH,AVAILABILITY,PORT,HOST,DYNAMIC_DOMAIN,STORAGE_VOLUME from PROVIDER where REMOVED=false and EMAIL_VERIFIED=true and ACTIVE=true")
+	rows, err := tx.Query("SELECT NODE_ID,PUBLIC_KEY,BILL_EMAIL,ENCRYPT_KEY,WALLET_ADDRESS,UP_BANDWIDTH,DOWN_BANDWIDTH,TEST_UP_BANDWIDTH,TEST_DOWN_BANDWIDTH,MEASURED_UP_BANDWIDTH,MEASURED_DOWN_BANDWIDTH,AVAILABILITY,PORT,HOST,DYNAMIC_DOMAIN,STORAGE_VOLUME from PROVIDER where REMOVED=false and EMAIL_VERIFIED=true and ACTIVE=true and STATUS=0")
 	checkErr(err)
 	defer rows.Close()
 	res := make([]ProviderInfo, 0, 16)
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ProviderStatusNormal    = 0
+	ProviderStatusSuspended = 1 // no new placement
+	ProviderStatusDraining  = 2 // no new placement, stored blocks migrate to other providers
+	ProviderStatusBanned    = 3 // permanent
+	ProviderStatusExiting   = 4 // asked by the provider itself, removed once every stored block migrated
+)
+
+type ProviderAdminLog struct {
+	FromStatus int       `json:"fromStatus"`
+	ToStatus   int       `json:"toStatus"`
+	Operator   string    `json:"operator"`
+	Reason     string    `json:"reason"`
+	Creation   time.Time `json:"creation"`
+}
+
+// ProviderChangeStatus changes the status of a provider and records the change
+// in the admin log, a banned provider can not be changed any more.
+func ProviderChangeStatus(nodeId string, status int, operator string, reason string) (previous int, err error) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	found, previous := providerGetStatus(tx, nodeId)
+	if !found {
+		return 0, errors.New("provider not found")
+	}
+	if previous == status {
+		return previous, fmt.Errorf("provider status is %d already", status)
+	}
+	if previous == ProviderStatusBanned {
+		return previous, errors.New("provider is banned")
+	}
+	updateProviderStatus(tx, nodeId, status)
+	saveProviderAdminLog(tx, nodeId, previous, status, operator, reason)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func ProviderGetStatus(nodeId string) (found bool, status int) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	found, status = providerGetStatus(tx, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerGetStatus(tx *sql.Tx, nodeId string) (found bool, status int) {
+	rows, err := tx.Query("SELECT STATUS FROM PROVIDER where NODE_ID=$1 and REMOVED=false", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&status)
+		checkErr(err)
+		return true, status
+	}
+	return
+}
+
+func updateProviderStatus(tx *sql.Tx, nodeId string, status int) {
+	stmt, err := tx.Prepare("update PROVIDER set STATUS=$2,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, status)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+}
+
+func saveProviderAdminLog(tx *sql.Tx, nodeId string, fromStatus int, toStatus int, operator string, reason string) {
+	stmt, err := tx.Prepare("insert into PROVIDER_ADMIN_LOG(NODE_ID,FROM_STATUS,TO_STATUS,OPERATOR,REASON,CREATION) values($1,$2,$3,$4,$5,now())")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, fromStatus, toStatus, operator, reason)
+	checkErr(err)
+}
+
+func ProviderAdminLogs(nodeId string) (logs []*ProviderAdminLog) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	logs = providerAdminLogs(tx, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerAdminLogs(tx *sql.Tx, nodeId string) []*ProviderAdminLog {
+	rows, err := tx.Query("SELECT FROM_STATUS,TO_STATUS,OPERATOR,REASON,CREATION FROM PROVIDER_ADMIN_LOG where NODE_ID=$1 order by CREATION", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*ProviderAdminLog, 0, 8)
+	for rows.Next() {
+		l := &ProviderAdminLog{}
+		err = rows.Scan(&l.FromStatus, &l.ToStatus, &l.Operator, &l.Reason, &l.Creation)
+		checkErr(err)
+		res = append(res, l)
+	}
+	return res
+}
+
+func ProviderFindByStatus(status int) (nodeIds []string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	nodeIds = providerFindByStatus(tx, status)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerFindByStatus(tx *sql.Tx, status int) []string {
+	rows, err := tx.Query("SELECT NODE_ID FROM PROVIDER where STATUS=$1 and REMOVED=false", status)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]string, 0, 8)
+	for rows.Next() {
+		var nodeId string
+		err = rows.Scan(&nodeId)
+		checkErr(err)
+		res = append(res, nodeId)
+	}
+	return res
+}
+
+// ProviderFinishExit removes an exiting provider, after every block stored on
+// it has been migrated, and releases the earnings held back from it.
+func ProviderFinishExit(nodeId string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update PROVIDER set REMOVED=true,ACTIVE=false,LAST_MODIFIED=now() where NODE_ID=$1 and STATUS=$2 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, ProviderStatusExiting)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+	saveProviderAdminLog(tx, nodeId, ProviderStatusExiting, ProviderStatusExiting, "tracker", "all blocks migrated, exit finished")
+	providerReleaseHeld(tx, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+}
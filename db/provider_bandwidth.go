@@ -0,0 +1,29 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ProviderSaveMeasuredBandwidth keeps the result of the last speed test next to
+// the bandwidth the provider declared.
+func ProviderSaveMeasuredBandwidth(nodeId string, up uint64, down uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerSaveMeasuredBandwidth(tx, nodeId, up, down)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func providerSaveMeasuredBandwidth(tx *sql.Tx, nodeId string, up uint64, down uint64) {
+	stmt, err := tx.Prepare("update PROVIDER set MEASURED_UP_BANDWIDTH=$2,MEASURED_DOWN_BANDWIDTH=$3,MEASURED_TIME=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, up, down)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+}
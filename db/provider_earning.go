@@ -0,0 +1,231 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	EarningKindPeriod  = 0 // earned in a period
+	EarningKindRelease = 1 // the held back amount released when the provider exited
+)
+
+type ProviderEarning struct {
+	NodeId       string    `json:"nodeId"`
+	Kind         int       `json:"kind"`
+	PeriodStart  time.Time `json:"periodStart"`
+	PeriodEnd    time.Time `json:"periodEnd"`
+	ByteHours    float64   `json:"byteHours"`
+	Traffic      uint64    `json:"traffic"`
+	Availability float64   `json:"availability"`
+	Amount       uint64    `json:"amount"`
+	Held         uint64    `json:"held"` // part of amount kept back till the provider exits
+}
+
+// ProviderByteHours sums up the size of the blocks stored on each provider
+// multiplied by the hours they were stored within the period, a migrated block
+// counts on each provider for the time it was there.
+func ProviderByteHours(start time.Time, end time.Time) (m map[string]float64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	m = providerByteHours(tx, start, end)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerByteHours(tx *sql.Tx, start time.Time, end time.Time) map[string]float64 {
+	res := make(map[string]float64, 64)
+	sumByteHours(tx, res, "SELECT PROVIDER_ID,sum(SIZE*extract(epoch from least(COALESCE(REMOVE_TIME,$2),$2)-greatest(COALESCE(PLACED_TIME,CREATION),$1))/3600) FROM BLOCK where COALESCE(PLACED_TIME,CREATION)<$2 and (REMOVE_TIME is null or REMOVE_TIME>$1) and (REMOVED=false or REMOVE_TIME is not null) group by PROVIDER_ID", start, end)
+	sumByteHours(tx, res, "SELECT PROVIDER_ID,sum(SIZE*extract(epoch from least(END_TIME,$2)-greatest(START_TIME,$1))/3600) FROM BLOCK_PLACEMENT where START_TIME<$2 and END_TIME>$1 group by PROVIDER_ID", start, end)
+	return res
+}
+
+func sumByteHours(tx *sql.Tx, res map[string]float64, query string, start time.Time, end time.Time) {
+	rows, err := tx.Query(query, start, end)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var nodeId string
+		var byteHours float64
+		err = rows.Scan(&nodeId, &byteHours)
+		checkErr(err)
+		res[nodeId] += byteHours
+	}
+}
+
+// ProviderRetrieveTraffic sums up the bytes each provider served successfully
+// to clients within the period, from the action log in the database of the
+// collector.
+func ProviderRetrieveTraffic(collectorDb string, start time.Time, end time.Time) (m map[string]uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	m = providerRetrieveTraffic(tx, collectorDb, start, end)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerRetrieveTraffic(tx *sql.Tx, collectorDb string, start time.Time, end time.Time) map[string]uint64 {
+	rows, err := tx.Query(fmt.Sprintf("SELECT PVD_NODE_ID,sum(PVD_TRANSPORT_SIZE) FROM %s.ACTION_LOG where PVD_TYPE=$3 and PVD_SUCCESS=true and PVD_END_TIME>=$1 and PVD_END_TIME<$2 group by PVD_NODE_ID", collectorDb), start, end, actionTypeRetrieve)
+	checkErr(err)
+	defer rows.Close()
+	res := make(map[string]uint64, 64)
+	for rows.Next() {
+		var nodeId string
+		var traffic uint64
+		err = rows.Scan(&nodeId, &traffic)
+		checkErr(err)
+		res[nodeId] = traffic
+	}
+	return res
+}
+
+// ProviderEarningLastEnd returns the end of the last period earnings were
+// computed for.
+func ProviderEarningLastEnd() (found bool, end time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var last NullTime
+	err := tx.QueryRow("SELECT max(PERIOD_END) FROM PROVIDER_EARNING where KIND=$1", EarningKindPeriod).Scan(&last)
+	checkErr(err)
+	if last.Valid {
+		found, end = true, last.Time
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ProviderSaveEarnings saves the earnings of a period, the ones already saved
+// are left untouched.
+func ProviderSaveEarnings(earnings []*ProviderEarning) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("insert into PROVIDER_EARNING(NODE_ID,KIND,PERIOD_START,PERIOD_END,BYTE_HOURS,TRAFFIC,AVAILABILITY,AMOUNT,HELD,CREATION) values($1,$2,$3,$4,$5,$6,$7,$8,$9,now()) ON CONFLICT (NODE_ID,PERIOD_START,KIND) DO NOTHING")
+	defer stmt.Close()
+	checkErr(err)
+	for _, pe := range earnings {
+		_, err = stmt.Exec(pe.NodeId, pe.Kind, pe.PeriodStart, pe.PeriodEnd, pe.ByteHours, pe.Traffic, pe.Availability, pe.Amount, pe.Held)
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// providerReleaseHeld turns the amount held back from the provider into a
+// payable earning.
+func providerReleaseHeld(tx *sql.Tx, nodeId string) {
+	var held uint64
+	err := tx.QueryRow("SELECT COALESCE(sum(HELD),0) FROM PROVIDER_EARNING where NODE_ID=$1 and KIND=$2", nodeId, EarningKindPeriod).Scan(&held)
+	checkErr(err)
+	if held == 0 {
+		return
+	}
+	stmt, err := tx.Prepare("insert into PROVIDER_EARNING(NODE_ID,KIND,PERIOD_START,PERIOD_END,BYTE_HOURS,TRAFFIC,AVAILABILITY,AMOUNT,HELD,CREATION) values($1,$2,now(),now(),0,0,1,$3,0,now())")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, EarningKindRelease, held)
+	checkErr(err)
+}
+
+// ProviderEarningSummary returns the amount earned by the provider, the part
+// held back and the part paid out.
+func ProviderEarningSummary(nodeId string) (amount uint64, held uint64, paid uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	var released uint64
+	err := tx.QueryRow("SELECT COALESCE(sum(CASE WHEN KIND=$2 THEN AMOUNT ELSE 0 END),0),COALESCE(sum(CASE WHEN KIND=$2 THEN HELD ELSE 0 END),0),COALESCE(sum(CASE WHEN KIND=$3 THEN AMOUNT ELSE 0 END),0) FROM PROVIDER_EARNING where NODE_ID=$1", nodeId, EarningKindPeriod, EarningKindRelease).Scan(&amount, &held, &released)
+	checkErr(err)
+	held -= released
+	err = tx.QueryRow("SELECT COALESCE(sum(AMOUNT),0) FROM PROVIDER_PAYOUT where NODE_ID=$1 and PAID=true", nodeId).Scan(&paid)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+type ProviderPayout struct {
+	Id            string `json:"id"`
+	NodeId        string `json:"nodeId"`
+	WalletAddress string `json:"address"`
+	Amount        uint64 `json:"amount"`
+}
+
+// ProviderCreatePayoutBatch pays out the earnings not paid yet of every
+// provider not banned whose payable amount reaches minPayout, to the wallet
+// address in effect at the given time.
+func ProviderCreatePayoutBatch(minPayout uint64, at time.Time) (batchId string, payouts []*ProviderPayout) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT e.NODE_ID,sum(e.AMOUNT-e.HELD) FROM PROVIDER_EARNING e join PROVIDER p on e.NODE_ID=p.NODE_ID where e.PAYOUT_ID is null and p.STATUS<>$1 group by e.NODE_ID having sum(e.AMOUNT-e.HELD)>=$2", ProviderStatusBanned, minPayout)
+	checkErr(err)
+	payouts = make([]*ProviderPayout, 0, 64)
+	for rows.Next() {
+		pp := &ProviderPayout{}
+		err = rows.Scan(&pp.NodeId, &pp.Amount)
+		checkErr(err)
+		payouts = append(payouts, pp)
+	}
+	rows.Close()
+	if len(payouts) == 0 {
+		return
+	}
+	err = tx.QueryRow("insert into PROVIDER_PAYOUT_BATCH(CREATION) values(now()) RETURNING ID").Scan(&batchId)
+	checkErr(err)
+	for _, pp := range payouts {
+		pp.WalletAddress = providerWalletAddressAt(tx, pp.NodeId, at)
+		err = tx.QueryRow("insert into PROVIDER_PAYOUT(BATCH_ID,NODE_ID,WALLET_ADDRESS,AMOUNT,CREATION) values($1,$2,$3,$4,now()) RETURNING ID", batchId, pp.NodeId, pp.WalletAddress, pp.Amount).Scan(&pp.Id)
+		checkErr(err)
+		_, err = tx.Exec("update PROVIDER_EARNING set PAYOUT_ID=$2 where NODE_ID=$1 and PAYOUT_ID is null", pp.NodeId, pp.Id)
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+// ProviderPayoutsUnpaid returns the payouts the teller has not executed yet.
+func ProviderPayoutsUnpaid() (payouts []*ProviderPayout) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT ID,NODE_ID,WALLET_ADDRESS,AMOUNT FROM PROVIDER_PAYOUT where PAID=false order by CREATION")
+	checkErr(err)
+	defer rows.Close()
+	payouts = make([]*ProviderPayout, 0, 64)
+	for rows.Next() {
+		pp := &ProviderPayout{}
+		err = rows.Scan(&pp.Id, &pp.NodeId, &pp.WalletAddress, &pp.Amount)
+		checkErr(err)
+		payouts = append(payouts, pp)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+type PayoutResult struct {
+	Id            string `json:"id"`
+	TransactionId string `json:"txid"`
+}
+
+// ProviderPayoutsPaid marks the payouts executed by the teller, all or none.
+func ProviderPayoutsPaid(results []*PayoutResult) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("update PROVIDER_PAYOUT set PAID=true,TRANSACTION_ID=$2,PAID_TIME=now() where ID=$1 and PAID=false")
+	defer stmt.Close()
+	checkErr(err)
+	for _, pr := range results {
+		rs, err := stmt.Exec(pr.Id, pr.TransactionId)
+		checkErr(err)
+		cnt, err := rs.RowsAffected()
+		checkErr(err)
+		if cnt == 0 {
+			panic(fmt.Errorf("unpaid payout %s not found", pr.Id))
+		}
+	}
+	checkErr(tx.Commit())
+	commit = true
+}
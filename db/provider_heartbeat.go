@@ -0,0 +1,69 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+type ProviderHeartbeat struct {
+	NodeId       string
+	FreeVolume   uint64
+	UsedVolume   uint64
+	MaxFileSize  uint64
+	Version      string
+	Endpoints    []string
+	LastModified time.Time
+}
+
+func ProviderSaveHeartbeat(hb *ProviderHeartbeat) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerSaveHeartbeat(tx, hb)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func providerSaveHeartbeat(tx *sql.Tx, hb *ProviderHeartbeat) {
+	endpoints := "NULL"
+	if len(hb.Endpoints) > 0 {
+		endpoints = arrayClause(len(hb.Endpoints), 7)
+	}
+	stmt, err := tx.Prepare("UPSERT INTO PROVIDER_HEARTBEAT(NODE_ID,FREE_VOLUME,USED_VOLUME,MAX_FILE_SIZE,VERSION,LAST_MODIFIED,ENDPOINTS) values($1,$2,$3,$4,$5,$6," + endpoints + ")")
+	defer stmt.Close()
+	checkErr(err)
+	args := make([]interface{}, 6, 6+len(hb.Endpoints))
+	args[0], args[1], args[2], args[3], args[4], args[5] = hb.NodeId, hb.FreeVolume, hb.UsedVolume, hb.MaxFileSize, hb.Version, hb.LastModified
+	for _, ep := range hb.Endpoints {
+		args = append(args, ep)
+	}
+	_, err = stmt.Exec(args...)
+	checkErr(err)
+}
+
+// ProviderHeartbeatsSince returns the heartbeats received after since by node id.
+func ProviderHeartbeatsSince(since time.Time) (m map[string]*ProviderHeartbeat) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	m = providerHeartbeatsSince(tx, since)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerHeartbeatsSince(tx *sql.Tx, since time.Time) map[string]*ProviderHeartbeat {
+	rows, err := tx.Query("SELECT NODE_ID,FREE_VOLUME,USED_VOLUME,MAX_FILE_SIZE,VERSION,ENDPOINTS,LAST_MODIFIED FROM PROVIDER_HEARTBEAT where LAST_MODIFIED>$1", since)
+	checkErr(err)
+	defer rows.Close()
+	m := make(map[string]*ProviderHeartbeat, 64)
+	for rows.Next() {
+		hb := &ProviderHeartbeat{}
+		var endpoints NullStrSlice
+		err = rows.Scan(&hb.NodeId, &hb.FreeVolume, &hb.UsedVolume, &hb.MaxFileSize, &hb.Version, &endpoints, &hb.LastModified)
+		checkErr(err)
+		if endpoints.Valid {
+			hb.Endpoints = endpoints.StrSlice
+		}
+		m[hb.NodeId] = hb
+	}
+	return m
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func ProviderUpdateAddress(nodeId string, port uint32, host string, dynamicDomain string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerUpdateAddress(tx, nodeId, port, host, dynamicDomain)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func providerUpdateAddress(tx *sql.Tx, nodeId string, port uint32, host string, dynamicDomain string) {
+	stmt, err := tx.Prepare("update PROVIDER set PORT=$2,HOST=$3,DYNAMIC_DOMAIN=$4,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, port, host, dynamicDomain)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+}
+
+func ProviderUpdateBandwidth(nodeId string, upBandwidth uint64, downBandwidth uint64, testUpBandwidth uint64, testDownBandwidth uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerUpdateBandwidth(tx, nodeId, upBandwidth, downBandwidth, testUpBandwidth, testDownBandwidth)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func providerUpdateBandwidth(tx *sql.Tx, nodeId string, upBandwidth uint64, downBandwidth uint64, testUpBandwidth uint64, testDownBandwidth uint64) {
+	stmt, err := tx.Prepare("update PROVIDER set UP_BANDWIDTH=$2,DOWN_BANDWIDTH=$3,TEST_UP_BANDWIDTH=$4,TEST_DOWN_BANDWIDTH=$5,LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, upBandwidth, downBandwidth, testUpBandwidth, testDownBandwidth)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+}
+
+// ProviderChangeBillEmail keeps the new bill email aside until it is verified
+// with the random code.
+func ProviderChangeBillEmail(nodeId string, billEmail string, randomCode string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerChangeBillEmail(tx, nodeId, billEmail, randomCode)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func providerChangeBillEmail(tx *sql.Tx, nodeId string, billEmail string, randomCode string) {
+	stmt, err := tx.Prepare("update PROVIDER set NEW_BILL_EMAIL=$2,RANDOM_CODE=$3,SEND_TIME=now(),LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	rs, err := stmt.Exec(nodeId, billEmail, randomCode)
+	checkErr(err)
+	cnt, err := rs.RowsAffected()
+	checkErr(err)
+	if cnt == 0 {
+		panic(errors.New("no record found"))
+	}
+}
+
+// ProviderChangeWalletAddress logs a change of wallet address taking effect at
+// the given time, before that payouts still go to the address in use.
+func ProviderChangeWalletAddress(nodeId string, walletAddress string, effective time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	from := providerWalletAddressAt(tx, nodeId, time.Now())
+	stmt, err := tx.Prepare("insert into PROVIDER_WALLET_LOG(NODE_ID,FROM_ADDRESS,TO_ADDRESS,CREATION,EFFECTIVE) values($1,$2,$3,now(),$4)")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, from, walletAddress, effective)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// ProviderWalletAddressAt returns the wallet address payouts go to at the
+// given time.
+func ProviderWalletAddressAt(nodeId string, at time.Time) (address string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	address = providerWalletAddressAt(tx, nodeId, at)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerWalletAddressAt(tx *sql.Tx, nodeId string, at time.Time) (address string) {
+	err := tx.QueryRow("SELECT COALESCE((SELECT TO_ADDRESS FROM PROVIDER_WALLET_LOG where NODE_ID=$1 and EFFECTIVE<=$2 order by EFFECTIVE desc limit 1),WALLET_ADDRESS) FROM PROVIDER where NODE_ID=$1", nodeId, at).Scan(&address)
+	checkErr(err)
+	return
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	actionTypeStore    = 1
+	actionTypeRetrieve = 2
+)
+
+// ActionStats counts the store and retrieve actions a provider reported to the
+// collector, with the bytes transported by the successful ones.
+type ActionStats struct {
+	StoreSuccess    uint64
+	StoreFail       uint64
+	RetrieveSuccess uint64
+	RetrieveFail    uint64
+	StoreTraffic    uint64
+	RetrieveTraffic uint64
+}
+
+func ProviderActionStatsSince(collectorDb string, nodeId string, since time.Time) (as *ActionStats) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query(fmt.Sprintf("SELECT PVD_TYPE,PVD_SUCCESS,count(*),COALESCE(sum(PVD_TRANSPORT_SIZE),0) FROM %s.ACTION_LOG where PVD_NODE_ID=$1 and PVD_END_TIME>=$2 group by PVD_TYPE,PVD_SUCCESS", collectorDb), nodeId, since)
+	checkErr(err)
+	defer rows.Close()
+	as = &ActionStats{}
+	for rows.Next() {
+		var tp int
+		var success bool
+		var count, traffic uint64
+		err = rows.Scan(&tp, &success, &count, &traffic)
+		checkErr(err)
+		switch {
+		case tp == actionTypeStore && success:
+			as.StoreSuccess, as.StoreTraffic = count, traffic
+		case tp == actionTypeStore:
+			as.StoreFail = count
+		case tp == actionTypeRetrieve && success:
+			as.RetrieveSuccess, as.RetrieveTraffic = count, traffic
+		case tp == actionTypeRetrieve:
+			as.RetrieveFail = count
+		}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ProviderRecordProbe counts the result of a probe in the hour it was made.
+func ProviderRecordProbe(nodeId string, success bool, at time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	providerRecordProbe(tx, nodeId, success, at)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func providerRecordProbe(tx *sql.Tx, nodeId string, success bool, at time.Time) {
+	var s, f int
+	if success {
+		s = 1
+	} else {
+		f = 1
+	}
+	stmt, err := tx.Prepare("insert into PROVIDER_UPTIME(NODE_ID,HOUR,SUCCESS,FAIL) values($1,$2,$3,$4) ON CONFLICT (NODE_ID,HOUR) DO UPDATE SET SUCCESS=PROVIDER_UPTIME.SUCCESS+excluded.SUCCESS,FAIL=PROVIDER_UPTIME.FAIL+excluded.FAIL")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, at.UTC().Truncate(time.Hour), s, f)
+	checkErr(err)
+}
+
+func ProviderUptimeSince(nodeId string, since time.Time) (success uint64, fail uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	success, fail = providerUptimeSince(tx, nodeId, since)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerUptimeSince(tx *sql.Tx, nodeId string, since time.Time) (success uint64, fail uint64) {
+	err := tx.QueryRow("SELECT COALESCE(sum(SUCCESS),0),COALESCE(sum(FAIL),0) FROM PROVIDER_UPTIME where NODE_ID=$1 and HOUR>=$2", nodeId, since).Scan(&success, &fail)
+	checkErr(err)
+	return
+}
+
+type UptimeSummary struct {
+	NodeId   string
+	Declared float64
+	Success  uint64
+	Fail     uint64
+}
+
+// ProviderUptimeSummaries sums up the probes since the given time of every
+// provider probed, with the availability declared at register.
+func ProviderUptimeSummaries(since time.Time) (slice []*UptimeSummary) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	slice = providerUptimeSummaries(tx, since)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerUptimeSummaries(tx *sql.Tx, since time.Time) []*UptimeSummary {
+	rows, err := tx.Query("SELECT u.NODE_ID,p.AVAILABILITY,sum(u.SUCCESS),sum(u.FAIL) FROM PROVIDER_UPTIME u join PROVIDER p on u.NODE_ID=p.NODE_ID where u.HOUR>=$1 and p.REMOVED=false group by u.NODE_ID,p.AVAILABILITY", since)
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*UptimeSummary, 0, 64)
+	for rows.Next() {
+		us := &UptimeSummary{}
+		err = rows.Scan(&us.NodeId, &us.Declared, &us.Success, &us.Fail)
+		checkErr(err)
+		res = append(res, us)
+	}
+	return res
+}
+
+func ProviderGetAvailability(nodeId string) (found bool, availability float64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT AVAILABILITY FROM PROVIDER where NODE_ID=$1", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&availability)
+		checkErr(err)
+		found = true
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func ProviderSaveSlaBreach(nodeId string, declared float64, actual float64, probes uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("insert into PROVIDER_SLA_BREACH(NODE_ID,DECLARED,ACTUAL,PROBES,CREATION) values($1,$2,$3,$4,now())")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(nodeId, declared, actual, probes)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+func ProviderUptimePrune(before time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	_, err := tx.Exec("delete from PROVIDER_UPTIME where HOUR<$1", before)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// ProviderUptimesBetween sums up the probes of every provider within the period.
+func ProviderUptimesBetween(start time.Time, end time.Time) (m map[string]*UptimeSummary) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	rows, err := tx.Query("SELECT NODE_ID,sum(SUCCESS),sum(FAIL) FROM PROVIDER_UPTIME where HOUR>=$1 and HOUR<$2 group by NODE_ID", start, end)
+	checkErr(err)
+	defer rows.Close()
+	m = make(map[string]*UptimeSummary, 64)
+	for rows.Next() {
+		us := &UptimeSummary{}
+		err = rows.Scan(&us.NodeId, &us.Success, &us.Fail)
+		checkErr(err)
+		m[us.NodeId] = us
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+func ProviderGetStorageVolume(nodeId string) (found bool, volumes []uint64) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	found, volumes = providerGetStorageVolume(tx, nodeId)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerGetStorageVolume(tx *sql.Tx, nodeId string) (found bool, volumes []uint64) {
+	rows, err := tx.Query("SELECT STORAGE_VOLUME FROM PROVIDER where NODE_ID=$1 and REMOVED=false", nodeId)
+	checkErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var storageVolume NullUint64Slice
+		err = rows.Scan(&storageVolume)
+		checkErr(err)
+		if storageVolume.Valid {
+			volumes = storageVolume.Uint64Slice
+		}
+		found = true
+	}
+	return
+}
+
+// ProviderResizeStorageVolume sets the size of the volume at index, the first
+// one being the main storage volume.
+func ProviderResizeStorageVolume(nodeId string, index int, volume uint64) (volumes []uint64, err error) {
+	return providerChangeStorageVolume(nodeId, func(old []uint64) ([]uint64, error) {
+		return resizeVolume(old, index, volume)
+	})
+}
+
+// ProviderRemoveStorageVolume removes an extra storage volume, the main storage
+// volume can not be removed.
+func ProviderRemoveStorageVolume(nodeId string, index int) (volumes []uint64, err error) {
+	return providerChangeStorageVolume(nodeId, func(old []uint64) ([]uint64, error) {
+		return removeVolume(old, index)
+	})
+}
+
+func providerChangeStorageVolume(nodeId string, change func([]uint64) ([]uint64, error)) (volumes []uint64, err error) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	found, old := providerGetStorageVolume(tx, nodeId)
+	if !found {
+		return nil, errors.New("provider not found")
+	}
+	if volumes, err = change(old); err != nil {
+		return
+	}
+	providerSetStorageVolume(tx, nodeId, volumes)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerSetStorageVolume(tx *sql.Tx, nodeId string, volumes []uint64) {
+	stmt, err := tx.Prepare("update PROVIDER set STORAGE_VOLUME=" + arrayClause(len(volumes), 2) + ",LAST_MODIFIED=now() where NODE_ID=$1 and REMOVED=false")
+	defer stmt.Close()
+	checkErr(err)
+	args := make([]interface{}, 1, len(volumes)+1)
+	args[0] = nodeId
+	for _, val := range volumes {
+		args = append(args, val)
+	}
+	_, err = stmt.Exec(args...)
+	checkErr(err)
+}
+
+func resizeVolume(volumes []uint64, index int, volume uint64) ([]uint64, error) {
+	if index < 0 || index >= len(volumes) {
+		return nil, fmt.Errorf("storage volume index %d out of range", index)
+	}
+	res := append([]uint64(nil), volumes...)
+	res[index] = volume
+	return res, nil
+}
+
+func removeVolume(volumes []uint64, index int) ([]uint64, error) {
+	if index == 0 {
+		return nil, errors.New("main storage volume can not be removed")
+	}
+	if index < 0 || index >= len(volumes) {
+		return nil, fmt.Errorf("storage volume index %d out of range", index)
+	}
+	res := make([]uint64, 0, len(volumes)-1)
+	res = append(res, volumes[:index]...)
+	return append(res, volumes[index+1:]...), nil
+}
+
+func sumVolume(volumes []uint64) (sum uint64) {
+	for _, v := range volumes {
+		sum += v
+	}
+	return
+}
+
+// StorageUsage compares the storage volume a provider declared with the size of
+// the blocks the tracker placed on it.
+type StorageUsage struct {
+	NodeId   string `json:"nodeId"`
+	Declared uint64 `json:"declared"`
+	Used     uint64 `json:"used"`
+}
+
+func ProviderStorageUsage(nodeId string) (su *StorageUsage) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	found, volumes := providerGetStorageVolume(tx, nodeId)
+	if found {
+		su = &StorageUsage{NodeId: nodeId, Declared: sumVolume(volumes), Used: blockUsedVolume(tx, nodeId)}
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func blockUsedVolume(tx *sql.Tx, providerId string) (used uint64) {
+	_, used = blockRemainingOnProvider(tx, providerId)
+	return
+}
+
+func ProviderStorageUsages() (slice []*StorageUsage) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	slice = providerStorageUsages(tx)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func providerStorageUsages(tx *sql.Tx) []*StorageUsage {
+	rows, err := tx.Query("SELECT p.NODE_ID,p.STORAGE_VOLUME,(SELECT COALESCE(sum(b.SIZE),0)" + blocksOnProvider("p.NODE_ID") + ") FROM PROVIDER p where p.REMOVED=false")
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*StorageUsage, 0, 64)
+	for rows.Next() {
+		su := &StorageUsage{}
+		var storageVolume NullUint64Slice
+		err = rows.Scan(&su.NodeId, &storageVolume, &su.Used)
+		checkErr(err)
+		if storageVolume.Valid {
+			su.Declared = sumVolume(storageVolume.Uint64Slice)
+		}
+		res = append(res, su)
+	}
+	return res
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestResizeVolume(t *testing.T) {
+	volumes := []uint64{100, 200}
+	res, err := resizeVolume(volumes, 1, 150)
+	if err != nil || len(res) != 2 || res[0] != 100 || res[1] != 150 {
+		t.Errorf("failed: %v %s", res, err)
+	}
+	if volumes[1] != 200 {
+		t.Error("modified argument")
+	}
+	if _, err = resizeVolume(volumes, 2, 150); err == nil {
+		t.Error("out of range")
+	}
+}
+
+func TestRemoveVolume(t *testing.T) {
+	volumes := []uint64{100, 200, 300}
+	res, err := removeVolume(volumes, 1)
+	if err != nil || len(res) != 2 || res[0] != 100 || res[1] != 300 {
+		t.Errorf("failed: %v %s", res, err)
+	}
+	if volumes[1] != 200 {
+		t.Error("modified argument")
+	}
+	if _, err = removeVolume(volumes, 0); err == nil {
+		t.Error("removed main volume")
+	}
+	if _, err = removeVolume(volumes, 3); err == nil {
+		t.Error("out of range")
+	}
+	if sumVolume(res) != 400 {
+		t.Error("sum failed")
+	}
+}
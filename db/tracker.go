@@ -0,0 +1,48 @@
+package db
+
+import (
+	"database/sql"
+)
+
+const (
+	ServerCategoryTracker   = "tracker"
+	ServerCategoryCollector = "collector"
+)
+
+type ServerInfo struct {
+	Server   string
+	Port     uint32
+	Category string
+	Asn      string // the key of its network in the failure domain db
+	Weight   int
+}
+
+func ServerFindAll() (slice []*ServerInfo) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	slice = serverFindAll(tx)
+	checkErr(tx.Commit())
+	commit = true
+	return
+}
+
+func serverFindAll(tx *sql.Tx) []*ServerInfo {
+	rows, err := tx.Query("SELECT SERVER,PORT,CATEGORY,ASN,WEIGHT FROM TRACKER where ACTIVE=true and WEIGHT>0")
+	checkErr(err)
+	defer rows.Close()
+	res := make([]*ServerInfo, 0, 16)
+	for rows.Next() {
+		si := &ServerInfo{}
+		var category, asn sql.NullString
+		err = rows.Scan(&si.Server, &si.Port, &category, &asn, &si.Weight)
+		checkErr(err)
+		if category.Valid {
+			si.Category = category.String
+		}
+		if asn.Valid {
+			si.Asn = asn.String
+		}
+		res = append(res, si)
+	}
+	return res
+}
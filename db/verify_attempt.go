@@ -0,0 +1,77 @@
+package db
+
+import (
+	"time"
+)
+
+// VerifyAttemptLocked tells whether any of the keys is locked out.
+func VerifyAttemptLocked(keys []string) bool {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	var cnt int
+	err := tx.QueryRow("SELECT count(1) FROM VERIFY_ATTEMPT where KEY in "+inClause(len(keys), 1)+" and LOCKED_UNTIL>now()", args...).Scan(&cnt)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+	return cnt > 0
+}
+
+// VerifyAttemptFail counts a wrong code of the key within the window starting
+// at windowStart, the key is locked till lockedUntil once it reaches
+// maxFailures.
+func VerifyAttemptFail(key string, windowStart time.Time, maxFailures int, lockedUntil time.Time) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	stmt, err := tx.Prepare("insert into VERIFY_ATTEMPT(KEY,FAILURES,WINDOW_START,LOCKED_UNTIL) values ($1,1,now(),CASE WHEN 1>=$3 THEN $4::TIMESTAMPTZ ELSE NULL END) ON CONFLICT (KEY) DO UPDATE SET " +
+		"LOCKED_UNTIL=CASE WHEN (CASE WHEN VERIFY_ATTEMPT.WINDOW_START is null or VERIFY_ATTEMPT.WINDOW_START<$2 THEN 1 ELSE VERIFY_ATTEMPT.FAILURES+1 END)>=$3 THEN $4::TIMESTAMPTZ ELSE VERIFY_ATTEMPT.LOCKED_UNTIL END," +
+		"FAILURES=CASE WHEN VERIFY_ATTEMPT.WINDOW_START is null or VERIFY_ATTEMPT.WINDOW_START<$2 THEN 1 ELSE VERIFY_ATTEMPT.FAILURES+1 END," +
+		"WINDOW_START=CASE WHEN VERIFY_ATTEMPT.WINDOW_START is null or VERIFY_ATTEMPT.WINDOW_START<$2 THEN now() ELSE VERIFY_ATTEMPT.WINDOW_START END")
+	defer stmt.Close()
+	checkErr(err)
+	_, err = stmt.Exec(key, windowStart, maxFailures, lockedUntil)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// VerifyAttemptReset clears the wrong codes of the key after a right one.
+func VerifyAttemptReset(key string) {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	_, err := tx.Exec("update VERIFY_ATTEMPT set FAILURES=0,WINDOW_START=NULL,LOCKED_UNTIL=NULL where KEY=$1", key)
+	checkErr(err)
+	checkErr(tx.Commit())
+	commit = true
+}
+
+// VerifySendAllowed records a code sent for all of the keys, unless one was
+// sent for any of them after the given time already.
+func VerifySendAllowed(keys []string, lastSendBefore time.Time) bool {
+	tx, commit := beginTx()
+	defer rollback(tx, &commit)
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, lastSendBefore)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	var cnt int
+	err := tx.QueryRow("SELECT count(1) FROM VERIFY_ATTEMPT where LAST_SEND>=$1 and KEY in "+inClause(len(keys), 2), args...).Scan(&cnt)
+	checkErr(err)
+	if cnt > 0 {
+		return false
+	}
+	stmt, err := tx.Prepare("insert into VERIFY_ATTEMPT(KEY,FAILURES,LAST_SEND) values ($1,0,now()) ON CONFLICT (KEY) DO UPDATE SET LAST_SEND=now()")
+	defer stmt.Close()
+	checkErr(err)
+	for _, key := range keys {
+		_, err = stmt.Exec(key)
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	commit = true
+	return true
+}
@@ -7,12 +7,24 @@ import (
 	"log"
 	"net"
 
+	"nebula-tracker/admin"
 	"nebula-tracker/config"
 	"nebula-tracker/db"
 	metadata_impl "nebula-tracker/metadata/impl"
 	chooser "nebula-tracker/metadata/provider_chooser"
+	"nebula-tracker/metadata/repair"
 	register_cimpl "nebula-tracker/register/client/impl"
+	"nebula-tracker/register/client/notify"
+	"nebula-tracker/register/client/orderstate"
+	"nebula-tracker/register/client/plan"
+	"nebula-tracker/register/client/renew"
+	"nebula-tracker/register/client/retention"
+	"nebula-tracker/register/discovery"
+	"nebula-tracker/register/provider/billing"
 	register_pimpl "nebula-tracker/register/provider/impl"
+	"nebula-tracker/register/provider/speedtest"
+	"nebula-tracker/register/provider/uptime"
+	"nebula-tracker/register/sendmail"
 
 	pbm "github.com/samoslab/nebula/tracker/metadata/pb"
 	pbrc "github.com/samoslab/nebula/tracker/register/client/pb"
@@ -35,6 +47,29 @@ func main() {
 	defer dbo.Close()
 	chooser.StartAutoUpdate()
 	defer chooser.StopAutoUpdate()
+	repair.StartAutoRepair()
+	defer repair.StopAutoRepair()
+	uptime.StartAutoCheck()
+	defer uptime.StopAutoCheck()
+	speedtest.StartAutoTest()
+	defer speedtest.StopAutoTest()
+	billing.StartAutoBill()
+	defer billing.StopAutoBill()
+	discovery.StartAutoUpdate()
+	defer discovery.StopAutoUpdate()
+	sendmail.StartAutoRetry()
+	defer sendmail.StopAutoRetry()
+	notify.StartAutoNotify()
+	defer notify.StopAutoNotify()
+	retention.StartAutoRetention()
+	defer retention.StopAutoRetention()
+	renew.StartAutoRenew()
+	defer renew.StopAutoRenew()
+	plan.StartAutoPlanChange()
+	defer plan.StopAutoPlanChange()
+	orderstate.StartAutoOrderState()
+	defer orderstate.StopAutoOrderState()
+	admin.StartServer()
 	grpcServer := grpc.NewServer()
 	pbrp.RegisterProviderRegisterServiceServer(grpcServer, register_pimpl.NewProviderRegisterService(pk))
 	pbrc.RegisterClientRegisterServiceServer(grpcServer, register_cimpl.NewClientRegisterService(pk))
@@ -63,7 +63,23 @@ create table IF NOT EXISTS BLOCK(
     REMOVE_TIME TIMESTAMPTZ DEFAULT NULL,
     REMOVED BOOL NOT NULL DEFAULT false,
     PROVIDER_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
-    UNIQUE (FILE_ID, HASH)
+    -- failed attempts to migrate it off the provider, reset once migrated
+    MIGRATE_FAILURES INT NOT NULL DEFAULT 0,
+    -- when it was migrated to PROVIDER_ID, NULL while on the provider it was created on
+    PLACED_TIME TIMESTAMPTZ DEFAULT NULL,
+    UNIQUE (FILE_ID, HASH),
+    INDEX BLOCK_PROVIDER_ID(PROVIDER_ID)
+);
+
+-- the placements of blocks on the providers they were migrated off, for billing
+create table IF NOT EXISTS BLOCK_PLACEMENT(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    BLOCK_ID UUID NOT NULL REFERENCES BLOCK (ID),
+    PROVIDER_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    SIZE INT NOT NULL,
+    START_TIME TIMESTAMPTZ NOT NULL,
+    END_TIME TIMESTAMPTZ NOT NULL,
+    INDEX BLOCK_PLACEMENT_END_TIME(END_TIME)
 );
 
 create table IF NOT EXISTS NA_RECORD(
@@ -7,7 +7,7 @@ import (
 
 type providerChooser interface {
 	Count() int
-	Choose(num int) []db.ProviderInfo
+	Choose(sel *chooser.Selection) ([]db.ProviderInfo, bool)
 }
 
 type chooserImpl struct {
@@ -17,6 +17,6 @@ func (self *chooserImpl) Count() int {
 	return chooser.Count()
 }
 
-func (self *chooserImpl) Choose(num int) []db.ProviderInfo {
-	return chooser.Choose(num)
+func (self *chooserImpl) Choose(sel *chooser.Selection) ([]db.ProviderInfo, bool) {
+	return chooser.Choose(sel)
 }
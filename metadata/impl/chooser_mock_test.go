@@ -2,6 +2,7 @@
 package impl
 
 import db "nebula-tracker/db"
+import chooser "nebula-tracker/metadata/provider_chooser"
 
 import mock "github.com/stretchr/testify/mock"
 
@@ -10,20 +11,27 @@ type chooserMock struct {
 	mock.Mock
 }
 
-// Choose provides a mock function with given fields: num
-func (_m *chooserMock) Choose(num int) []db.ProviderInfo {
-	ret := _m.Called(num)
+// Choose provides a mock function with given fields: sel
+func (_m *chooserMock) Choose(sel *chooser.Selection) ([]db.ProviderInfo, bool) {
+	ret := _m.Called(sel)
 
 	var r0 []db.ProviderInfo
-	if rf, ok := ret.Get(0).(func(int) []db.ProviderInfo); ok {
-		r0 = rf(num)
+	if rf, ok := ret.Get(0).(func(*chooser.Selection) []db.ProviderInfo); ok {
+		r0 = rf(sel)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]db.ProviderInfo)
 		}
 	}
 
-	return r0
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(*chooser.Selection) bool); ok {
+		r1 = rf(sel)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
 }
 
 // Count provides a mock function with given fields:
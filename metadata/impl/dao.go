@@ -11,6 +11,9 @@ import (
 type dao interface {
 	FileOwnerMkFolders(interactive bool, nodeId string, spaceNo uint32, parent []byte, folders []string) (duplicateFileName []string, duplicateFolderName []string)
 	ClientGetPubKey(nodeId string) *rsa.PublicKey
+	ClientAccountOf(nodeId string) string
+	ClientRetentionState(nodeId string) int
+	GraceNetflow(nodeId string) (netflow uint32, downNetflow uint32, usageNetflow uint32, usageDownNetflow uint32)
 	FileOwnerFileExists(nodeId string, spaceNo uint32, parent []byte, name string) (id []byte, isFolder bool, hash string)
 	FileCheckExist(nodeId string, hash string, spaceNo uint32, doneExpSecs int) (id []byte, active bool, done bool, fileType string, size uint64, selfCreate bool, doneExpired bool)
 	FileReuse(existId []byte, nodeId string, id []byte, hash string, name string, size uint64, modTime uint64, spaceNo uint32, parentId []byte, fileType string)
@@ -37,6 +40,15 @@ func (self *daoImpl) FileOwnerMkFolders(interactive bool, nodeId string, spaceNo
 func (self *daoImpl) ClientGetPubKey(nodeId string) *rsa.PublicKey {
 	return db.ClientGetPubKey(nodeId)
 }
+func (self *daoImpl) ClientAccountOf(nodeId string) string {
+	return db.ClientAccountOf(nodeId)
+}
+func (self *daoImpl) ClientRetentionState(nodeId string) int {
+	return db.ClientRetentionState(nodeId)
+}
+func (self *daoImpl) GraceNetflow(nodeId string) (netflow uint32, downNetflow uint32, usageNetflow uint32, usageDownNetflow uint32) {
+	return db.GraceNetflow(nodeId)
+}
 func (self *daoImpl) FileOwnerFileExists(nodeId string, spaceNo uint32, parent []byte, name string) (id []byte, isFolder bool, hash string) {
 	return db.FileOwnerFileExists(nodeId, spaceNo, parent, name)
 }
@@ -13,6 +13,69 @@ type daoMock struct {
 	mock.Mock
 }
 
+// ClientAccountOf provides a mock function with given fields: nodeId
+func (_m *daoMock) ClientAccountOf(nodeId string) string {
+	ret := _m.Called(nodeId)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string) string); ok {
+		r0 = rf(nodeId)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
+// ClientRetentionState provides a mock function with given fields: nodeId
+func (_m *daoMock) ClientRetentionState(nodeId string) int {
+	ret := _m.Called(nodeId)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(string) int); ok {
+		r0 = rf(nodeId)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	return r0
+}
+
+// GraceNetflow provides a mock function with given fields: nodeId
+func (_m *daoMock) GraceNetflow(nodeId string) (uint32, uint32, uint32, uint32) {
+	ret := _m.Called(nodeId)
+
+	var r0 uint32
+	if rf, ok := ret.Get(0).(func(string) uint32); ok {
+		r0 = rf(nodeId)
+	} else {
+		r0 = ret.Get(0).(uint32)
+	}
+
+	var r1 uint32
+	if rf, ok := ret.Get(1).(func(string) uint32); ok {
+		r1 = rf(nodeId)
+	} else {
+		r1 = ret.Get(1).(uint32)
+	}
+
+	var r2 uint32
+	if rf, ok := ret.Get(2).(func(string) uint32); ok {
+		r2 = rf(nodeId)
+	} else {
+		r2 = ret.Get(2).(uint32)
+	}
+
+	var r3 uint32
+	if rf, ok := ret.Get(3).(func(string) uint32); ok {
+		r3 = rf(nodeId)
+	} else {
+		r3 = ret.Get(3).(uint32)
+	}
+
+	return r0, r1, r2, r3
+}
+
 // ClientGetPubKey provides a mock function with given fields: nodeId
 func (_m *daoMock) ClientGetPubKey(nodeId string) *rsa.PublicKey {
 	ret := _m.Called(nodeId)
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"nebula-tracker/config"
 	"nebula-tracker/db"
+	chooser "nebula-tracker/metadata/provider_chooser"
+	"net"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -24,6 +26,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -74,7 +77,7 @@ func (self *MatadataService) MkFolder(ctx context.Context, req *pb.MkFolderReq)
 			return &pb.MkFolderResp{Code: 13, ErrMsg: "folder name can not contains slash /"}, nil
 		}
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, _, _, _, _, _, _, _, _, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
 		return &pb.MkFolderResp{Code: 400, ErrMsg: "email not verified"}, nil
@@ -142,7 +145,7 @@ func (self *MatadataService) CheckFileExist(ctx context.Context, req *pb.CheckFi
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.CheckFileExistResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, volume, netflow, upNetflow,
 		_, usageVolume, usageNetflow, usageUpNetflow, _, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
@@ -289,8 +292,29 @@ func uuidStr() string {
 	u := uuid.NewV4()
 	return "-" + base64.StdEncoding.EncodeToString(u[:])
 }
-func (self *MatadataService) prepareReplicaProvider(nodeId string, num int, fileHash []byte, fileSize uint64, blockHash []byte, blockSize uint64) []*pb.ReplicaProvider {
-	pis := self.c.Choose(num)
+
+// clientHosts returns the address the request comes from, the client must not
+// store pieces on a provider running on its own host. It is a best effort only:
+// behind NAT or a proxy the peer address is the one of the gateway, so a
+// provider on the client host is not caught, and the providers sharing the
+// gateway of the client are excluded as well.
+func clientHosts(ctx context.Context) map[string]bool {
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.Addr == net.Addr(nil) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(pr.Addr.String())
+	if err != nil {
+		return nil
+	}
+	return map[string]bool{host: true}
+}
+
+func (self *MatadataService) prepareReplicaProvider(nodeId string, excludeHosts map[string]bool, num int, fileHash []byte, fileSize uint64, blockHash []byte, blockSize uint64) []*pb.ReplicaProvider {
+	pis, diverse := self.c.Choose(&chooser.Selection{Num: num, PieceSize: blockSize, ExcludeHosts: excludeHosts})
+	if !diverse {
+		log.Warnf("replicas of block %x of file %x share failure domain", blockHash, fileHash)
+	}
 	res := make([]*pb.ReplicaProvider, 0, len(pis))
 	ts := uint64(time.Now().Unix())
 	for _, pi := range pis {
@@ -337,7 +361,7 @@ func (self *MatadataService) UploadFilePrepare(ctx context.Context, req *pb.Uplo
 	if err := req.VerifySign(pubKey); err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "verify sign failed， error: %s", err)
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, volume, netflow, upNetflow,
 		_, usageVolume, usageNetflow, usageUpNetflow, _, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
@@ -383,7 +407,12 @@ func (self *MatadataService) UploadFilePrepare(ctx context.Context, req *pb.Uplo
 		if providerCnt < 5 {
 			replicaCount = uint32(providerCnt)
 		}
-		return &pb.UploadFilePrepareResp{ReplicaCount: replicaCount, Provider: self.prepareReplicaProvider(nodeIdStr, int(replicaCount), req.FileHash, req.FileSize, piece.Hash, uint64(piece.Size))}, nil
+		provider := self.prepareReplicaProvider(nodeIdStr, clientHosts(ctx), int(replicaCount), req.FileHash, req.FileSize, piece.Hash, uint64(piece.Size))
+		if len(provider) == 0 {
+			return nil, status.Error(codes.Unavailable, "not enough provider")
+		}
+		// fewer providers than asked may be available for the size and exclusions
+		return &pb.UploadFilePrepareResp{ReplicaCount: uint32(len(provider)), Provider: provider}, nil
 	}
 	hashMap := make(map[string]bool, pieceCnt*len(req.Partition))
 	for _, part := range req.Partition {
@@ -403,16 +432,42 @@ func (self *MatadataService) UploadFilePrepare(ctx context.Context, req *pb.Uplo
 	if providerCnt-pieceCnt < backupProCnt {
 		backupProCnt = providerCnt - pieceCnt
 	}
-	return &pb.UploadFilePrepareResp{Partition: self.prepareErasureCodeProvider(nodeIdStr, req.FileHash, req.FileSize, req.Partition, pieceCnt, backupProCnt)}, nil
+	partition, err := self.prepareErasureCodeProvider(nodeIdStr, clientHosts(ctx), req.FileHash, req.FileSize, req.Partition, pieceCnt, backupProCnt)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UploadFilePrepareResp{Partition: partition}, nil
 }
 
-func (self *MatadataService) prepareErasureCodeProvider(nodeId string, fileHash []byte, fileSize uint64, partition []*pb.SplitPartition, pieceCnt int, backupProCnt int) []*pb.ErasureCodePartition {
+// prepareErasureCodeProvider chooses the providers of every partition, apart
+// from the ones of the other partitions as long as enough are available. It
+// fails if fewer providers than pieces of a partition are available.
+func (self *MatadataService) prepareErasureCodeProvider(nodeId string, excludeHosts map[string]bool, fileHash []byte, fileSize uint64, partition []*pb.SplitPartition, pieceCnt int, backupProCnt int) ([]*pb.ErasureCodePartition, error) {
 	ts := uint64(time.Now().Unix())
 	res := make([]*pb.ErasureCodePartition, 0, len(partition))
+	used := make(map[string]bool, (pieceCnt+backupProCnt)*len(partition))
 	for _, part := range partition {
-		pis := self.c.Choose(pieceCnt + backupProCnt)
+		var maxPieceSize uint64
+		for _, piece := range part.Piece {
+			if uint64(piece.Size) > maxPieceSize {
+				maxPieceSize = uint64(piece.Size)
+			}
+		}
+		sel := &chooser.Selection{Num: pieceCnt + backupProCnt, PieceSize: maxPieceSize, ExcludeNodes: used, ExcludeHosts: excludeHosts}
+		pis, diverse := self.c.Choose(sel)
+		if len(pis) < pieceCnt && len(used) > 0 {
+			log.Warnf("not enough provider for distinct partitions of file %x, reuse providers", fileHash)
+			sel.ExcludeNodes = nil
+			pis, diverse = self.c.Choose(sel)
+		}
 		if len(pis) < pieceCnt {
-			panic("not enough provider")
+			return nil, status.Errorf(codes.Unavailable, "not enough provider, %d available for %d pieces", len(pis), pieceCnt)
+		}
+		for _, pi := range pis {
+			used[pi.NodeId] = true
+		}
+		if !diverse {
+			log.Warnf("pieces of partition of file %x share failure domain", fileHash)
 		}
 		proAuth := make([]*pb.BlockProviderAuth, 0, len(pis))
 		for i, piece := range part.Piece {
@@ -460,7 +515,7 @@ func (self *MatadataService) prepareErasureCodeProvider(nodeId string, fileHash
 		}
 		res = append(res, &pb.ErasureCodePartition{ProviderAuth: proAuth, Timestamp: ts})
 	}
-	return res
+	return res, nil
 }
 
 func (self *MatadataService) UploadFileDone(ctx context.Context, req *pb.UploadFileDoneReq) (resp *pb.UploadFileDoneResp, err error) {
@@ -482,7 +537,7 @@ func (self *MatadataService) UploadFileDone(ctx context.Context, req *pb.UploadF
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.UploadFileDoneResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, volume, netflow, upNetflow,
 		_, usageVolume, usageNetflow, usageUpNetflow, _, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
@@ -597,26 +652,41 @@ func (self *MatadataService) ListFiles(ctx context.Context, req *pb.ListFilesReq
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.ListFilesResp{Code: 6, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, _, netflow, _,
 		downNetflow, _, usageNetflow, _, usageDownNetflow, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
 		return &pb.ListFilesResp{Code: 400, ErrMsg: "email not verified"}, nil
 	}
 	if !inService {
-		return &pb.ListFilesResp{Code: 401, ErrMsg: "not buy any package order"}, nil
-	}
-	// if volume <= usageVolume {
-	// 	return &pb.ListFilesResp{Code: 410, ErrMsg: "storage volume exceed"}, nil
-	// }
-	if netflow <= usageNetflow {
-		return &pb.ListFilesResp{Code: 411, ErrMsg: "netflow exceed"}, nil
-	}
-	// if upNetflow <= usageUpNetflow {
-	// 	return &pb.ListFilesResp{Code: 412, ErrMsg: "upload netflow exceed"}, nil
-	// }
-	if downNetflow <= usageDownNetflow {
-		return &pb.ListFilesResp{Code: 413, ErrMsg: "download netflow exceed"}, nil
+		// read only within the grace period after the package ended, with the netflow left of it
+		switch self.d.ClientRetentionState(nodeIdStr) {
+		case db.RetentionGrace:
+			graceNetflow, graceDownNetflow, graceUsageNetflow, graceUsageDownNetflow := self.d.GraceNetflow(nodeIdStr)
+			if graceNetflow <= graceUsageNetflow {
+				return &pb.ListFilesResp{Code: 411, ErrMsg: "netflow exceed"}, nil
+			}
+			if graceDownNetflow <= graceUsageDownNetflow {
+				return &pb.ListFilesResp{Code: 413, ErrMsg: "download netflow exceed"}, nil
+			}
+		case db.RetentionFrozen:
+			return &pb.ListFilesResp{Code: 401, ErrMsg: "package expired and files frozen, please renew"}, nil
+		default:
+			return &pb.ListFilesResp{Code: 401, ErrMsg: "not buy any package order"}, nil
+		}
+	} else {
+		// if volume <= usageVolume {
+		// 	return &pb.ListFilesResp{Code: 410, ErrMsg: "storage volume exceed"}, nil
+		// }
+		if netflow <= usageNetflow {
+			return &pb.ListFilesResp{Code: 411, ErrMsg: "netflow exceed"}, nil
+		}
+		// if upNetflow <= usageUpNetflow {
+		// 	return &pb.ListFilesResp{Code: 412, ErrMsg: "upload netflow exceed"}, nil
+		// }
+		if downNetflow <= usageDownNetflow {
+			return &pb.ListFilesResp{Code: 413, ErrMsg: "download netflow exceed"}, nil
+		}
 	}
 	resobj, _, parentId := self.findPathId(nodeIdStr, req.Parent, true)
 	if resobj != nil {
@@ -665,26 +735,41 @@ func (self *MatadataService) RetrieveFile(ctx context.Context, req *pb.RetrieveF
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.RetrieveFileResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, _, netflow, _,
 		downNetflow, _, usageNetflow, _, usageDownNetflow, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
 		return &pb.RetrieveFileResp{Code: 400, ErrMsg: "email not verified"}, nil
 	}
 	if !inService {
-		return &pb.RetrieveFileResp{Code: 401, ErrMsg: "not buy any package order"}, nil
-	}
-	// if volume <= usageVolume {
-	// 	return &pb.RetrieveFileResp{Code: 410, ErrMsg: "storage volume exceed"}, nil
-	// }
-	if netflow <= usageNetflow {
-		return &pb.RetrieveFileResp{Code: 411, ErrMsg: "netflow exceed"}, nil
-	}
-	// if upNetflow <= usageUpNetflow {
-	// 	return &pb.RetrieveFileResp{Code: 412, ErrMsg: "upload netflow exceed"}, nil
-	// }
-	if downNetflow <= usageDownNetflow {
-		return &pb.RetrieveFileResp{Code: 413, ErrMsg: "download netflow exceed"}, nil
+		// read only within the grace period after the package ended, with the netflow left of it
+		switch self.d.ClientRetentionState(nodeIdStr) {
+		case db.RetentionGrace:
+			graceNetflow, graceDownNetflow, graceUsageNetflow, graceUsageDownNetflow := self.d.GraceNetflow(nodeIdStr)
+			if graceNetflow <= graceUsageNetflow {
+				return &pb.RetrieveFileResp{Code: 411, ErrMsg: "netflow exceed"}, nil
+			}
+			if graceDownNetflow <= graceUsageDownNetflow {
+				return &pb.RetrieveFileResp{Code: 413, ErrMsg: "download netflow exceed"}, nil
+			}
+		case db.RetentionFrozen:
+			return &pb.RetrieveFileResp{Code: 401, ErrMsg: "package expired and files frozen, please renew"}, nil
+		default:
+			return &pb.RetrieveFileResp{Code: 401, ErrMsg: "not buy any package order"}, nil
+		}
+	} else {
+		// if volume <= usageVolume {
+		// 	return &pb.RetrieveFileResp{Code: 410, ErrMsg: "storage volume exceed"}, nil
+		// }
+		if netflow <= usageNetflow {
+			return &pb.RetrieveFileResp{Code: 411, ErrMsg: "netflow exceed"}, nil
+		}
+		// if upNetflow <= usageUpNetflow {
+		// 	return &pb.RetrieveFileResp{Code: 412, ErrMsg: "upload netflow exceed"}, nil
+		// }
+		if downNetflow <= usageDownNetflow {
+			return &pb.RetrieveFileResp{Code: 413, ErrMsg: "download netflow exceed"}, nil
+		}
 	}
 	hash := base64.StdEncoding.EncodeToString(req.FileHash)
 	exist, active, fileData, partitionCount, blocks, size, fileType, encryptKey := self.d.FileRetrieve(nodeIdStr, hash, req.SpaceNo)
@@ -811,7 +896,7 @@ func (self *MatadataService) Remove(ctx context.Context, req *pb.RemoveReq) (res
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.RemoveResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, _, _, _,
 		_, _, _, _, _, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
@@ -892,7 +977,7 @@ func (self *MatadataService) Move(ctx context.Context, req *pb.MoveReq) (resp *p
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.MoveResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	inService, emailVerified, _, _, _, _,
 		_, _, _, _, _, _ := self.d.UsageAmount(nodeIdStr)
 	if !emailVerified {
@@ -984,7 +1069,7 @@ func (self *MatadataService) SpaceSysFile(ctx context.Context, req *pb.SpaceSysF
 	// if downNetflow <= usageDownNetflow {
 	// 	return nil, status.Error(codes.OutOfRange, "download netflow exceed")
 	// }
-	nodeIdStr := base64.StdEncoding.EncodeToString(req.NodeId)
+	nodeIdStr := self.d.ClientAccountOf(base64.StdEncoding.EncodeToString(req.NodeId))
 	id, isFolder, hash := self.d.FileOwnerFileExists(nodeIdStr, req.SpaceNo, nil, db.SpaceSysFilename)
 	if len(id) > 0 && !isFolder {
 		exist, _, fileData, _, _, _, _, _ := self.d.FileRetrieve(nodeIdStr, hash, req.SpaceNo)
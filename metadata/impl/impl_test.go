@@ -79,6 +79,7 @@ func TestMkFolder(t *testing.T) {
 	ms = &MatadataService{d: mockDao}
 	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
 	mockDao.On("UsageAmount", nodeIdStr).Return(true, true, int64(1212), uint32(1024), uint32(3072), uint32(3072), uint32(3072), uint32(512), uint32(512), uint32(512), uint32(512), time.Now())
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
 	req := pb.MkFolderReq{NodeId: nodeId,
 		Timestamp: ts,
 		Parent:    &pb.FilePath{SpaceNo: 0, OneOfPath: &pb.FilePath_Path{"aa"}},
@@ -120,6 +121,7 @@ func TestMkFolder(t *testing.T) {
 	ms = &MatadataService{d: mockDao}
 	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
 	mockDao.On("UsageAmount", nodeIdStr).Return(true, true, int64(1212), uint32(1024), uint32(3072), uint32(3072), uint32(3072), uint32(512), uint32(512), uint32(512), uint32(512), time.Now())
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
 	mockDao.On("FileOwnerIdOfFilePath", nodeIdStr, pathStr, spaceNo).Return(true, nil, parentId, false)
 	req = pb.MkFolderReq{NodeId: nodeId,
 		Timestamp: ts,
@@ -134,6 +136,7 @@ func TestMkFolder(t *testing.T) {
 	ms = &MatadataService{d: mockDao}
 	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
 	mockDao.On("UsageAmount", nodeIdStr).Return(true, false, int64(1212), uint32(1024), uint32(3072), uint32(3072), uint32(3072), uint32(512), uint32(512), uint32(512), uint32(512), time.Now())
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
 	req = pb.MkFolderReq{NodeId: nodeId,
 		Timestamp: ts,
 		Parent:    path,
@@ -147,6 +150,7 @@ func TestMkFolder(t *testing.T) {
 	ms = &MatadataService{d: mockDao}
 	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
 	mockDao.On("UsageAmount", nodeIdStr).Return(false, true, int64(1212), uint32(1024), uint32(3072), uint32(3072), uint32(3072), uint32(512), uint32(512), uint32(512), uint32(512), time.Now())
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
 	req = pb.MkFolderReq{NodeId: nodeId,
 		Timestamp: ts,
 		Parent:    path,
@@ -160,6 +164,7 @@ func TestMkFolder(t *testing.T) {
 	ms = &MatadataService{d: mockDao}
 	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
 	mockDao.On("UsageAmount", nodeIdStr).Return(true, true, int64(1212), uint32(1024), uint32(3072), uint32(3072), uint32(3072), uint32(512), uint32(512), uint32(512), uint32(512), time.Now())
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
 	mockDao.On("FileOwnerCheckId", parentId, spaceNo).Return("", nil, false)
 	req = pb.MkFolderReq{NodeId: nodeId,
 		Timestamp: ts,
@@ -1290,6 +1295,7 @@ func TestListFiles(t *testing.T) {
 	ms = &MatadataService{d: mockDao}
 	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
 	mockDao.On("UsageAmount", nodeIdStr).Return(true, true, int64(1212), uint32(1024), uint32(3072), uint32(3072), uint32(3072), uint32(512), uint32(512), uint32(512), uint32(512), time.Now())
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
 	mockDao.On("FileOwnerIdOfFilePath", nodeIdStr, pathStr, spaceNo).Return(true, nil, pathId, true)
 	mockDao.On("FileOwnerListOfPath", nodeIdStr, spaceNo, mock.Anything, uint32(500), uint32(1), "NAME", true).Return(uint32(0), nil)
 	req = pb.ListFilesReq{NodeId: nodeId,
@@ -1303,6 +1309,42 @@ func TestListFiles(t *testing.T) {
 	resp, err = ms.ListFiles(ctx, &req)
 	assert.Equal(uint32(0), resp.Code)
 	mockDao.AssertExpectations(t)
+
+	// package ended, still listed within the grace period
+	mockDao = new(daoMock)
+	ms = &MatadataService{d: mockDao}
+	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
+	mockDao.On("UsageAmount", nodeIdStr).Return(false, true, int64(0), uint32(0), uint32(0), uint32(0), uint32(0), uint32(512), uint32(512), uint32(512), uint32(512), time.Time{})
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
+	mockDao.On("ClientRetentionState", nodeIdStr).Return(db.RetentionGrace)
+	mockDao.On("GraceNetflow", nodeIdStr).Return(uint32(1024), uint32(1024), uint32(512), uint32(512))
+	mockDao.On("FileOwnerIdOfFilePath", nodeIdStr, pathStr, spaceNo).Return(true, nil, pathId, true)
+	mockDao.On("FileOwnerListOfPath", nodeIdStr, spaceNo, mock.Anything, uint32(500), uint32(1), "NAME", true).Return(uint32(0), nil)
+	resp, err = ms.ListFiles(ctx, &req)
+	assert.Equal(uint32(0), resp.Code)
+	mockDao.AssertExpectations(t)
+
+	// the download netflow left of the ended package used up within the grace period
+	mockDao = new(daoMock)
+	ms = &MatadataService{d: mockDao}
+	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
+	mockDao.On("UsageAmount", nodeIdStr).Return(false, true, int64(0), uint32(0), uint32(0), uint32(0), uint32(0), uint32(512), uint32(512), uint32(512), uint32(512), time.Time{})
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
+	mockDao.On("ClientRetentionState", nodeIdStr).Return(db.RetentionGrace)
+	mockDao.On("GraceNetflow", nodeIdStr).Return(uint32(2048), uint32(1024), uint32(1024), uint32(1024))
+	resp, err = ms.ListFiles(ctx, &req)
+	assert.Equal(uint32(413), resp.Code)
+	mockDao.AssertExpectations(t)
+
+	mockDao = new(daoMock)
+	ms = &MatadataService{d: mockDao}
+	mockDao.On("ClientGetPubKey", nodeIdStr).Return(pubKey)
+	mockDao.On("UsageAmount", nodeIdStr).Return(false, true, int64(0), uint32(0), uint32(0), uint32(0), uint32(0), uint32(512), uint32(512), uint32(512), uint32(512), time.Time{})
+	mockDao.On("ClientAccountOf", nodeIdStr).Return(nodeIdStr)
+	mockDao.On("ClientRetentionState", nodeIdStr).Return(db.RetentionFrozen)
+	resp, err = ms.ListFiles(ctx, &req)
+	assert.Equal(uint32(401), resp.Code)
+	mockDao.AssertExpectations(t)
 }
 
 func TestToRetrievePartition(t *testing.T) {
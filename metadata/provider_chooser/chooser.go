@@ -3,134 +3,327 @@ package provider_chooser
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/rand"
+	"nebula-tracker/config"
 	"nebula-tracker/db"
 	"sync/atomic"
 	"time"
 
-	gosync "github.com/lrita/gosync"
-	"github.com/robfig/cron"
 	provider_pb "github.com/samoslab/nebula/provider/pb"
-	"google.golang.org/grpc"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-var cronRunner *cron.Cron
+var prb *prober
 
 func StartAutoUpdate() {
-	cronRunner = cron.New()
-	cronRunner.AddFunc("15 */3 * * * *", update)
-	cronRunner.Start()
+	conf := config.GetTrackerConfig().Chooser
+	if len(conf.DomainDbFile) > 0 {
+		ddb, err := loadDomainDb(conf.DomainDbFile)
+		if err != nil {
+			log.Fatalf("load failure domain db %s failed: %s", conf.DomainDbFile, err)
+		}
+		domains = ddb
+	}
+	prb = newProber(conf.ProbeWorkers, time.Duration(conf.ProbeIntervalSec)*time.Second, time.Duration(conf.ProbeJitterSec)*time.Second,
+		time.Duration(conf.HeartbeatIntervalSec*heartbeat_missed_max)*time.Second)
+	prb.start()
 }
 
 func StopAutoUpdate() {
-	cronRunner.Stop()
+	prb.shutdown()
+}
+
+// Exclude stops placing on a provider immediately, it is expected to be
+// filtered out of db.ProviderFindAll from now on.
+func Exclude(nodeId string) {
+	if prb != nil {
+		prb.exclude(nodeId)
+	}
 }
 
-var providers *[]db.ProviderInfo
-var providerMap map[string]*db.ProviderInfo
-var initialized = false
-var currentProviderIdx uint64 = 0
+// a heartbeat is fresh as long as the provider missed fewer heartbeats than
+// this, the endpoints of a fresh heartbeat are probed when the registered address
+// is not reachable
+const heartbeat_missed_max = 3
 
-func incrementProviderIdx(offset uint64) {
-	atomic.AddUint64(&currentProviderIdx, offset)
+// Heartbeat takes a heartbeat received from a provider into account.
+func Heartbeat(hb *db.ProviderHeartbeat) {
+	if prb != nil {
+		prb.heartbeat(hb)
+	}
 }
-func Count() int {
-	if !initialized {
-		update()
+
+// Reload picks up providers made available again without waiting for the
+// next scheduled reload.
+func Reload() {
+	if prb != nil {
+		go prb.reload()
 	}
-	return len(*providers)
 }
 
-func Choose(num int) []db.ProviderInfo {
-	if !initialized {
-		update()
+// snapshot is the set of available providers, replaced as a whole whenever a
+// probe changes it so that readers never see it half updated.
+type snapshot struct {
+	entries []*providerEntry
+	byId    map[string]*providerEntry
+}
+
+var current atomic.Value
+
+func load() *snapshot {
+	if s, ok := current.Load().(*snapshot); ok {
+		return s
 	}
-	pros := *providers
-	l := len(pros)
-	if l < num {
-		panic("provider is not enough")
+	return &snapshot{}
+}
+
+func publish(entries []*providerEntry) {
+	m := make(map[string]*providerEntry, len(entries))
+	for _, pe := range entries {
+		m[pe.info.NodeId] = pe
 	}
-	idx := int(currentProviderIdx % uint64(l))
-	incrementProviderIdx(uint64(num))
-	if idx+num <= l {
-		return pros[idx : idx+num]
-	} else {
-		k := l - idx
-		res := make([]db.ProviderInfo, num)
-		copy(res[0:k], pros[idx:l])
-		copy(res[k:num], pros[0:num-k])
-		return res
+	current.Store(&snapshot{entries: entries, byId: m})
+}
+
+// providerEntry keeps the capacity a provider reported at the last probe
+// together with the bytes handed out to it since then.
+type providerEntry struct {
+	info        db.ProviderInfo
+	total       uint64
+	maxFileSize uint64
+	reserved    uint64
+	domain      string
+}
+
+// remaining returns the capacity still available for a piece of pieceSize,
+// zero if the provider can not take it.
+func (self *providerEntry) remaining(pieceSize uint64) uint64 {
+	if self.maxFileSize < pieceSize {
+		return 0
+	}
+	reserved := atomic.LoadUint64(&self.reserved)
+	if self.total < reserved+pieceSize {
+		return 0
 	}
-	// return (*providers)[0:num]
+	return self.total - reserved
 }
 
-func Get(nodeId string) *db.ProviderInfo {
-	if v, ok := providerMap[nodeId]; ok {
-		return v
-	} else {
-		return db.ProviderFindOne(nodeId)
+// weight is the remaining capacity scaled down by the bandwidth rank.
+func (self *providerEntry) weight(pieceSize uint64) uint64 {
+	return uint64(float64(self.remaining(pieceSize)) * BandwidthRank(&self.info))
+}
+
+// the measured bandwidth may fall this far below the declared one, the tracker
+// measures through its own link
+const misreport_ratio = 0.5
+
+const min_bandwidth_rank = 0.05
+
+// BandwidthRank returns 1 unless the measured bandwidth of the provider is far
+// below the declared one, then the ratio of measured to declared.
+func BandwidthRank(pi *db.ProviderInfo) float64 {
+	ratio := bandwidthRatio(pi)
+	if ratio >= misreport_ratio {
+		return 1
 	}
+	return math.Max(ratio, min_bandwidth_rank)
 }
 
-var running gosync.Mutex = gosync.NewMutex()
+// Misreported tells whether the measured bandwidth of the provider is far below
+// the declared one.
+func Misreported(pi *db.ProviderInfo) bool {
+	return bandwidthRatio(pi) < misreport_ratio
+}
 
-func update() {
-	if running.TryLock() {
-		defer running.UnLock()
-	} else {
-		return
+// bandwidthRatio is the lower ratio of measured to declared bandwidth, 1 when
+// not measured.
+func bandwidthRatio(pi *db.ProviderInfo) float64 {
+	if pi.MeasuredUpBandwidth == 0 && pi.MeasuredDownBandwidth == 0 {
+		return 1
+	}
+	ratio := 1.0
+	if pi.UpBandwidth > 0 {
+		ratio = math.Min(ratio, float64(pi.MeasuredUpBandwidth)/float64(pi.UpBandwidth))
+	}
+	if pi.DownBandwidth > 0 {
+		ratio = math.Min(ratio, float64(pi.MeasuredDownBandwidth)/float64(pi.DownBandwidth))
 	}
-	all := db.ProviderFindAll()
-	providers, providerMap = filter(all)
-	initialized = true
-	fmt.Printf("%s found %d available provider.\n", time.Now().UTC().Format("2006-01-02 15:04 UTC"), len(*providers))
-}
-
-func filter(all []db.ProviderInfo) (*[]db.ProviderInfo, map[string]*db.ProviderInfo) {
-	slice := make([]db.ProviderInfo, 0, len(all))
-	m := make(map[string]*db.ProviderInfo, len(all))
-	for _, pi := range all {
-		start := time.Now().UTC()
-		available := false
-		if check(&pi, &available) || check(&pi, &available) || check(&pi, &available) {
-			m[pi.NodeId] = &pi
-			slice = append(slice, pi)
+	return ratio
+}
+
+func (self *providerEntry) reserve(pieceSize uint64) bool {
+	for {
+		reserved := atomic.LoadUint64(&self.reserved)
+		if self.total < reserved+pieceSize {
+			return false
 		}
-		if !available {
-			db.SaveNaRecord(pi.NodeId, start, time.Now().UTC())
+		if atomic.CompareAndSwapUint64(&self.reserved, reserved, reserved+pieceSize) {
+			return true
 		}
 	}
-	return &slice, m
 }
 
-func check(pi *db.ProviderInfo, available *bool) bool {
-	var hostStr string // prefer
-	if len(pi.Host) > 0 {
-		hostStr = pi.Host
-	} else if len(pi.DynamicDomain) > 0 {
-		hostStr = pi.DynamicDomain
+// Share returns the chance the provider is picked for a piece among the
+// providers available, with its bandwidth rank. available is false if it is not
+// available at the moment.
+func Share(nodeId string) (available bool, share float64, rank float64) {
+	return shareOf(load().entries, nodeId)
+}
+
+func shareOf(pros []*providerEntry, nodeId string) (available bool, share float64, rank float64) {
+	var sum, own uint64
+	for _, pe := range pros {
+		w := pe.weight(0)
+		sum += w
+		if pe.info.NodeId == nodeId {
+			available, own, rank = true, w, BandwidthRank(&pe.info)
+		}
 	}
-	providerAddr := fmt.Sprintf("%s:%d", hostStr, pi.Port)
-	conn, err := grpc.Dial(providerAddr, grpc.WithInsecure())
-	if err != nil {
-		return false
+	if available && sum > 0 {
+		share = float64(own) / float64(sum)
 	}
-	defer conn.Close()
-	psc := provider_pb.NewProviderServiceClient(conn)
+	return
+}
+
+func Count() int {
+	return len(load().entries)
+}
+
+// Selection describes the providers wanted for one piece.
+type Selection struct {
+	Num          int
+	PieceSize    uint64
+	ExcludeNodes map[string]bool // node ids not to choose, e.g. providers already holding pieces of the file
+	ExcludeHosts map[string]bool // servers not to choose, e.g. the host the client itself runs on
+}
+
+func (self *Selection) excluded(pi *db.ProviderInfo) bool {
+	return self.ExcludeNodes[pi.NodeId] || self.ExcludeHosts[pi.Server()]
+}
+
+// Choose picks at most sel.Num distinct providers able to store a piece of
+// sel.PieceSize, weighted by their remaining capacity and bandwidth rank, and reserves the size on
+// each of them until it is probed again. Providers are spread across distinct
+// failure domains, diverse is false if some of them had to share one. The
+// result is a copy the caller is free to modify.
+func Choose(sel *Selection) (res []db.ProviderInfo, diverse bool) {
+	return choose(load().entries, sel)
+}
+
+func choose(pros []*providerEntry, sel *Selection) (res []db.ProviderInfo, diverse bool) {
+	num, pieceSize := sel.Num, sel.PieceSize
+	candidates := make([]*providerEntry, 0, len(pros))
+	for _, pe := range pros {
+		if !sel.excluded(&pe.info) && pe.remaining(pieceSize) > 0 {
+			candidates = append(candidates, pe)
+		}
+	}
+	res = make([]db.ProviderInfo, 0, num)
+	diverse = true
+	usedDomains := make(map[string]bool, num)
+	for len(res) < num && len(candidates) > 0 {
+		// first round only takes one provider of each domain, the following
+		// rounds fill up with the providers left over
+		deferred := make([]*providerEntry, 0, len(candidates))
+		fresh := make([]*providerEntry, 0, len(candidates))
+		for _, pe := range candidates {
+			if usedDomains[pe.domain] {
+				deferred = append(deferred, pe)
+			} else {
+				fresh = append(fresh, pe)
+			}
+		}
+		if len(fresh) == 0 {
+			diverse = false
+			usedDomains = make(map[string]bool, num)
+			continue
+		}
+		var picked []*providerEntry
+		picked, candidates = pickWeighted(fresh, num-len(res), pieceSize, usedDomains)
+		for _, pe := range picked {
+			res = append(res, copyProviderInfo(&pe.info))
+		}
+		candidates = append(candidates, deferred...)
+	}
+	return
+}
+
+// pickWeighted takes up to num providers of distinct domains from candidates,
+// weighted by remaining capacity and bandwidth rank. It returns the providers picked and the
+// candidates neither picked nor sharing a domain with a picked one.
+func pickWeighted(candidates []*providerEntry, num int, pieceSize uint64, usedDomains map[string]bool) (picked []*providerEntry, left []*providerEntry) {
+	weights := make([]uint64, 0, len(candidates))
+	var sum uint64
+	for _, pe := range candidates {
+		w := pe.weight(pieceSize)
+		weights = append(weights, w)
+		sum += w
+	}
+	picked = make([]*providerEntry, 0, num)
+	left = make([]*providerEntry, 0, len(candidates))
+	for len(picked) < num && sum > 0 {
+		r := uint64(rand.Int63n(int64(sum)))
+		i := 0
+		for ; r >= weights[i]; i++ {
+			r -= weights[i]
+		}
+		pe := candidates[i]
+		sum -= weights[i]
+		weights[i] = 0
+		if usedDomains[pe.domain] {
+			left = append(left, pe)
+			continue
+		}
+		if pe.reserve(pieceSize) {
+			usedDomains[pe.domain] = true
+			picked = append(picked, pe)
+		}
+	}
+	for i, pe := range candidates {
+		if weights[i] > 0 {
+			left = append(left, pe)
+		}
+	}
+	return
+}
+
+func Get(nodeId string) *db.ProviderInfo {
+	if v, ok := load().byId[nodeId]; ok {
+		info := copyProviderInfo(&v.info)
+		return &info
+	} else {
+		return db.ProviderFindOne(nodeId)
+	}
+}
+
+func copyProviderInfo(pi *db.ProviderInfo) db.ProviderInfo {
+	c := *pi
+	c.NodeIdBytes = append([]byte(nil), pi.NodeIdBytes...)
+	c.PublicKey = append([]byte(nil), pi.PublicKey...)
+	c.EncryptKey = append([]byte(nil), pi.EncryptKey...)
+	c.StorageVolume = append([]uint64(nil), pi.StorageVolume...)
+	return c
+}
+
+func check(psc provider_pb.ProviderServiceClient, pe *providerEntry, available *bool) bool {
+	pi := &pe.info
 	total, maxFileSize, err := checkAvailable(psc, pi.PublicKey)
 	if err != nil {
 		st, ok := status.FromError(err)
 		if !ok || st.Code() != codes.DeadlineExceeded {
-			fmt.Printf("checkAvailable of provider [%s:%d] failed,  error: %v\n", hostStr, pi.Port, err)
+			fmt.Printf("checkAvailable of provider [%s:%d] failed,  error: %v\n", pi.Server(), pi.Port, err)
 		}
 		return false
 	}
 	*available = true
 	if total > giga && maxFileSize > giga {
+		pe.total, pe.maxFileSize = total, maxFileSize
 		return true
 	} else {
-		fmt.Printf("checkAvailable of provider [%s:%d] reply total: %d, maxFileSize: %d\n", hostStr, pi.Port, total, maxFileSize)
+		fmt.Printf("checkAvailable of provider [%s:%d] reply total: %d, maxFileSize: %d\n", pi.Server(), pi.Port, total, maxFileSize)
 		return false
 	}
 }
@@ -5,7 +5,10 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"io/ioutil"
 	"nebula-tracker/db"
+	"net"
+	"os"
 	"strconv"
 	"testing"
 
@@ -13,48 +16,161 @@ import (
 )
 
 func TestChoose(t *testing.T) {
-	initialized = true
-	currentProviderIdx = 5
-	pros := mockProviderInfoSlice(10)
-	providers = &pros
-	res := Choose(4)
+	pros := mockProviderEntrySlice(10, 100*giga, 4*giga)
+	publish(pros)
+	res, _ := Choose(&Selection{Num: 4, PieceSize: giga})
 	if len(res) != 4 {
-		t.Error("failed")
+		t.Errorf("failed: %d", len(res))
 	}
-	if res[3].Host != "127.0.0.8" {
-		t.Error("failed")
+	seen := make(map[string]bool, len(res))
+	for _, pi := range res {
+		if seen[pi.NodeId] {
+			t.Errorf("failed, provider %s chosen twice", pi.Host)
+		}
+		seen[pi.NodeId] = true
 	}
-	if currentProviderIdx != 9 {
-		t.Errorf("failed: %d", currentProviderIdx)
+	var reserved uint64
+	for _, pe := range pros {
+		reserved += pe.reserved
 	}
-	res = Choose(5)
-	if len(res) != 5 {
-		t.Error("failed")
+	if reserved != 4*giga {
+		t.Errorf("failed: %d", reserved)
 	}
-	if res[0].Host != "127.0.0.9" {
-		t.Errorf("failed: %s", res[0].Host)
+	res, _ = Choose(&Selection{Num: 20, PieceSize: giga})
+	if len(res) != 10 {
+		t.Errorf("failed: %d", len(res))
 	}
-	if res[4].Host != "127.0.0.3" {
-		t.Error("failed")
+}
+
+func TestChooseMaxFileSize(t *testing.T) {
+	pros := mockProviderEntrySlice(6, 100*giga, 2*giga)
+	pros[1].maxFileSize = 8 * giga
+	pros[4].maxFileSize = 8 * giga
+	res, _ := choose(pros, &Selection{Num: 5, PieceSize: 4 * giga})
+	if len(res) != 2 {
+		t.Errorf("failed: %d", len(res))
+	}
+	for _, pi := range res {
+		if pi.Host != "127.0.0.1" && pi.Host != "127.0.0.4" {
+			t.Errorf("failed: %s", pi.Host)
+		}
+	}
+}
+
+func TestChooseReserve(t *testing.T) {
+	pros := mockProviderEntrySlice(3, 10*giga, 4*giga)
+	for i := 0; i < 7; i++ {
+		if res, _ := choose(pros, &Selection{Num: 3, PieceSize: 4 * giga}); len(res) != 3 && i < 2 {
+			t.Errorf("failed, round %d: %d", i, len(res))
+		} else if len(res) != 0 && i >= 2 {
+			t.Errorf("failed, round %d: %d", i, len(res))
+		}
+	}
+	if pros[0].remaining(giga) != 2*giga {
+		t.Errorf("failed: %d", pros[0].remaining(giga))
+	}
+}
+
+func TestChooseWeighted(t *testing.T) {
+	pros := mockProviderEntrySlice(2, 10*giga, giga)
+	pros[1].total = 90 * giga
+	counts := make(map[string]int, 2)
+	for i := 0; i < 2000; i++ {
+		pros[0].reserved, pros[1].reserved = 0, 0
+		res, _ := choose(pros, &Selection{Num: 1, PieceSize: 1})
+		counts[res[0].Host]++
+	}
+	if counts["127.0.0.1"] < 1500 {
+		t.Errorf("failed: %v", counts)
+	}
+}
+
+func TestChooseDiverse(t *testing.T) {
+	pros := mockProviderEntrySlice(9, 100*giga, 4*giga)
+	for i, pe := range pros {
+		pe.domain = "test:" + strconv.Itoa(i%3)
+	}
+	for i := 0; i < 20; i++ {
+		res, diverse := choose(pros, &Selection{Num: 3, PieceSize: 1})
+		if len(res) != 3 || !diverse {
+			t.Errorf("failed: %d %t", len(res), diverse)
+		}
+		domains := make(map[string]bool, 3)
+		for _, pi := range res {
+			for _, pe := range pros {
+				if pe.info.NodeId == pi.NodeId {
+					domains[pe.domain] = true
+				}
+			}
+		}
+		if len(domains) != 3 {
+			t.Errorf("failed: %v", domains)
+		}
+	}
+	res, diverse := choose(pros, &Selection{Num: 5, PieceSize: 1})
+	if len(res) != 5 || diverse {
+		t.Errorf("failed: %d %t", len(res), diverse)
+	}
+}
+
+func TestChooseExclude(t *testing.T) {
+	pros := mockProviderEntrySlice(6, 100*giga, 4*giga)
+	sel := &Selection{Num: 6, PieceSize: giga,
+		ExcludeNodes: map[string]bool{pros[0].info.NodeId: true},
+		ExcludeHosts: map[string]bool{"127.0.0.3": true}}
+	res, _ := choose(pros, sel)
+	if len(res) != 4 {
+		t.Errorf("failed: %d", len(res))
 	}
-	res = Choose(7)
-	if len(res) != 7 {
-		t.Error("failed")
+	for _, pi := range res {
+		if pi.NodeId == pros[0].info.NodeId || pi.Host == "127.0.0.3" {
+			t.Errorf("failed, excluded provider %s chosen", pi.Host)
+		}
 	}
-	if res[0].Host != "127.0.0.4" {
-		t.Error("failed")
+	res[0].PublicKey[0]++
+	res[0].StorageVolume[0]++
+	for _, pe := range pros {
+		if pe.info.NodeId == res[0].NodeId && (pe.info.PublicKey[0] == res[0].PublicKey[0] || pe.info.StorageVolume[0] == res[0].StorageVolume[0]) {
+			t.Error("failed, result aliases snapshot")
+		}
 	}
-	if res[4].Host != "127.0.0.8" {
-		t.Error("failed")
+}
+
+func TestDomainDb(t *testing.T) {
+	f, err := ioutil.TempFile("", "domain-db")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if res[5].Host != "127.0.0.9" {
-		t.Error("failed")
+	defer os.Remove(f.Name())
+	f.WriteString("network,autonomous_system_number,autonomous_system_organization\n1.0.0.0/8,100,Test A\n1.2.0.0/16,200,Test B\n2001:db8::/32,300,Test C\n")
+	f.Close()
+	ddb, err := loadDomainDb(f.Name())
+	if err != nil {
+		t.Fatal(err)
 	}
-	if res[6].Host != "127.0.0.0" {
-		t.Error("failed")
+	defer func() { domains = nil }()
+	domains = ddb
+	cases := map[string]string{"1.1.1.1": "db:100",
+		"1.2.3.4":     "db:200",
+		"2001:db8::1": "db:300",
+		"8.8.8.8":     "ip4:8.8.8.0",
+		"2001:db9::1": "ip6:2001:db9::"}
+	for ip, expected := range cases {
+		if d := ipDomain(net.ParseIP(ip)); d != expected {
+			t.Errorf("failed, %s: %s", ip, d)
+		}
 	}
 }
 
+func mockProviderEntrySlice(count int, total uint64, maxFileSize uint64) []*providerEntry {
+	infos := mockProviderInfoSlice(count)
+	slice := make([]*providerEntry, 0, count)
+	for i, pi := range infos {
+		slice = append(slice, &providerEntry{info: pi, total: total, maxFileSize: maxFileSize, domain: "test:" + strconv.Itoa(i)})
+	}
+	return slice
+}
+
 func mockProviderInfoSlice(count int) []db.ProviderInfo {
 	slice := make([]db.ProviderInfo, 0, count)
 	for i := 0; i < count; i++ {
@@ -81,3 +197,33 @@ func mockProviderInfoSlice(count int) []db.ProviderInfo {
 	}
 	return slice
 }
+
+func TestBandwidthRank(t *testing.T) {
+	pi := &db.ProviderInfo{UpBandwidth: 2000000, DownBandwidth: 10000000}
+	if r := BandwidthRank(pi); r != 1 {
+		t.Errorf("not tested provider rank: %f", r)
+	}
+	pi.MeasuredUpBandwidth, pi.MeasuredDownBandwidth = 1500000, 6000000
+	if r := BandwidthRank(pi); r != 1 || Misreported(pi) {
+		t.Errorf("honest provider rank: %f", r)
+	}
+	pi.MeasuredDownBandwidth = 2000000
+	if r := BandwidthRank(pi); r != 0.2 || !Misreported(pi) {
+		t.Errorf("misreporting provider rank: %f", r)
+	}
+	pi.MeasuredUpBandwidth = 1000
+	if r := BandwidthRank(pi); r != min_bandwidth_rank {
+		t.Errorf("min rank: %f", r)
+	}
+}
+
+func TestShare(t *testing.T) {
+	pros := mockProviderEntrySlice(4, 4*giga, 100*1024*1024)
+	available, s, rank := shareOf(pros, pros[1].info.NodeId)
+	if !available || s != 0.25 || rank != 1 {
+		t.Errorf("failed: %t %f %f", available, s, rank)
+	}
+	if available, s, _ = shareOf(pros, "not-exists"); available || s != 0 {
+		t.Errorf("failed: %t %f", available, s)
+	}
+}
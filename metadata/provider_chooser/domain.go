@@ -0,0 +1,128 @@
+package provider_chooser
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"nebula-tracker/db"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// domainDb maps ip networks to a failure domain key, loaded from a GeoIP or
+// ASN database exported as csv, e.g. GeoLite2-ASN-Blocks-IPv4.csv:
+//
+//	network,autonomous_system_number,autonomous_system_organization
+//	1.0.0.0/24,13335,Cloudflare Inc
+//
+// the first column is the network, the second one is used as the key.
+type domainDb struct {
+	prefixLens []int
+	networks   map[string]string
+}
+
+var domains *domainDb
+
+func loadDomainDb(filename string) (*domainDb, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ddb := &domainDb{networks: make(map[string]string, 1024)}
+	lens := make(map[int]bool, 32)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		arr := strings.SplitN(line, ",", 3)
+		_, ipNet, err := net.ParseCIDR(arr[0])
+		if err != nil {
+			if lineNo == 1 { // header
+				continue
+			}
+			return nil, fmt.Errorf("%s line %d: %s", filename, lineNo, err)
+		}
+		if len(arr) < 2 || len(strings.TrimSpace(arr[1])) == 0 {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		ddb.networks[ipNet.String()] = strings.TrimSpace(arr[1])
+		lens[ones] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for l := 128; l >= 0; l-- {
+		if lens[l] {
+			ddb.prefixLens = append(ddb.prefixLens, l)
+		}
+	}
+	return ddb, nil
+}
+
+// lookup returns the key of the most specific network containing ip.
+func (self *domainDb) lookup(ip net.IP) (string, bool) {
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	for _, l := range self.prefixLens {
+		if l > bits {
+			continue
+		}
+		ipNet := net.IPNet{IP: ip.Mask(net.CIDRMask(l, bits)), Mask: net.CIDRMask(l, bits)}
+		if key, ok := self.networks[ipNet.String()]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// failureDomain derives the key of the failure domain a provider belongs to,
+// providers sharing the key are assumed to fail together.
+func failureDomain(pi *db.ProviderInfo) string {
+	server := strings.ToLower(pi.Server())
+	ip := net.ParseIP(server)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, server)
+		if err != nil || len(addrs) == 0 {
+			log.Warnf("resolve provider [%s] host %s failed: %v", pi.NodeId, server, err)
+			return "host:" + server
+		}
+		ip = addrs[0].IP
+	}
+	return ipDomain(ip)
+}
+
+func ipDomain(ip net.IP) string {
+	if domains != nil {
+		if key, ok := domains.lookup(ip); ok {
+			return "db:" + key
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return "ip4:" + ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return "ip6:" + ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Asn returns the key the failure domain db maps ip to, the autonomous system
+// number with an ASN db, empty if it is not found or no db is loaded.
+func Asn(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || domains == nil {
+		return ""
+	}
+	key, _ := domains.lookup(parsed)
+	return key
+}
@@ -0,0 +1,338 @@
+package provider_chooser
+
+import (
+	"fmt"
+	"math/rand"
+	"nebula-tracker/db"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	provider_pb "github.com/samoslab/nebula/provider/pb"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// prober checks every provider on its own jittered schedule with a bounded
+// pool of workers, keeping one grpc connection per provider across rounds.
+type prober struct {
+	workers          int
+	interval         time.Duration
+	jitter           time.Duration
+	heartbeatTimeout time.Duration
+	mutex            sync.Mutex
+	targets          map[string]*probeTarget
+	heartbeats       map[string]*db.ProviderHeartbeat
+	queue            chan *probeTarget
+	dirty            int32
+	stop             chan struct{}
+	wg               sync.WaitGroup
+}
+
+type probeTarget struct {
+	info    db.ProviderInfo
+	addr    string
+	conn    *grpc.ClientConn
+	entry   *providerEntry // nil while not available
+	next    time.Time
+	probing bool
+	removed bool
+}
+
+func newProber(workers int, interval time.Duration, jitter time.Duration, heartbeatTimeout time.Duration) *prober {
+	if workers < 1 {
+		workers = 1
+	}
+	return &prober{workers: workers,
+		interval:         interval,
+		jitter:           jitter,
+		heartbeatTimeout: heartbeatTimeout,
+		targets:          make(map[string]*probeTarget, 256),
+		heartbeats:       make(map[string]*db.ProviderHeartbeat, 256),
+		queue:            make(chan *probeTarget, workers),
+		stop:             make(chan struct{})}
+}
+
+func (self *prober) start() {
+	self.wg.Add(self.workers + 1)
+	for i := 0; i < self.workers; i++ {
+		go self.work()
+	}
+	go self.run()
+}
+
+func (self *prober) shutdown() {
+	close(self.stop)
+	self.wg.Wait()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, t := range self.targets {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+	}
+}
+
+func (self *prober) run() {
+	defer self.wg.Done()
+	self.reload()
+	reloadAt := time.Now().Add(self.interval)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case now := <-ticker.C:
+			if now.After(reloadAt) {
+				self.reload()
+				reloadAt = now.Add(self.interval)
+			}
+			self.dispatch(now)
+			if atomic.CompareAndSwapInt32(&self.dirty, 1, 0) {
+				self.publish()
+			}
+		}
+	}
+}
+
+func (self *prober) reload() {
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("reload providers Panic Error: %s, detail: %s", er, string(debug.Stack()))
+		}
+	}()
+	self.sync(db.ProviderFindAll(), time.Now())
+	hbs := db.ProviderHeartbeatsSince(time.Now().Add(-self.heartbeatTimeout))
+	self.mutex.Lock()
+	self.heartbeats = hbs
+	self.mutex.Unlock()
+	fmt.Printf("%s found %d available provider.\n", time.Now().UTC().Format("2006-01-02 15:04 UTC"), Count())
+}
+
+// sync adds the providers not probed yet, due immediately, and drops the ones
+// no longer in all.
+func (self *prober) sync(all []db.ProviderInfo, now time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	seen := make(map[string]bool, len(all))
+	for _, pi := range all {
+		seen[pi.NodeId] = true
+		if t, ok := self.targets[pi.NodeId]; ok {
+			if !t.probing {
+				t.info = pi
+			}
+			continue
+		}
+		self.targets[pi.NodeId] = &probeTarget{info: pi, next: now}
+	}
+	for nodeId, t := range self.targets {
+		if !seen[nodeId] {
+			self.removeLocked(nodeId, t)
+		}
+	}
+}
+
+// exclude drops a provider and publishes the snapshot without it right away.
+func (self *prober) exclude(nodeId string) {
+	self.mutex.Lock()
+	t, ok := self.targets[nodeId]
+	if ok {
+		self.removeLocked(nodeId, t)
+	}
+	self.mutex.Unlock()
+	if ok {
+		atomic.StoreInt32(&self.dirty, 0)
+		self.publish()
+	}
+}
+
+func (self *prober) removeLocked(nodeId string, t *probeTarget) {
+	delete(self.targets, nodeId)
+	t.removed = true
+	if t.entry != nil {
+		atomic.StoreInt32(&self.dirty, 1)
+	}
+	if !t.probing && t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// heartbeat records a heartbeat received by this tracker, a provider not
+// available at the moment is probed again right away.
+func (self *prober) heartbeat(hb *db.ProviderHeartbeat) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.heartbeats[hb.NodeId] = hb
+	if t, ok := self.targets[hb.NodeId]; ok && t.entry == nil && !t.probing {
+		t.next = time.Now()
+	}
+}
+
+func (self *prober) freshHeartbeat(nodeId string) *db.ProviderHeartbeat {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if hb, ok := self.heartbeats[nodeId]; ok && time.Since(hb.LastModified) < self.heartbeatTimeout {
+		return hb
+	}
+	return nil
+}
+
+// dispatch queues the targets due before now as long as a worker is free.
+func (self *prober) dispatch(now time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, t := range self.targets {
+		if t.probing || t.next.After(now) {
+			continue
+		}
+		select {
+		case self.queue <- t:
+			t.probing = true
+		default:
+			return
+		}
+	}
+}
+
+func (self *prober) publish() {
+	self.mutex.Lock()
+	entries := make([]*providerEntry, 0, len(self.targets))
+	for _, t := range self.targets {
+		if t.entry != nil {
+			entries = append(entries, t.entry)
+		}
+	}
+	self.mutex.Unlock()
+	publish(entries)
+}
+
+func (self *prober) work() {
+	defer self.wg.Done()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case t := <-self.queue:
+			self.probe(t)
+		}
+	}
+}
+
+// probe decides whether a provider is available, it has to answer
+// CheckAvailable at the host and port it registered, or, while its heartbeat is
+// fresh, at one of the endpoints the heartbeat reported, which clients are then
+// given instead. A heartbeat alone does not make it available, as the tracker
+// can not tell whether clients reach it.
+func (self *prober) probe(t *probeTarget) {
+	var entry *providerEntry
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("probe provider [%s] Panic Error: %s, detail: %s", t.info.NodeId, er, string(debug.Stack()))
+		}
+		self.done(t, entry)
+	}()
+	pi := t.info
+	start := time.Now().UTC()
+	available := false
+	pe := &providerEntry{info: pi}
+	if psc := self.client(t); psc != nil && (check(psc, pe, &available) || check(psc, pe, &available) || check(psc, pe, &available)) {
+		entry = pe
+	} else if hb := self.freshHeartbeat(pi.NodeId); !available && hb != nil {
+		entry = probeEndpoints(pi, hb.Endpoints, &available)
+		if !available {
+			log.Warnf("provider [%s] sends heartbeats but is not reachable at %s:%d or its %d endpoints", pi.NodeId, pi.Server(), pi.Port, len(hb.Endpoints))
+		}
+	}
+	if entry != nil {
+		entry.domain = failureDomain(&entry.info)
+	}
+	if !available {
+		db.SaveNaRecord(pi.NodeId, start, time.Now().UTC())
+	}
+	db.ProviderRecordProbe(pi.NodeId, available, start)
+}
+
+// probeEndpoints checks the endpoints of a heartbeat one after another, the
+// entry returned carries the first endpoint answering as the provider address.
+func probeEndpoints(pi db.ProviderInfo, endpoints []string, available *bool) *providerEntry {
+	for _, ep := range endpoints {
+		info, ok := endpointInfo(pi, ep)
+		if !ok {
+			continue
+		}
+		conn, err := grpc.Dial(ep, grpc.WithInsecure())
+		if err != nil {
+			continue
+		}
+		pe := &providerEntry{info: info}
+		ok = check(provider_pb.NewProviderServiceClient(conn), pe, available)
+		conn.Close()
+		if ok {
+			return pe
+		}
+		if *available {
+			return nil
+		}
+	}
+	return nil
+}
+
+// endpointInfo returns the provider info with the address replaced by the
+// host:port endpoint.
+func endpointInfo(pi db.ProviderInfo, ep string) (db.ProviderInfo, bool) {
+	host, portStr, err := net.SplitHostPort(ep)
+	if err != nil || len(host) == 0 {
+		return pi, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return pi, false
+	}
+	pi.Host, pi.DynamicDomain, pi.Port = host, "", uint32(port)
+	return pi, true
+}
+
+// client returns a client on the connection kept for the target, nil if it
+// can not be dialed.
+func (self *prober) client(t *probeTarget) provider_pb.ProviderServiceClient {
+	pi := &t.info
+	addr := fmt.Sprintf("%s:%d", pi.Server(), pi.Port)
+	if t.conn == nil || t.addr != addr {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			log.Warnf("dial provider [%s] %s failed: %s", pi.NodeId, addr, err)
+			t.conn, t.addr = nil, ""
+			return nil
+		}
+		t.conn, t.addr = conn, addr
+	}
+	return provider_pb.NewProviderServiceClient(t.conn)
+}
+
+// done records the result of a probe and schedules the next one.
+func (self *prober) done(t *probeTarget, entry *providerEntry) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	t.probing = false
+	if t.removed {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+		return
+	}
+	if t.entry != nil || entry != nil {
+		t.entry = entry
+		atomic.StoreInt32(&self.dirty, 1)
+	}
+	t.next = time.Now().Add(self.interval)
+	if self.jitter > 0 {
+		t.next = t.next.Add(time.Duration(rand.Int63n(int64(self.jitter))))
+	}
+}
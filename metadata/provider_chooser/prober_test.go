@@ -0,0 +1,102 @@
+package provider_chooser
+
+import (
+	"nebula-tracker/db"
+	"testing"
+	"time"
+)
+
+func TestProberSync(t *testing.T) {
+	p := newProber(2, time.Minute, 0, time.Minute)
+	infos := mockProviderInfoSlice(3)
+	now := time.Now()
+	p.sync(infos, now)
+	if len(p.targets) != 3 {
+		t.Errorf("failed: %d", len(p.targets))
+	}
+	p.targets[infos[0].NodeId].entry = &providerEntry{info: infos[0]}
+	p.targets[infos[1].NodeId].probing = true
+	p.sync(infos[2:], now)
+	if len(p.targets) != 1 {
+		t.Errorf("failed: %d", len(p.targets))
+	}
+	if p.dirty != 1 {
+		t.Errorf("failed: %d", p.dirty)
+	}
+}
+
+func TestProberDispatch(t *testing.T) {
+	p := newProber(2, time.Minute, 0, time.Minute)
+	infos := mockProviderInfoSlice(3)
+	now := time.Now()
+	p.sync(infos, now)
+	p.dispatch(now)
+	if len(p.queue) != 2 {
+		t.Errorf("failed: %d", len(p.queue))
+	}
+	target := <-p.queue
+	p.done(target, &providerEntry{info: target.info})
+	if target.probing || !target.next.After(now) {
+		t.Errorf("failed: %t %s", target.probing, target.next)
+	}
+	p.dispatch(now)
+	if len(p.queue) != 2 {
+		t.Errorf("failed: %d", len(p.queue))
+	}
+	p.publish()
+	if Count() != 1 || Get(target.info.NodeId).NodeId != target.info.NodeId {
+		t.Errorf("failed: %d", Count())
+	}
+}
+
+func TestProberExclude(t *testing.T) {
+	p := newProber(2, time.Minute, 0, time.Minute)
+	infos := mockProviderInfoSlice(2)
+	p.sync(infos, time.Now())
+	for _, target := range p.targets {
+		target.entry = &providerEntry{info: target.info}
+	}
+	p.publish()
+	p.exclude(infos[0].NodeId)
+	if Count() != 1 || len(p.targets) != 1 {
+		t.Errorf("failed: %d", Count())
+	}
+	if _, ok := load().byId[infos[0].NodeId]; ok {
+		t.Error("failed, excluded provider still available")
+	}
+}
+
+func TestProberHeartbeat(t *testing.T) {
+	p := newProber(2, time.Minute, 0, time.Minute)
+	infos := mockProviderInfoSlice(1)
+	p.sync(infos, time.Now())
+	target := p.targets[infos[0].NodeId]
+	target.next = time.Now().Add(time.Hour)
+	if p.freshHeartbeat(infos[0].NodeId) != nil {
+		t.Error("failed")
+	}
+	p.heartbeat(&db.ProviderHeartbeat{NodeId: infos[0].NodeId, LastModified: time.Now().Add(-2 * time.Minute)})
+	if p.freshHeartbeat(infos[0].NodeId) != nil {
+		t.Error("failed, stale heartbeat is fresh")
+	}
+	if target.next.After(time.Now()) {
+		t.Error("failed, unavailable provider not probed again")
+	}
+	p.heartbeat(&db.ProviderHeartbeat{NodeId: infos[0].NodeId, LastModified: time.Now()})
+	if p.freshHeartbeat(infos[0].NodeId) == nil {
+		t.Error("failed")
+	}
+}
+
+func TestEndpointInfo(t *testing.T) {
+	pi := db.ProviderInfo{NodeId: "a", Host: "10.0.0.1", DynamicDomain: "a.example.com", Port: 6666}
+	info, ok := endpointInfo(pi, "1.2.3.4:7777")
+	if !ok || info.Server() != "1.2.3.4" || info.Port != 7777 || info.NodeId != "a" || pi.Host != "10.0.0.1" {
+		t.Errorf("failed: %t %+v", ok, info)
+	}
+	for _, ep := range []string{"1.2.3.4", ":7777", "1.2.3.4:0", "1.2.3.4:x"} {
+		if _, ok := endpointInfo(pi, ep); ok {
+			t.Errorf("failed: %s", ep)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package provider_client talks to providers on behalf of the tracker itself,
+// the auth of each request is generated with the public key of the provider
+// the same way it is handed out to clients.
+package provider_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"nebula-tracker/db"
+	"time"
+
+	provider_pb "github.com/samoslab/nebula/provider/pb"
+	util_hash "github.com/samoslab/nebula/util/hash"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+)
+
+const ticket_prefix = "tracker-"
+
+func dial(pi *db.ProviderInfo) (*grpc.ClientConn, error) {
+	return grpc.Dial(fmt.Sprintf("%s:%d", pi.Server(), pi.Port), grpc.WithInsecure())
+}
+
+func ticket() string {
+	return ticket_prefix + uuid.NewV4().String()
+}
+
+// Copy streams a block from one provider to another.
+func Copy(from *db.ProviderInfo, to *db.ProviderInfo, fileKey []byte, fileSize uint64, blockKey []byte, blockSize uint64, timeout time.Duration) error {
+	fromConn, err := dial(from)
+	if err != nil {
+		return err
+	}
+	defer fromConn.Close()
+	toConn, err := dial(to)
+	if err != nil {
+		return err
+	}
+	defer toConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ts := uint64(time.Now().Unix())
+	rreq := &provider_pb.RetrieveReq{Timestamp: ts,
+		Ticket:    ticket(),
+		FileKey:   fileKey,
+		FileSize:  fileSize,
+		BlockKey:  blockKey,
+		BlockSize: blockSize}
+	rreq.GenAuth(from.PublicKey)
+	rstream, err := provider_pb.NewProviderServiceClient(fromConn).Retrieve(ctx, rreq)
+	if err != nil {
+		return err
+	}
+	sstream, err := provider_pb.NewProviderServiceClient(toConn).Store(ctx)
+	if err != nil {
+		return err
+	}
+	sreq := &provider_pb.StoreReq{Timestamp: ts,
+		Ticket:    ticket(),
+		FileKey:   fileKey,
+		FileSize:  fileSize,
+		BlockKey:  blockKey,
+		BlockSize: blockSize}
+	sreq.GenAuth(to.PublicKey)
+	var copied uint64
+	for {
+		resp, err := rstream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sreq.Data = resp.Data
+		if err = sstream.Send(sreq); err != nil {
+			return err
+		}
+		copied += uint64(len(resp.Data))
+	}
+	if copied != blockSize {
+		return fmt.Errorf("retrieved %d bytes, expected %d", copied, blockSize)
+	}
+	resp, err := sstream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return errors.New("store not success")
+	}
+	return nil
+}
+
+// Remove deletes a block from a provider.
+func Remove(pi *db.ProviderInfo, blockKey []byte, blockSize uint64, timeout time.Duration) error {
+	conn, err := dial(pi)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req := &provider_pb.RemoveReq{Timestamp: uint64(time.Now().Unix()), Key: blockKey, Size: blockSize}
+	req.GenAuth(pi.PublicKey)
+	resp, err := provider_pb.NewProviderServiceClient(conn).Remove(ctx, req)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return errors.New("remove not success")
+	}
+	return nil
+}
+
+const speed_test_chunk_size = 64 * 1024
+
+// the payload is removed with its own timeout, the one of the test may be over
+const speed_test_remove_timeout = 10 * time.Second
+
+// SpeedTest stores payload on a provider, retrieves and removes it, returning
+// the bandwidth measured in bits per second, down is the direction towards the
+// provider.
+func SpeedTest(pi *db.ProviderInfo, payload []byte, timeout time.Duration) (up uint64, down uint64, err error) {
+	conn, err := dial(pi)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	psc := provider_pb.NewProviderServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	key := util_hash.Sha1(payload)
+	size := uint64(len(payload))
+	ts := uint64(time.Now().Unix())
+
+	start := time.Now()
+	sstream, err := psc.Store(ctx)
+	if err != nil {
+		return
+	}
+	sreq := &provider_pb.StoreReq{Timestamp: ts, Ticket: ticket(), FileKey: key, FileSize: size, BlockKey: key, BlockSize: size}
+	sreq.GenAuth(pi.PublicKey)
+	for i := 0; i < len(payload); i += speed_test_chunk_size {
+		end := i + speed_test_chunk_size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		sreq.Data = payload[i:end]
+		if err = sstream.Send(sreq); err != nil {
+			return
+		}
+	}
+	sresp, err := sstream.CloseAndRecv()
+	if err != nil {
+		return
+	}
+	if !sresp.Success {
+		err = errors.New("store not success")
+		return
+	}
+	down = bitsPerSecond(size, time.Since(start))
+	defer func() {
+		rctx, rcancel := context.WithTimeout(context.Background(), speed_test_remove_timeout)
+		defer rcancel()
+		req := &provider_pb.RemoveReq{Timestamp: uint64(time.Now().Unix()), Key: key, Size: size}
+		req.GenAuth(pi.PublicKey)
+		psc.Remove(rctx, req)
+	}()
+
+	start = time.Now()
+	rreq := &provider_pb.RetrieveReq{Timestamp: ts, Ticket: ticket(), FileKey: key, FileSize: size, BlockKey: key, BlockSize: size}
+	rreq.GenAuth(pi.PublicKey)
+	rstream, err := psc.Retrieve(ctx, rreq)
+	if err != nil {
+		return
+	}
+	var retrieved uint64
+	for {
+		resp, er := rstream.Recv()
+		if er == io.EOF {
+			break
+		}
+		if er != nil {
+			err = er
+			return
+		}
+		retrieved += uint64(len(resp.Data))
+	}
+	if retrieved != size {
+		err = fmt.Errorf("retrieved %d bytes, expected %d", retrieved, size)
+		return
+	}
+	up = bitsPerSecond(size, time.Since(start))
+	return
+}
+
+func bitsPerSecond(bytes uint64, elapsed time.Duration) uint64 {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	return uint64(float64(bytes*8) / elapsed.Seconds())
+}
@@ -0,0 +1,15 @@
+package provider_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBitsPerSecond(t *testing.T) {
+	if bps := bitsPerSecond(1000000, 2*time.Second); bps != 4000000 {
+		t.Errorf("failed: %d", bps)
+	}
+	if bps := bitsPerSecond(1000, 0); bps != 8000000 {
+		t.Errorf("failed: %d", bps)
+	}
+}
@@ -0,0 +1,150 @@
+// Package repair moves the blocks stored on draining and exiting providers, and
+// the ones over the storage volume of providers that shrank it, to other
+// providers.
+package repair
+
+import (
+	"encoding/base64"
+	"errors"
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	chooser "nebula-tracker/metadata/provider_chooser"
+	client "nebula-tracker/metadata/provider_client"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const transfer_timeout = 10 * time.Minute
+
+var runner *cronjob.Runner
+
+func StartAutoRepair() {
+	conf := config.GetTrackerConfig().Repair
+	runner = cronjob.Start(conf.CronSpec, "repair", func() {
+		drain(conf.BatchSize, conf.MaxFailures)
+		shrink(conf.BatchSize, conf.MaxFailures)
+	})
+}
+
+func StopAutoRepair() {
+	runner.Stop()
+}
+
+func drain(batchSize int, maxFailures int) {
+	for _, nodeId := range db.ProviderFindByStatus(db.ProviderStatusDraining) {
+		blocks := db.BlockFindByProvider(nodeId, maxFailures, batchSize)
+		if len(blocks) == 0 {
+			if !stuck(nodeId, maxFailures) {
+				log.Infof("provider [%s] drained", nodeId)
+			}
+			continue
+		}
+		migrateAll(nodeId, blocks, maxFailures)
+	}
+	for _, nodeId := range db.ProviderFindByStatus(db.ProviderStatusExiting) {
+		blocks := db.BlockFindByProvider(nodeId, maxFailures, batchSize)
+		if len(blocks) == 0 {
+			if !stuck(nodeId, maxFailures) {
+				db.ProviderFinishExit(nodeId)
+				log.Infof("provider [%s] exited", nodeId)
+			}
+			continue
+		}
+		migrateAll(nodeId, blocks, maxFailures)
+	}
+}
+
+// stuck tells whether blocks are left on the provider that are skipped as they
+// failed to be migrated too many times, and alerts about them.
+func stuck(nodeId string, maxFailures int) bool {
+	count := db.BlockStuckOnProvider(nodeId, maxFailures)
+	if count > 0 {
+		log.Errorf("%d blocks on provider [%s] failed to be migrated %d times and are skipped, they need an operator", count, nodeId, maxFailures)
+	}
+	return count > 0
+}
+
+func migrateAll(nodeId string, blocks []*db.BlockLocation, maxFailures int) {
+	from := db.ProviderFindOne(nodeId)
+	migrated := 0
+	for _, bl := range blocks {
+		if err := migrate(from, bl); err != nil {
+			failed(bl, err, maxFailures)
+		} else {
+			migrated++
+		}
+	}
+	log.Infof("migrated %d of %d blocks from provider [%s]", migrated, len(blocks), nodeId)
+}
+
+// failed counts the failed attempt, the block is skipped from now on once it
+// failed maxFailures times.
+func failed(bl *db.BlockLocation, err error, maxFailures int) {
+	failures := db.BlockMigrateFailed(bl)
+	if failures >= maxFailures {
+		log.Errorf("migrate block %s of file %s from provider [%s] failed %d times, skipped: %s", bl.Hash, bl.FileHash, bl.ProviderId, failures, err)
+		return
+	}
+	log.Warnf("migrate block %s of file %s from provider [%s] failed: %s", bl.Hash, bl.FileHash, bl.ProviderId, err)
+}
+
+// shrink migrates blocks off the providers using more than their declared
+// storage volume until the excess is moved.
+func shrink(batchSize int, maxFailures int) {
+	for _, su := range db.ProviderStorageUsages() {
+		if su.Used <= su.Declared {
+			continue
+		}
+		excess := su.Used - su.Declared
+		from := db.ProviderFindOne(su.NodeId)
+		var moved uint64
+		for _, bl := range db.BlockFindByProvider(su.NodeId, maxFailures, batchSize) {
+			if moved >= excess {
+				break
+			}
+			if err := migrate(from, bl); err != nil {
+				failed(bl, err, maxFailures)
+			} else {
+				moved += bl.Size
+			}
+		}
+		log.Infof("migrated %d of %d excess bytes from provider [%s]", moved, excess, su.NodeId)
+	}
+}
+
+func migrate(from *db.ProviderInfo, bl *db.BlockLocation) (err error) {
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("Panic Error: %s, detail: %s", er, string(debug.Stack()))
+			err = errors.New("system error")
+		}
+	}()
+	fileKey, err := base64.StdEncoding.DecodeString(bl.FileHash)
+	if err != nil {
+		return err
+	}
+	blockKey, err := base64.StdEncoding.DecodeString(bl.Hash)
+	if err != nil {
+		return err
+	}
+	exclude := make(map[string]bool, 16)
+	for _, pid := range db.BlockProvidersOfFile(bl.FileId) {
+		exclude[pid] = true
+	}
+	pis, _ := chooser.Choose(&chooser.Selection{Num: 1, PieceSize: bl.Size, ExcludeNodes: exclude})
+	if len(pis) == 0 {
+		return errors.New("no provider available")
+	}
+	to := &pis[0]
+	if err = client.Copy(from, to, fileKey, bl.FileSize, blockKey, bl.Size, transfer_timeout); err != nil {
+		return err
+	}
+	db.BlockMigrate(bl, to.NodeId)
+	if err = client.Remove(from, blockKey, bl.Size, transfer_timeout); err != nil {
+		log.Warnf("remove migrated block %s from provider [%s] failed: %s", bl.Hash, from.NodeId, err)
+	}
+	return nil
+}
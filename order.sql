@@ -45,7 +45,31 @@ create table IF NOT EXISTS CLIENT_ORDER(
     START_TIME TIMESTAMPTZ DEFAULT NULL,
     END_TIME TIMESTAMPTZ DEFAULT NULL,
     PAY_TIME TIMESTAMPTZ DEFAULT NULL,
-    REMARK STRING(255)  
+    REMARK STRING(255),
+    DOWNGRADED BOOL NOT NULL DEFAULT false,
+    FROM_PACKAGE_ID INT DEFAULT NULL,
+    BASE_AMOUNT INT NOT NULL DEFAULT 0,
+    DISCOUNT_AMOUNT INT NOT NULL DEFAULT 0,
+    UPGRADE_AMOUNT INT NOT NULL DEFAULT 0,
+    UPGRADE_START TIMESTAMPTZ DEFAULT NULL,
+    UPGRADE_END TIMESTAMPTZ DEFAULT NULL,
+    -- 0: created, 1: paid, 2: active, 3: expired, 4: cancelled, 5: refunded
+    STATE INT NOT NULL DEFAULT 0,
+    INDEX CLIENT_ORDER_STATE(STATE)
+);
+
+create table IF NOT EXISTS CLIENT_ORDER_EVENT(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    ORDER_ID UUID NOT NULL REFERENCES CLIENT_ORDER (ID),
+    -- NULL for the event creating the order
+    FROM_STATE INT DEFAULT NULL,
+    TO_STATE INT NOT NULL,
+    OPERATOR STRING(64) NOT NULL,
+    REASON STRING(512) NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    -- orders the events of one transaction, which share CREATION
+    SEQ SERIAL NOT NULL,
+    INDEX CLIENT_ORDER_EVENT_ORDER_ID(ORDER_ID)
 );
 
 
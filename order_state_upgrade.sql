@@ -0,0 +1,32 @@
+-- upgrade of a database created by an order.sql without order states, run once
+-- before starting the tracker with order states
+
+ALTER TABLE CLIENT_ORDER ADD COLUMN IF NOT EXISTS STATE INT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS CLIENT_ORDER_STATE ON CLIENT_ORDER (STATE);
+
+create table IF NOT EXISTS CLIENT_ORDER_EVENT(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    ORDER_ID UUID NOT NULL REFERENCES CLIENT_ORDER (ID),
+    -- NULL for the event creating the order
+    FROM_STATE INT DEFAULT NULL,
+    TO_STATE INT NOT NULL,
+    OPERATOR STRING(64) NOT NULL,
+    REASON STRING(512) NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    -- orders the events of one transaction, which share CREATION
+    SEQ SERIAL NOT NULL,
+    INDEX CLIENT_ORDER_EVENT_ORDER_ID(ORDER_ID)
+);
+
+-- unpaid orders were removed when cancelled, paid ones are in the state their
+-- period is in
+update CLIENT_ORDER set STATE=4 where PAY_TIME is null and REMOVED=true;
+update CLIENT_ORDER set STATE=0 where PAY_TIME is null and REMOVED=false;
+update CLIENT_ORDER set STATE=1 where PAY_TIME is not null and START_TIME>now();
+update CLIENT_ORDER set STATE=2 where PAY_TIME is not null and START_TIME<=now() and END_TIME>now();
+update CLIENT_ORDER set STATE=3 where PAY_TIME is not null and END_TIME<=now();
+
+-- the history of an order created before starts with the state it was found in
+insert into CLIENT_ORDER_EVENT(ORDER_ID,FROM_STATE,TO_STATE,OPERATOR,REASON,CREATION)
+    select o.ID,NULL,o.STATE,'tracker','state backfilled',o.LAST_MODIFIED from CLIENT_ORDER o
+    where not exists (select 1 from CLIENT_ORDER_EVENT e where e.ORDER_ID=o.ID);
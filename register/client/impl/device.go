@@ -0,0 +1,180 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"time"
+
+	"nebula-tracker/db"
+	"nebula-tracker/register/sendmail"
+	"nebula-tracker/register/verifycode"
+
+	pb "github.com/samoslab/nebula/tracker/register/client/pb"
+	"golang.org/x/net/context"
+
+	util_hash "github.com/samoslab/nebula/util/hash"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const device_name_max_length = 64
+
+// AddDevice asks to join the account registered with the contact email, the
+// device is approved by another device of the account or with the code sent
+// to the contact email.
+func (self *ClientRegisterService) AddDevice(ctx context.Context, req *pb.AddDeviceReq) (*pb.AddDeviceResp, error) {
+	if len(req.NodeId) != 20 {
+		return nil, status.Error(codes.InvalidArgument, "NodeId length must be 20")
+	}
+	interval := time.Now().Unix() - int64(req.Timestamp)
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return nil, status.Error(codes.Unauthenticated, "auth info expired， please check your system time")
+	}
+	if !bytes.Equal(self.PubKeyHash, req.PublicKeyHash) {
+		return nil, status.Error(codes.FailedPrecondition, "tracker public key expired")
+	}
+	if len(req.Name) == 0 || len(req.Name) > device_name_max_length {
+		return nil, status.Errorf(codes.InvalidArgument, "device name is required and at most %d bytes", device_name_max_length)
+	}
+	publicKey, err := self.decrypt(req.PublicKeyEnc)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decrypt PublicKeyEnc error: %s", err)
+	}
+	if !bytes.Equal(util_hash.Sha1(publicKey), req.NodeId) {
+		return nil, status.Error(codes.InvalidArgument, "Public Key is not match NodeId")
+	}
+	pubKey, err := x509.ParsePKCS1PublicKey(publicKey)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Public Key can not be parsed")
+	}
+	if err = req.VerifySign(pubKey); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "verify sign failed: %s", err)
+	}
+	contactEmail, err := self.decrypt(req.ContactEmailEnc)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decrypt ContactEmailEnc error: %s", err)
+	}
+	found, accountId := db.ClientAccountOfContactEmail(string(contactEmail))
+	if !found {
+		return nil, status.Error(codes.NotFound, "no account registered with this contact email")
+	}
+	nodeId := base64.StdEncoding.EncodeToString(req.NodeId)
+	if db.ClientExistsNodeId(nodeId) {
+		if pending, pendingAccountId, _, _, _, _ := db.ClientGetPendingDevice(nodeId); !pending || pendingAccountId != accountId {
+			return nil, status.Error(codes.AlreadyExists, "This NodeId is already registered")
+		}
+	}
+	if !verifycode.MaySend(verifycode.EmailKey(string(contactEmail))) {
+		return nil, status.Error(codes.ResourceExhausted, "verify code sent just now, please try again later")
+	}
+	randomCode, codeHash := verifycode.New(nodeId)
+	db.ClientAddDevice(accountId, nodeId, publicKey, req.Name, codeHash)
+	sendmail.SendTemplate(string(contactEmail), db.ClientGetLocale(accountId), sendmail.TemplateVerifyCode, &sendmail.VerifyCodeData{Purpose: sendmail.PurposeAddDevice, Code: randomCode,
+		Time: sendmail.FormatTime(time.Now()), Device: req.Name})
+	return &pb.AddDeviceResp{Success: true}, nil
+}
+
+func (self *ClientRegisterService) VerifyDevice(ctx context.Context, req *pb.VerifyDeviceReq) (*pb.VerifyDeviceResp, error) {
+	nodeId := base64.StdEncoding.EncodeToString(req.NodeId)
+	found, accountId, publicKey, _, codeHash, sendTime := db.ClientGetPendingDevice(nodeId)
+	if !found {
+		return nil, status.Error(codes.InvalidArgument, "this node id is not waiting for approval")
+	}
+	interval := time.Now().Unix() - int64(req.Timestamp)
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return nil, status.Error(codes.Unauthenticated, "auth info expired， please check your system time")
+	}
+	pubKey, err := x509.ParsePKCS1PublicKey(publicKey)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Public Key can not be parsed")
+	}
+	if err = req.VerifySign(pubKey); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "verify sign failed: %s", err)
+	}
+	// AddDevice needs no auth, wrong codes are not charged to the account not to
+	// let anyone knowing the contact email lock its owner out
+	keys := requesterKeys(ctx, nodeId)
+	if verifycode.Locked(keys...) {
+		return nil, status.Error(codes.ResourceExhausted, "too many wrong verify codes, please try again later")
+	}
+	if !verifycode.Match(codeHash, nodeId, req.VerifyCode) {
+		verifycode.Fail(keys...)
+		return nil, status.Error(codes.InvalidArgument, "wrong verify code")
+	}
+	if time.Now().UTC().Sub(sendTime).Minutes() > 120 {
+		return nil, status.Error(codes.DeadlineExceeded, "verify code expired, please add device again")
+	}
+	verifycode.Succeed(keys...)
+	db.ClientApproveDevice(accountId, nodeId)
+	return &pb.VerifyDeviceResp{Success: true}, nil
+}
+
+func (self *ClientRegisterService) ApproveDevice(ctx context.Context, req *pb.ApproveDeviceReq) (*pb.ApproveDeviceResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	accountId := db.ClientAccountOf(nodeId)
+	deviceNodeId := base64.StdEncoding.EncodeToString(req.DeviceNodeId)
+	found, pendingAccountId, _, _, _, _ := db.ClientGetPendingDevice(deviceNodeId)
+	if !found || pendingAccountId != accountId {
+		return nil, status.Error(codes.NotFound, "no such device waiting for approval")
+	}
+	db.ClientApproveDevice(accountId, deviceNodeId)
+	return &pb.ApproveDeviceResp{Success: true}, nil
+}
+
+func (self *ClientRegisterService) ListDevice(ctx context.Context, req *pb.ListDeviceReq) (*pb.ListDeviceResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	devices := db.ClientListDevice(db.ClientAccountOf(nodeId))
+	resp := &pb.ListDeviceResp{Device: make([]*pb.Device, 0, len(devices))}
+	for _, cd := range devices {
+		id, err := base64.StdEncoding.DecodeString(cd.NodeId)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "decode node id error: %s", err)
+		}
+		resp.Device = append(resp.Device, &pb.Device{NodeId: id,
+			Name:     cd.Name,
+			Primary:  cd.Primary,
+			Approved: cd.Approved,
+			Revoked:  cd.Revoked,
+			Creation: uint64(cd.Creation.Unix())})
+	}
+	return resp, nil
+}
+
+func (self *ClientRegisterService) RevokeDevice(ctx context.Context, req *pb.RevokeDeviceReq) (*pb.RevokeDeviceResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	accountId := db.ClientAccountOf(nodeId)
+	deviceNodeId := base64.StdEncoding.EncodeToString(req.DeviceNodeId)
+	if deviceNodeId != accountId && db.ClientAccountOf(deviceNodeId) != accountId {
+		if found, pendingAccountId, _, _, _, _ := db.ClientGetPendingDevice(deviceNodeId); !found || pendingAccountId != accountId {
+			return nil, status.Error(codes.NotFound, "no such device in this account")
+		}
+	}
+	if db.ClientRevokeDevice(accountId, deviceNodeId) {
+		return nil, status.Error(codes.FailedPrecondition, "can not revoke the last device of the account")
+	}
+	return &pb.RevokeDeviceResp{Success: true}, nil
+}
+
+// requesterKeys are the verify code keys of the node sending a request and of
+// its ip.
+func requesterKeys(ctx context.Context, nodeId string) []string {
+	keys := []string{verifycode.NodeKey(nodeId)}
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != net.Addr(nil) {
+		if ip, _, err := net.SplitHostPort(pr.Addr.String()); err == nil {
+			keys = append(keys, verifycode.IpKey(ip))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,182 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"nebula-tracker/db"
+	"nebula-tracker/register/random"
+	"nebula-tracker/register/sendmail"
+	"nebula-tracker/register/verifycode"
+
+	"github.com/samoslab/nebula/provider/node"
+	pb "github.com/samoslab/nebula/tracker/register/client/pb"
+	"golang.org/x/net/context"
+
+	util_hash "github.com/samoslab/nebula/util/hash"
+	util_rsa "github.com/samoslab/nebula/util/rsa"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const recovery_code_length = 16
+
+// decryptNewKey decrypts a public key not registered yet, returning it with
+// the node id derived from it.
+func (self *ClientRegisterService) decryptNewKey(publicKeyEnc []byte, publicKeyHash []byte) (publicKey []byte, pubKey *rsa.PublicKey, nodeId string, err error) {
+	if !bytes.Equal(self.PubKeyHash, publicKeyHash) {
+		err = status.Error(codes.FailedPrecondition, "tracker public key expired")
+		return
+	}
+	if publicKey, err = self.decrypt(publicKeyEnc); err != nil {
+		err = status.Errorf(codes.InvalidArgument, "decrypt PublicKeyEnc error: %s", err)
+		return
+	}
+	if pubKey, err = x509.ParsePKCS1PublicKey(publicKey); err != nil {
+		err = status.Error(codes.InvalidArgument, "Public Key can not be parsed")
+		return
+	}
+	nodeId = base64.StdEncoding.EncodeToString(util_hash.Sha1(publicKey))
+	if db.ClientExistsNodeId(nodeId) {
+		err = status.Error(codes.AlreadyExists, "This NodeId is already registered")
+	}
+	return
+}
+
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCode returns a recovery code encrypted with the public key, and
+// the hash of it to keep.
+func newRecoveryCode(pubKey *rsa.PublicKey) (codeEnc []byte, codeHash string, err error) {
+	code := random.SecureRandomStr(recovery_code_length)
+	codeEnc, err = util_rsa.EncryptLong(pubKey, []byte(code), node.RSA_KEY_BYTES)
+	if err != nil {
+		err = status.Errorf(codes.Internal, "encrypt recovery code failed: %s", err)
+		return
+	}
+	codeHash = recoveryCodeHash(code)
+	return
+}
+
+// RotateKey replaces the key of the signing device with a new one, the node
+// id of the device changes with it.
+func (self *ClientRegisterService) RotateKey(ctx context.Context, req *pb.RotateKeyReq) (*pb.RotateKeyResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, newNodeId, err := self.decryptNewKey(req.PublicKeyEnc, req.PublicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	accountId := db.ClientAccountOf(nodeId)
+	db.ClientRotateKey(accountId, nodeId, newNodeId, publicKey, db.ClientDeviceName(accountId, nodeId))
+	return &pb.RotateKeyResp{Success: true}, nil
+}
+
+func (self *ClientRegisterService) GenerateRecoveryCode(ctx context.Context, req *pb.GenerateRecoveryCodeReq) (*pb.GenerateRecoveryCodeResp, error) {
+	nodeId, pubKey, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	codeEnc, codeHash, err := newRecoveryCode(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	db.ClientSetRecoveryCode(db.ClientAccountOf(nodeId), codeHash)
+	return &pb.GenerateRecoveryCodeResp{RecoveryCodeEnc: codeEnc}, nil
+}
+
+func (self *ClientRegisterService) RequestRecovery(ctx context.Context, req *pb.RequestRecoveryReq) (*pb.RequestRecoveryResp, error) {
+	interval := time.Now().Unix() - int64(req.Timestamp)
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return nil, status.Error(codes.Unauthenticated, "auth info expired， please check your system time")
+	}
+	if !bytes.Equal(self.PubKeyHash, req.PublicKeyHash) {
+		return nil, status.Error(codes.FailedPrecondition, "tracker public key expired")
+	}
+	contactEmail, err := self.decrypt(req.ContactEmailEnc)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decrypt ContactEmailEnc error: %s", err)
+	}
+	// the response is the same whether the email belongs to an account able
+	// to recover or not, so that registered emails can not be told
+	if !verifycode.MaySend(verifycode.EmailKey(string(contactEmail))) {
+		return nil, status.Error(codes.ResourceExhausted, "recovery email sent just now, please try again later")
+	}
+	found, accountId := db.ClientAccountOfContactEmail(string(contactEmail))
+	if !found {
+		return &pb.RequestRecoveryResp{Success: true}, nil
+	}
+	_, codeHash, _, _ := db.ClientGetRecovery(accountId)
+	if codeHash == "" {
+		return &pb.RequestRecoveryResp{Success: true}, nil
+	}
+	code, emailCodeHash := verifycode.New(accountId)
+	db.ClientUpdateRecoveryEmailCode(accountId, emailCodeHash)
+	sendmail.SendTemplate(string(contactEmail), db.ClientGetLocale(accountId), sendmail.TemplateVerifyCode, &sendmail.VerifyCodeData{Purpose: sendmail.PurposeKeyRecovery, Code: code,
+		Time: sendmail.FormatTime(time.Now())})
+	return &pb.RequestRecoveryResp{Success: true}, nil
+}
+
+// RecoverKey puts a new key in use for an account whose keys are all lost,
+// with the code sent to the contact email and the recovery code. Wrong codes
+// are charged to the requesting key and address only, so that they can not
+// lock the owner of the account out.
+func (self *ClientRegisterService) RecoverKey(ctx context.Context, req *pb.RecoverKeyReq) (*pb.RecoverKeyResp, error) {
+	interval := time.Now().Unix() - int64(req.Timestamp)
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return nil, status.Error(codes.Unauthenticated, "auth info expired， please check your system time")
+	}
+	publicKey, pubKey, nodeId, err := self.decryptNewKey(req.PublicKeyEnc, req.PublicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if nodeId != base64.StdEncoding.EncodeToString(req.NodeId) {
+		return nil, status.Error(codes.InvalidArgument, "Public Key is not match NodeId")
+	}
+	if err = req.VerifySign(pubKey); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "verify sign failed: %s", err)
+	}
+	contactEmail, err := self.decrypt(req.ContactEmailEnc)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decrypt ContactEmailEnc error: %s", err)
+	}
+	keys := requesterKeys(ctx, nodeId)
+	if verifycode.Locked(keys...) {
+		return nil, status.Error(codes.ResourceExhausted, "too many wrong verify codes, please try again later")
+	}
+	// an unknown email is answered as a wrong code, not to tell registered ones
+	found, accountId := db.ClientAccountOfContactEmail(string(contactEmail))
+	var codeHash, emailCodeHash string
+	var sendTime time.Time
+	if found {
+		_, codeHash, emailCodeHash, sendTime = db.ClientGetRecovery(accountId)
+	}
+	if !found || emailCodeHash == "" || !verifycode.Match(emailCodeHash, accountId, req.VerifyCode) ||
+		subtle.ConstantTimeCompare([]byte(recoveryCodeHash(req.RecoveryCode)), []byte(codeHash)) != 1 {
+		verifycode.Fail(keys...)
+		return nil, status.Error(codes.InvalidArgument, "wrong verify code or recovery code")
+	}
+	if time.Now().UTC().Sub(sendTime).Minutes() > 120 {
+		return nil, status.Error(codes.DeadlineExceeded, "verify code expired, please request recovery again")
+	}
+	verifycode.Succeed(keys...)
+	codeEnc, newCodeHash, err := newRecoveryCode(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	db.ClientRecoverKey(accountId, nodeId, publicKey, "recovered", newCodeHash)
+	sendmail.SendTemplate(string(contactEmail), db.ClientGetLocale(accountId), sendmail.TemplateAccount, &sendmail.AccountData{Event: "key_recovered",
+		Time: sendmail.FormatTime(time.Now())})
+	return &pb.RecoverKeyResp{RecoveryCodeEnc: codeEnc}, nil
+}
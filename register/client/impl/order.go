@@ -46,23 +46,49 @@ func convertPackageInfo(p *db.PackageInfo) *pb.Package {
 
 func convertOrderInfo(o *db.OrderInfo) *pb.Order {
 	return &pb.Order{Id: o.Id,
-		Creation:    uint64(o.Creation.Unix()),
-		PackageId:   o.PackageId,
-		Package:     convertPackageInfo(o.Package),
-		Quanlity:    o.Quanlity,
-		TotalAmount: o.TotalAmount,
-		Upgraded:    o.Upgraded,
-		Discount:    o.Discount.String(),
-		Volume:      o.Volume,
-		Netflow:     o.Netflow,
-		UpNetflow:   o.UpNetflow,
-		DownNetflow: o.DownNetflow,
-		ValidDays:   o.ValidDays,
-		StartTime:   o.StartTime,
-		EndTime:     o.EndTime,
-		Paid:        o.Paid,
-		PayTime:     o.PayTime,
-		Remark:      o.Remark}
+		Creation:       uint64(o.Creation.Unix()),
+		PackageId:      o.PackageId,
+		Package:        convertPackageInfo(o.Package),
+		Quanlity:       o.Quanlity,
+		TotalAmount:    o.TotalAmount,
+		Upgraded:       o.Upgraded,
+		Discount:       o.Discount.String(),
+		Volume:         o.Volume,
+		Netflow:        o.Netflow,
+		UpNetflow:      o.UpNetflow,
+		DownNetflow:    o.DownNetflow,
+		ValidDays:      o.ValidDays,
+		StartTime:      o.StartTime,
+		EndTime:        o.EndTime,
+		Paid:           o.Paid,
+		PayTime:        o.PayTime,
+		Remark:         o.Remark,
+		Downgraded:     o.Downgraded,
+		FromPackageId:  o.FromPackageId,
+		BaseAmount:     o.BaseAmount,
+		DiscountAmount: o.DiscountAmount,
+		UpgradeAmount:  o.UpgradeAmount,
+		UpgradeStart:   o.UpgradeStart,
+		UpgradeEnd:     o.UpgradeEnd,
+		State:          uint32(o.State),
+		Events:         convertOrderEvents(o.Events)}
+}
+
+func convertOrderEvents(events []*db.OrderEvent) []*pb.OrderEvent {
+	res := make([]*pb.OrderEvent, 0, len(events))
+	for _, e := range events {
+		pe := &pb.OrderEvent{ToState: uint32(e.ToState),
+			Operator: e.Operator,
+			Reason:   e.Reason,
+			Creation: uint64(e.Creation.Unix())}
+		if e.FromState == nil {
+			pe.Initial = true
+		} else {
+			pe.FromState = uint32(*e.FromState)
+		}
+		res = append(res, pe)
+	}
+	return res
 }
 
 func (self *ClientOrderService) PackageInfo(ctx context.Context, req *pb.PackageInfoReq) (*pb.PackageInfoResp, error) {
@@ -101,6 +127,7 @@ func (self *ClientOrderService) BuyPackage(ctx context.Context, req *pb.BuyPacka
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.BuyPackageResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	found, _, emailVerified, _, _ := db.ClientGetRandomCode(nodeId)
 	if !found || !emailVerified {
 		return &pb.BuyPackageResp{Code: 9, ErrMsg: "email not verified"}, nil
@@ -111,20 +138,33 @@ func (self *ClientOrderService) BuyPackage(ctx context.Context, req *pb.BuyPacka
 	}
 
 	inService, _, packageId, volume, _, _, _, endTime := db.GetCurrentPackage(nodeId)
-	var renew, upgrade bool
+	var renew, upgrade, downgrade bool
 	if inService {
+		if nextPackageId, _ := db.ClientNextPackage(nodeId); nextPackageId != 0 {
+			return &pb.BuyPackageResp{Code: 23, ErrMsg: "a downgraded package is scheduled, can not buy before it takes effect"}, nil
+		}
 		if pi.Volume < volume {
-			return &pb.BuyPackageResp{Code: 22, ErrMsg: "can not buy a package which volume is less than current"}, nil
+			if usageExceeds(nodeId, pi.Volume) {
+				return &pb.BuyPackageResp{Code: 22, ErrMsg: "can not downgrade to a package which volume is less than current usage"}, nil
+			}
+			downgrade = true
 		} else if pi.Volume == volume {
 			renew = true
 		} else {
 			upgrade = true
 		}
 	}
-	oi := db.BuyPackage(nodeId, req.PackageId, req.Quanlity, req.CancelUnpaid, renew, endTime, upgrade, packageId)
+	oi := db.BuyPackage(nodeId, req.PackageId, req.Quanlity, req.CancelUnpaid, renew, endTime, upgrade, downgrade, packageId)
 	return &pb.BuyPackageResp{Order: convertOrderInfo(oi)}, nil
 }
 
+// usageExceeds tells if the volume used by the client is more than the volume
+// of a package, which is in GB.
+func usageExceeds(nodeId string, volume uint32) bool {
+	_, _, _, _, _, _, _, usageVolume, _, _, _, _ := db.UsageAmount(nodeId)
+	return uint64(usageVolume) > uint64(volume)*1024
+}
+
 func (self *ClientOrderService) MyAllOrder(ctx context.Context, req *pb.MyAllOrderReq) (*pb.MyAllOrderResp, error) {
 	if req.NodeId == nil {
 		return &pb.MyAllOrderResp{Code: 2, ErrMsg: "NodeId is required"}, nil
@@ -144,6 +184,7 @@ func (self *ClientOrderService) MyAllOrder(ctx context.Context, req *pb.MyAllOrd
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.MyAllOrderResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	found, _, emailVerified, _, _ := db.ClientGetRandomCode(nodeId)
 	if !found || !emailVerified {
 		return &pb.MyAllOrderResp{Code: 9, ErrMsg: "email not verified"}, nil
@@ -175,6 +216,7 @@ func (self *ClientOrderService) OrderInfo(ctx context.Context, req *pb.OrderInfo
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.OrderInfoResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	if len(req.OrderId) == 0 {
 		return &pb.OrderInfoResp{Code: 15, ErrMsg: "orderId is required"}, nil
 	}
@@ -209,6 +251,7 @@ func (self *ClientOrderService) RemoveOrder(ctx context.Context, req *pb.RemoveO
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.RemoveOrderResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	if len(req.OrderId) == 0 {
 		return &pb.RemoveOrderResp{Code: 15, ErrMsg: "orderId is required"}, nil
 	}
@@ -247,6 +290,7 @@ func (self *ClientOrderService) RechargeAddress(ctx context.Context, req *pb.Rec
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.RechargeAddressResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	found, _, emailVerified, _, _ := db.ClientGetRandomCode(nodeId)
 	if !found || !emailVerified {
 		return &pb.RechargeAddressResp{Code: 9, ErrMsg: "email not verified"}, nil
@@ -278,6 +322,7 @@ func (self *ClientOrderService) PayOrder(ctx context.Context, req *pb.PayOrderRe
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.PayOrderResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	if len(req.OrderId) == 0 {
 		return &pb.PayOrderResp{Code: 15, ErrMsg: "orderId is required"}, nil
 	}
@@ -292,11 +337,25 @@ func (self *ClientOrderService) PayOrder(ctx context.Context, req *pb.PayOrderRe
 	if oi.Paid {
 		return &pb.PayOrderResp{Code: 16, ErrMsg: "order is paid"}, nil
 	}
+	inService, _, packageId, _, _, _, _, _ := db.GetCurrentPackage(nodeId)
+	if inService {
+		if nextPackageId, _ := db.ClientNextPackage(nodeId); nextPackageId != 0 {
+			return &pb.PayOrderResp{Code: 23, ErrMsg: "a downgraded package is scheduled, can not pay before it takes effect"}, nil
+		}
+	}
+	// priced against the package in service when ordered, an upgrade also
+	// against its remaining time
+	if oi.FromPackageId != 0 && (inService && packageId != oi.FromPackageId || !inService && oi.Upgraded) {
+		return &pb.PayOrderResp{Code: 18, ErrMsg: "current package changed since ordered, please buy again"}, nil
+	}
+	if oi.Downgraded && usageExceeds(nodeId, oi.Volume) {
+		return &pb.PayOrderResp{Code: 22, ErrMsg: "can not downgrade to a package which volume is less than current usage"}, nil
+	}
 	balance := db.GetBalance(nodeId)
 	if balance < oi.TotalAmount {
 		return &pb.PayOrderResp{Code: 20, ErrMsg: "balance is not enough, margin: " + decimal.New(int64(oi.TotalAmount-balance), 0).String()}, nil
 	}
-	db.PayOrder(nodeId, req.OrderId, oi.TotalAmount, oi.ValidDays, oi.PackageId, oi.Volume, oi.Netflow, oi.UpNetflow, oi.DownNetflow)
+	db.PayOrder(nodeId, req.OrderId, oi.TotalAmount, oi.ValidDays, oi.PackageId, oi.Volume, oi.Netflow, oi.UpNetflow, oi.DownNetflow, oi.Upgraded, oi.Downgraded)
 	return &pb.PayOrderResp{}, nil
 }
 
@@ -319,6 +378,7 @@ func (self *ClientOrderService) UsageAmount(ctx context.Context, req *pb.UsageAm
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.UsageAmountResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	inService, emailVerified, packageId, volume, netflow, upNetflow, downNetflow, usageVolume, usageNetflow, usageUpNetflow, usageDownNetflow, endTime := db.UsageAmount(nodeId)
 	if !emailVerified {
 		return &pb.UsageAmountResp{Code: 400, ErrMsg: "email not verified"}, nil
@@ -326,7 +386,7 @@ func (self *ClientOrderService) UsageAmount(ctx context.Context, req *pb.UsageAm
 	if !inService {
 		return &pb.UsageAmountResp{Code: 401, ErrMsg: "not buy any package order"}, nil
 	}
-	return &pb.UsageAmountResp{PackageId: packageId, Volume: volume,
+	resp := &pb.UsageAmountResp{PackageId: packageId, Volume: volume,
 		Netflow:          netflow,
 		UpNetflow:        upNetflow,
 		DownNetflow:      downNetflow,
@@ -334,5 +394,38 @@ func (self *ClientOrderService) UsageAmount(ctx context.Context, req *pb.UsageAm
 		UsageNetflow:     usageNetflow,
 		UsageUpNetflow:   usageUpNetflow,
 		UsageDownNetflow: usageDownNetflow,
-		EndTime:          uint64(endTime.Unix())}, nil
+		EndTime:          uint64(endTime.Unix()),
+		AutoRenew:        db.ClientGetAutoRenew(nodeId)}
+	if nextPackageId, nextStartTime := db.ClientNextPackage(nodeId); nextPackageId != 0 {
+		resp.NextPackageId, resp.NextStartTime = nextPackageId, uint64(nextStartTime.Unix())
+	}
+	return resp, nil
+}
+
+func (self *ClientOrderService) SetAutoRenew(ctx context.Context, req *pb.SetAutoRenewReq) (*pb.SetAutoRenewResp, error) {
+	if req.NodeId == nil {
+		return &pb.SetAutoRenewResp{Code: 2, ErrMsg: "NodeId is required"}, nil
+	}
+	if len(req.NodeId) != 20 {
+		return &pb.SetAutoRenewResp{Code: 3, ErrMsg: "NodeId length must be 20"}, nil
+	}
+	nodeId := base64.StdEncoding.EncodeToString(req.NodeId)
+	pubKey := db.ClientGetPubKey(nodeId)
+	if pubKey == nil {
+		return &pb.SetAutoRenewResp{Code: 4, ErrMsg: "this node id is not been registered"}, nil
+	}
+	interval := time.Now().Unix() - int64(req.Timestamp)
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return &pb.SetAutoRenewResp{Code: 10, ErrMsg: "auth info expired， please check your system time"}, nil
+	}
+	if err := req.VerifySign(pubKey); err != nil {
+		return &pb.SetAutoRenewResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
+	}
+	nodeId = db.ClientAccountOf(nodeId)
+	found, _, emailVerified, _, _ := db.ClientGetRandomCode(nodeId)
+	if !found || !emailVerified {
+		return &pb.SetAutoRenewResp{Code: 9, ErrMsg: "email not verified"}, nil
+	}
+	db.ClientSetAutoRenew(nodeId, req.AutoRenew)
+	return &pb.SetAutoRenewResp{}, nil
 }
@@ -5,12 +5,14 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
-	"fmt"
+	"encoding/json"
+	"net"
 	"time"
 
 	"nebula-tracker/db"
-	"nebula-tracker/register/random"
+	"nebula-tracker/register/discovery"
 	"nebula-tracker/register/sendmail"
+	"nebula-tracker/register/verifycode"
 
 	"github.com/samoslab/nebula/provider/node"
 	pb "github.com/samoslab/nebula/tracker/register/client/pb"
@@ -19,7 +21,10 @@ import (
 	util_hash "github.com/samoslab/nebula/util/hash"
 	util_rsa "github.com/samoslab/nebula/util/rsa"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type ClientRegisterService struct {
@@ -84,25 +89,58 @@ func (self *ClientRegisterService) Register(ctx context.Context, req *pb.Registe
 	if db.ClientExistsContactEmail(string(contactEmail)) {
 		return &pb.RegisterResp{Code: 11, ErrMsg: "This Contact Email is already registered"}, nil
 	}
-	randomCode := random.RandomStr(8)
-	db.ClientRegister(nodeIdStr, publicKey, pubKey, string(contactEmail), randomCode)
+	if !sendmail.ValidLocale(req.Locale) {
+		return &pb.RegisterResp{Code: 12, ErrMsg: "invalid locale"}, nil
+	}
+	randomCode, codeHash := verifycode.New(nodeIdStr)
+	db.ClientRegister(nodeIdStr, publicKey, pubKey, string(contactEmail), codeHash, req.Locale)
 	self.sendVerifyCodeToContactEmail(nodeIdStr, string(contactEmail), randomCode)
 	return &pb.RegisterResp{Code: 0}, nil
 }
 
 func (self *ClientRegisterService) sendVerifyCodeToContactEmail(nodeId string, email string, randomCode string) {
-	sendmail.Send(email, "Nebula Client Register Contact Email Verify Code", fmt.Sprintf("verify code is %s, sent at %s",
-		randomCode, time.Now().UTC().Format("2006-01-02 15:04:05 UTC")))
+	sendmail.SendTemplate(email, db.ClientGetLocale(nodeId), sendmail.TemplateVerifyCode, &sendmail.VerifyCodeData{Purpose: sendmail.PurposeContactEmail, Code: randomCode,
+		Time: sendmail.FormatTime(time.Now())})
 }
 
-func (self *ClientRegisterService) reGenerateVerifyCode(nodeId string, email string) {
-	randomCode := random.RandomStr(8)
-	db.ClientUpdateVerifyCode(nodeId, randomCode)
+// reGenerateVerifyCode sends a new verify code unless one was sent just now.
+func (self *ClientRegisterService) reGenerateVerifyCode(nodeId string, email string) bool {
+	if !verifycode.MaySend(verifycode.NodeKey(nodeId), verifycode.EmailKey(email)) {
+		return false
+	}
+	randomCode, codeHash := verifycode.New(nodeId)
+	db.ClientUpdateVerifyCode(nodeId, codeHash)
 	self.sendVerifyCodeToContactEmail(nodeId, email, randomCode)
+	return true
 }
 
 const verify_sign_expired = 15
 
+// signedReq is a request signed by the client node it is sent from.
+type signedReq interface {
+	GetNodeId() []byte
+	GetTimestamp() uint64
+	VerifySign(pubKey *rsa.PublicKey) error
+}
+
+// verifyClientReq checks the request is recent and signed by the registered
+// node it names, and returns the node id with its public key.
+func verifyClientReq(req signedReq) (string, *rsa.PublicKey, error) {
+	nodeId := base64.StdEncoding.EncodeToString(req.GetNodeId())
+	pubKey := db.ClientGetPubKey(nodeId)
+	if pubKey == nil {
+		return "", nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	interval := time.Now().Unix() - int64(req.GetTimestamp())
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return "", nil, status.Error(codes.Unauthenticated, "auth info expired， please check your system time")
+	}
+	if err := req.VerifySign(pubKey); err != nil {
+		return "", nil, status.Errorf(codes.Unauthenticated, "verify sign failed: %s", err)
+	}
+	return nodeId, pubKey, nil
+}
+
 func (self *ClientRegisterService) VerifyContactEmail(ctx context.Context, req *pb.VerifyContactEmailReq) (*pb.VerifyContactEmailResp, error) {
 	if req.NodeId == nil {
 		return &pb.VerifyContactEmailResp{Code: 2, ErrMsg: "NodeId is required"}, nil
@@ -122,6 +160,7 @@ func (self *ClientRegisterService) VerifyContactEmail(ctx context.Context, req *
 	if err := req.VerifySign(pubKey); err != nil {
 		return &pb.VerifyContactEmailResp{Code: 5, ErrMsg: "Verify Sign failed: " + err.Error()}, nil
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	found, contactEmail, emailVerified, randomCode, sendTime := db.ClientGetRandomCode(nodeId)
 	if !found {
 		return &pb.VerifyContactEmailResp{Code: 6, ErrMsg: "this node id is not been registered"}, nil
@@ -129,14 +168,21 @@ func (self *ClientRegisterService) VerifyContactEmail(ctx context.Context, req *
 	if emailVerified {
 		return &pb.VerifyContactEmailResp{Code: 7, ErrMsg: "already verified contact email"}, nil
 	}
-	if req.VerifyCode != randomCode {
-		self.reGenerateVerifyCode(nodeId, contactEmail)
-		return &pb.VerifyContactEmailResp{Code: 8, ErrMsg: "wrong verified code, will send verify email again"}, nil
+	keys := []string{verifycode.NodeKey(nodeId), verifycode.EmailKey(contactEmail)}
+	if verifycode.Locked(keys...) {
+		return &pb.VerifyContactEmailResp{Code: 11, ErrMsg: "too many wrong verify codes, please try again later"}, nil
+	}
+	if !verifycode.Match(randomCode, nodeId, req.VerifyCode) {
+		verifycode.Fail(keys...)
+		return &pb.VerifyContactEmailResp{Code: 8, ErrMsg: "wrong verified code"}, nil
 	}
 	if subM := time.Now().UTC().Sub(sendTime).Minutes(); subM > 120 {
-		self.reGenerateVerifyCode(nodeId, contactEmail)
-		return &pb.VerifyContactEmailResp{Code: 9, ErrMsg: "verify code expired, will send verify email again"}, nil
+		if self.reGenerateVerifyCode(nodeId, contactEmail) {
+			return &pb.VerifyContactEmailResp{Code: 9, ErrMsg: "verify code expired, will send verify email again"}, nil
+		}
+		return &pb.VerifyContactEmailResp{Code: 9, ErrMsg: "verify code expired, please resend verify code later"}, nil
 	}
+	verifycode.Succeed(keys...)
 	db.ClientUpdateEmailVerified(nodeId)
 	return &pb.VerifyContactEmailResp{Code: 0}, nil
 }
@@ -154,6 +200,7 @@ func (self *ClientRegisterService) ResendVerifyCode(ctx context.Context, req *pb
 	if err := req.VerifySign(pubKey); err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "verify sign failed: %s", err)
 	}
+	nodeId = db.ClientAccountOf(nodeId)
 	found, contactEmail, emailVerified, _, _ := db.ClientGetRandomCode(nodeId)
 	if !found {
 		return nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
@@ -161,11 +208,177 @@ func (self *ClientRegisterService) ResendVerifyCode(ctx context.Context, req *pb
 	if emailVerified {
 		return nil, status.Error(codes.AlreadyExists, "already verified！")
 	}
-	self.reGenerateVerifyCode(nodeId, contactEmail)
+	if !self.reGenerateVerifyCode(nodeId, contactEmail) {
+		return nil, status.Error(codes.ResourceExhausted, "verify code sent just now, please try again later")
+	}
 	return &pb.ResendVerifyCodeResp{Success: true}, nil
 }
 
 func (self *ClientRegisterService) GetTrackerServer(ctx context.Context, req *pb.GetTrackerServerReq) (*pb.GetTrackerServerResp, error) {
-	// TODO
-	return nil, nil
+	if _, _, err := verifyClientReq(req); err != nil {
+		return nil, err
+	}
+	var ip string
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != net.Addr(nil) {
+		ip, _, _ = net.SplitHostPort(pr.Addr.String())
+	}
+	servers := discovery.Servers(db.ServerCategoryTracker, ip)
+	resp := &pb.GetTrackerServerResp{Server: make([]*pb.TrackerServer, 0, len(servers))}
+	for _, si := range servers {
+		resp.Server = append(resp.Server, &pb.TrackerServer{Server: si.Server, Port: si.Port})
+	}
+	return resp, nil
+}
+
+func (self *ClientRegisterService) ExportAccount(ctx context.Context, req *pb.ExportAccountReq) (*pb.ExportAccountResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	nodeId = db.ClientAccountOf(nodeId)
+	data, err := json.Marshal(db.ClientExportAccount(nodeId))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "export account failed: %s", err)
+	}
+	return &pb.ExportAccountResp{Data: data}, nil
+}
+
+// minutes a delete account code stays valid
+const delete_code_expired = 120
+
+func (self *ClientRegisterService) RequestDeleteAccount(ctx context.Context, req *pb.RequestDeleteAccountReq) (*pb.RequestDeleteAccountResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	nodeId = db.ClientAccountOf(nodeId)
+	found, contactEmail, emailVerified, _, _ := db.ClientGetRandomCode(nodeId)
+	if !found {
+		return nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	if !emailVerified {
+		return nil, status.Error(codes.FailedPrecondition, "contact email is not verified")
+	}
+	if !verifycode.MaySend(verifycode.NodeKey(nodeId)) {
+		return nil, status.Error(codes.ResourceExhausted, "verify code sent just now, please try again later")
+	}
+	code, codeHash := verifycode.New(nodeId)
+	db.ClientUpdateDeleteCode(nodeId, codeHash)
+	sendmail.SendTemplate(contactEmail, db.ClientGetLocale(nodeId), sendmail.TemplateVerifyCode, &sendmail.VerifyCodeData{Purpose: sendmail.PurposeDeleteAccount, Code: code,
+		Time: sendmail.FormatTime(time.Now())})
+	return &pb.RequestDeleteAccountResp{Success: true}, nil
+}
+
+func (self *ClientRegisterService) DeleteAccount(ctx context.Context, req *pb.DeleteAccountReq) (*pb.DeleteAccountResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	nodeId = db.ClientAccountOf(nodeId)
+	found, codeHash, sendTime := db.ClientGetDeleteCode(nodeId)
+	if !found {
+		return nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	if codeHash == "" {
+		return nil, status.Error(codes.FailedPrecondition, "request delete account first")
+	}
+	key := verifycode.NodeKey(nodeId)
+	if verifycode.Locked(key) {
+		return nil, status.Error(codes.ResourceExhausted, "too many wrong verify codes, please try again later")
+	}
+	if !verifycode.Match(codeHash, nodeId, req.VerifyCode) {
+		verifycode.Fail(key)
+		return nil, status.Error(codes.InvalidArgument, "wrong verify code")
+	}
+	if time.Now().UTC().Sub(sendTime).Minutes() > delete_code_expired {
+		return nil, status.Error(codes.DeadlineExceeded, "verify code expired, please request delete account again")
+	}
+	verifycode.Succeed(key)
+	deleted, balance := db.ClientDeleteAccount(nodeId, req.ForfeitBalance)
+	if !deleted {
+		return nil, status.Errorf(codes.FailedPrecondition, "balance %d left would be forfeited, set forfeitBalance to delete anyway", balance)
+	}
+	if balance > 0 {
+		log.Infof("client [%s] deleted account forfeiting balance %d", nodeId, balance)
+	}
+	return &pb.DeleteAccountResp{Success: true}, nil
+}
+
+// requests to change the contact email allowed per email_change_window, wrong
+// codes are limited by verifycode
+const email_change_limit = 5
+
+const email_change_window = 24 * time.Hour
+
+func (self *ClientRegisterService) ChangeContactEmail(ctx context.Context, req *pb.ChangeContactEmailReq) (*pb.ChangeContactEmailResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	nodeId = db.ClientAccountOf(nodeId)
+	if !bytes.Equal(self.PubKeyHash, req.PublicKeyHash) {
+		return nil, status.Error(codes.FailedPrecondition, "tracker public key expired")
+	}
+	if len(req.ContactEmailEnc) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ContactEmailEnc is required")
+	}
+	contactEmail, err := self.decrypt(req.ContactEmailEnc)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decrypt ContactEmailEnc error: %s", err)
+	}
+	found, oldEmail, _, _, _ := db.ClientGetNewContactEmail(nodeId)
+	if !found {
+		return nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	if string(contactEmail) == oldEmail {
+		return nil, status.Error(codes.InvalidArgument, "same as the current contact email")
+	}
+	if db.ClientExistsContactEmail(string(contactEmail)) {
+		return nil, status.Error(codes.AlreadyExists, "This Contact Email is already registered")
+	}
+	if !db.ClientEmailChangeAttempt(nodeId, time.Now().Add(-email_change_window), email_change_limit) {
+		return nil, status.Error(codes.ResourceExhausted, "too many attempts to change contact email, please try again later")
+	}
+	if !verifycode.MaySend(verifycode.EmailKey(string(contactEmail))) {
+		return nil, status.Error(codes.ResourceExhausted, "verify code sent just now, please try again later")
+	}
+	code, codeHash := verifycode.New(nodeId)
+	db.ClientChangeContactEmail(nodeId, string(contactEmail), codeHash)
+	now, locale := sendmail.FormatTime(time.Now()), db.ClientGetLocale(nodeId)
+	sendmail.SendTemplate(string(contactEmail), locale, sendmail.TemplateVerifyCode, &sendmail.VerifyCodeData{Purpose: sendmail.PurposeNewContactEmail, Code: code, Time: now})
+	sendmail.SendTemplate(oldEmail, locale, sendmail.TemplateAccount, &sendmail.AccountData{Event: "contact_email_change_requested", NewEmail: string(contactEmail), Time: now})
+	return &pb.ChangeContactEmailResp{Success: true}, nil
+}
+
+func (self *ClientRegisterService) VerifyNewContactEmail(ctx context.Context, req *pb.VerifyNewContactEmailReq) (*pb.VerifyNewContactEmailResp, error) {
+	nodeId, _, err := verifyClientReq(req)
+	if err != nil {
+		return nil, err
+	}
+	nodeId = db.ClientAccountOf(nodeId)
+	found, oldEmail, newEmail, codeHash, sendTime := db.ClientGetNewContactEmail(nodeId)
+	if !found {
+		return nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	if newEmail == "" || codeHash == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no contact email change requested")
+	}
+	keys := []string{verifycode.NodeKey(nodeId), verifycode.EmailKey(newEmail)}
+	if verifycode.Locked(keys...) {
+		return nil, status.Error(codes.ResourceExhausted, "too many wrong verify codes, please try again later")
+	}
+	if !verifycode.Match(codeHash, nodeId, req.VerifyCode) {
+		verifycode.Fail(keys...)
+		return nil, status.Error(codes.InvalidArgument, "wrong verify code")
+	}
+	if time.Now().UTC().Sub(sendTime).Minutes() > 120 {
+		return nil, status.Error(codes.DeadlineExceeded, "verify code expired, please change contact email again")
+	}
+	verifycode.Succeed(keys...)
+	if db.ClientConfirmNewContactEmail(nodeId) {
+		return nil, status.Error(codes.AlreadyExists, "This Contact Email is already registered")
+	}
+	sendmail.SendTemplate(oldEmail, db.ClientGetLocale(nodeId), sendmail.TemplateAccount, &sendmail.AccountData{Event: "contact_email_changed", NewEmail: newEmail,
+		Time: sendmail.FormatTime(time.Now())})
+	return &pb.VerifyNewContactEmailResp{Success: true}, nil
 }
@@ -0,0 +1,131 @@
+// Package notify emails clients ahead of the end of their package and as they
+// use up its volume and netflow, instead of letting them find out by failed
+// uploads. Each threshold is sent once per package period, recorded in the
+// database so that the trackers don't send it again.
+package notify
+
+import (
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"nebula-tracker/register/sendmail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const kind_expiry = "expiry"
+
+const day = 24 * time.Hour
+
+// packages ended longer ago than this are left alone, so that enabling the
+// notice of expired packages does not mail every client ever expired
+const expired_lookback = day
+
+// notices are kept this long after the end of their package
+const notice_keep = 90 * day
+
+var runner *cronjob.Runner
+
+func StartAutoNotify() {
+	runner = cronjob.Start(config.GetTrackerConfig().Notify.CronSpec, "notify", notify)
+}
+
+func StopAutoNotify() {
+	runner.Stop()
+}
+
+func notify() {
+	conf := config.GetTrackerConfig().Notify
+	expiryDays := parseThresholds(conf.ExpiryDays)
+	usagePercents := parseThresholds(conf.UsagePercents)
+	now := time.Now()
+	for _, nc := range db.ClientNoticeCandidates(now.Add(-expired_lookback)) {
+		remaining := nc.EndTime.Sub(now)
+		if days, ok := expiryThreshold(expiryDays, remaining); ok && db.ClientNoticeRecord(nc.NodeId, kind_expiry, days, nc.EndTime) {
+			send(nc.ContactEmail, nc.Locale, sendmail.TemplateExpiry, &sendmail.ExpiryData{EndTime: sendmail.FormatTime(nc.EndTime), DaysLeft: daysLeft(remaining)})
+		}
+		if remaining <= 0 {
+			continue
+		}
+		for _, u := range []struct {
+			resource    string
+			used, total uint64
+		}{{"volume", nc.UsageVolume, nc.Volume},
+			{"netflow", nc.UsageNetflow, nc.Netflow},
+			{"up_netflow", nc.UsageUpNetflow, nc.UpNetflow},
+			{"down_netflow", nc.UsageDownNetflow, nc.DownNetflow}} {
+			if percent, ok := usageThreshold(usagePercents, u.used, u.total); ok && db.ClientNoticeRecord(nc.NodeId, u.resource, percent, nc.EndTime) {
+				send(nc.ContactEmail, nc.Locale, sendmail.TemplateQuota, &sendmail.QuotaData{Resource: u.resource, Used: u.used, Total: u.total, Percent: int(u.used * 100 / u.total)})
+			}
+		}
+	}
+	db.ClientNoticeClean(now.Add(-notice_keep))
+}
+
+func send(email string, locale string, template string, data interface{}) {
+	if err := sendmail.SendTemplate(email, locale, template, data); err != nil {
+		log.Warnf("send %s notice to %s failed: %s", template, email, err)
+	}
+}
+
+// parseThresholds parses the comma separated thresholds of the config, in
+// ascending order.
+func parseThresholds(str string) []int {
+	res := make([]int, 0, 4)
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			log.Warnf("invalid notify threshold %s in config", s)
+			continue
+		}
+		res = append(res, n)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// expiryThreshold returns the least days reached with the remaining time of
+// the package, only 0 is reached once it expired.
+func expiryThreshold(days []int, remaining time.Duration) (int, bool) {
+	for _, d := range days {
+		if remaining <= 0 {
+			if d == 0 {
+				return 0, true
+			}
+			continue
+		}
+		if d > 0 && remaining <= time.Duration(d)*day {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func daysLeft(remaining time.Duration) int {
+	if remaining <= 0 {
+		return 0
+	}
+	return int((remaining + day - 1) / day)
+}
+
+// usageThreshold returns the greatest percent reached with the usage.
+func usageThreshold(percents []int, used uint64, total uint64) (int, bool) {
+	if total == 0 {
+		return 0, false
+	}
+	usedPercent := used * 100 / total
+	for i := len(percents) - 1; i >= 0; i-- {
+		if percents[i] > 0 && uint64(percents[i]) <= usedPercent {
+			return percents[i], true
+		}
+	}
+	return 0, false
+}
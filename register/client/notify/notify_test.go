@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseThresholds(t *testing.T) {
+	if res := parseThresholds(" 7, 1,x,-2,,0"); !reflect.DeepEqual(res, []int{0, 1, 7}) {
+		t.Errorf("failed: %v", res)
+	}
+}
+
+func TestExpiryThreshold(t *testing.T) {
+	days := []int{1, 7}
+	if _, ok := expiryThreshold(days, 8*day); ok {
+		t.Error("8 days left should not be notified")
+	}
+	if d, ok := expiryThreshold(days, 6*day); !ok || d != 7 {
+		t.Errorf("failed: %d %t", d, ok)
+	}
+	if d, ok := expiryThreshold(days, 2*time.Hour); !ok || d != 1 {
+		t.Errorf("failed: %d %t", d, ok)
+	}
+	if _, ok := expiryThreshold(days, -time.Hour); ok {
+		t.Error("expired package should not be notified without threshold 0")
+	}
+	if d, ok := expiryThreshold([]int{0, 1, 7}, -time.Hour); !ok || d != 0 {
+		t.Errorf("failed: %d %t", d, ok)
+	}
+	if n := daysLeft(2 * time.Hour); n != 1 {
+		t.Errorf("failed: %d", n)
+	}
+	if n := daysLeft(6*day + time.Hour); n != 7 {
+		t.Errorf("failed: %d", n)
+	}
+}
+
+func TestUsageThreshold(t *testing.T) {
+	percents := []int{80, 95}
+	if _, ok := usageThreshold(percents, 79, 100); ok {
+		t.Error("79% should not be notified")
+	}
+	if p, ok := usageThreshold(percents, 90, 100); !ok || p != 80 {
+		t.Errorf("failed: %d %t", p, ok)
+	}
+	if p, ok := usageThreshold(percents, 120, 100); !ok || p != 95 {
+		t.Errorf("failed: %d %t", p, ok)
+	}
+	if _, ok := usageThreshold(percents, 10, 0); ok {
+		t.Error("no limit should not be notified")
+	}
+}
@@ -0,0 +1,45 @@
+// Package orderstate moves the client orders along their states: cancels the
+// ones left unpaid too long, and changes the paid ones to active and expired
+// as their periods begin and end.
+package orderstate
+
+import (
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var runner *cronjob.Runner
+
+func StartAutoOrderState() {
+	runner = cronjob.Start(config.GetTrackerConfig().OrderState.CronSpec, "order state", transit)
+}
+
+func StopAutoOrderState() {
+	runner.Stop()
+}
+
+func transit() {
+	conf := config.GetTrackerConfig().OrderState
+	createdBefore := time.Now().Add(-time.Duration(conf.UnpaidTimeoutHours) * time.Hour)
+	if cnt := inBatches(conf.BatchSize, func() int { return db.OrderCancelUnpaid(createdBefore, conf.BatchSize) }); cnt > 0 {
+		log.Infof("cancelled %d orders unpaid for %d hours", cnt, conf.UnpaidTimeoutHours)
+	}
+	inBatches(conf.BatchSize, func() int { return db.OrderActivate(conf.BatchSize) })
+	inBatches(conf.BatchSize, func() int { return db.OrderExpire(conf.BatchSize) })
+}
+
+// inBatches runs the batch till it changes less than batchSize orders, and
+// returns the count changed in all.
+func inBatches(batchSize int, batch func() int) (total int) {
+	for {
+		cnt := batch()
+		total += cnt
+		if cnt == 0 || cnt < batchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Package plan puts the packages clients downgraded to into service when the
+// packages they paid before end.
+package plan
+
+import (
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var runner *cronjob.Runner
+
+func StartAutoPlanChange() {
+	runner = cronjob.Start(config.GetTrackerConfig().PlanChange.CronSpec, "plan change", change)
+}
+
+func StopAutoPlanChange() {
+	runner.Stop()
+}
+
+func change() {
+	for _, nodeId := range db.ClientNextPackageDue() {
+		changeOne(nodeId)
+	}
+}
+
+func changeOne(nodeId string) {
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("plan change of client [%s] Panic Error: %s, detail: %s", nodeId, er, string(debug.Stack()))
+		}
+	}()
+	if oi := db.ClientApplyNextPackage(nodeId); oi != nil {
+		log.Infof("changed package of client [%s] to %d by order %x", nodeId, oi.PackageId, oi.Id)
+	}
+}
@@ -0,0 +1,66 @@
+// Package renew renews the packages of the clients turned auto renew on from
+// their balance shortly before the packages end, the same way as buying the
+// current package again and paying the order.
+package renew
+
+import (
+	"encoding/hex"
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"nebula-tracker/register/sendmail"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a failed renewal is notified once per package period
+const kind_renew_failed = "renew_failed"
+
+var runner *cronjob.Runner
+
+func StartAutoRenew() {
+	runner = cronjob.Start(config.GetTrackerConfig().AutoRenew.CronSpec, "renew", renew)
+}
+
+func StopAutoRenew() {
+	runner.Stop()
+}
+
+func renew() {
+	before := time.Duration(config.GetTrackerConfig().AutoRenew.BeforeHours) * time.Hour
+	for _, rc := range db.ClientAutoRenewDue(time.Now().Add(before)) {
+		renewOne(rc)
+	}
+}
+
+// renewOne renews the package of one client, a failure leaves the others to
+// be renewed.
+func renewOne(rc *db.RenewCandidate) {
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("renew client [%s] Panic Error: %s, detail: %s", rc.NodeId, er, string(debug.Stack()))
+		}
+	}()
+	result, oi, balance := db.ClientAutoRenew(rc.NodeId, rc.EndTime)
+	switch result {
+	case db.AutoRenewDone:
+		log.Infof("renewed package of client [%s] by order %x", rc.NodeId, oi.Id)
+		send(rc.ContactEmail, rc.Locale, &sendmail.OrderData{Event: "renewed", OrderId: hex.EncodeToString(oi.Id), Package: oi.Package.Name,
+			Quantity: oi.Quanlity, TotalAmount: oi.TotalAmount, Balance: balance, Time: sendmail.FormatTime(time.Now())})
+	case db.AutoRenewInsufficient:
+		if db.ClientNoticeRecord(rc.NodeId, kind_renew_failed, 0, rc.EndTime) {
+			send(rc.ContactEmail, rc.Locale, &sendmail.OrderData{Event: "renew_failed", Package: oi.Package.Name,
+				Quantity: oi.Quanlity, TotalAmount: oi.TotalAmount, Balance: oi.TotalAmount - balance, Time: sendmail.FormatTime(time.Now())})
+		}
+	case db.AutoRenewNoPackage:
+		log.Warnf("package of client [%s] is not sold any more, can not renew", rc.NodeId)
+	}
+}
+
+func send(email string, locale string, data *sendmail.OrderData) {
+	if err := sendmail.SendTemplate(email, locale, sendmail.TemplateOrder, data); err != nil {
+		log.Warnf("send renew notice to %s failed: %s", email, err)
+	}
+}
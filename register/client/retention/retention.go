@@ -0,0 +1,91 @@
+// Package retention carries the files of clients whose package ended through
+// the grace and frozen periods of the Retention config, emailing them as each
+// begins, and removes the files at the end so that their blocks can be
+// collected. Files are never removed before the frozen notice was sent a full
+// frozen period ago.
+package retention
+
+import (
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"nebula-tracker/register/sendmail"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const kind_retention = "retention"
+
+// a period is notified only if it began within this time, so that a change of
+// the config does not mail every client in the middle of one
+const notice_lookback = 48 * time.Hour
+
+var runner *cronjob.Runner
+
+func StartAutoRetention() {
+	runner = cronjob.Start(config.GetTrackerConfig().Retention.CronSpec, "retention", retain)
+}
+
+func StopAutoRetention() {
+	runner.Stop()
+}
+
+func retain() {
+	conf := config.GetTrackerConfig().Retention
+	grace, frozen := time.Duration(conf.GraceDays)*24*time.Hour, time.Duration(conf.FrozenDays)*24*time.Hour
+	now := time.Now()
+	for _, nc := range db.ClientNoticeCandidates(now.Add(-grace - frozen)) {
+		state := db.RetentionStateAt(nc.EndTime, now, grace, frozen)
+		var begin, until time.Time
+		var stateName string
+		switch state {
+		case db.RetentionGrace:
+			begin, until, stateName = nc.EndTime, nc.EndTime.Add(grace), "grace"
+		case db.RetentionFrozen:
+			begin, until, stateName = nc.EndTime.Add(grace), nc.EndTime.Add(grace+frozen), "frozen"
+		default:
+			continue
+		}
+		if now.Sub(begin) > notice_lookback || !db.ClientNoticeRecord(nc.NodeId, kind_retention, state, nc.EndTime) {
+			continue
+		}
+		send(nc.ContactEmail, nc.Locale, &sendmail.RetentionData{State: stateName, EndTime: sendmail.FormatTime(nc.EndTime), Until: sendmail.FormatTime(until)})
+	}
+	endBefore := now.Add(-grace - frozen)
+	// the files are removed a full frozen period after the frozen notice, those
+	// whose package ended before it could be sent are noticed now
+	for {
+		rcs := db.ClientRetentionUnnoticed(endBefore, kind_retention, conf.BatchSize)
+		for _, rc := range rcs {
+			if db.ClientNoticeRecord(rc.NodeId, kind_retention, db.RetentionFrozen, rc.EndTime) {
+				send(rc.ContactEmail, rc.Locale, &sendmail.RetentionData{State: "frozen", EndTime: sendmail.FormatTime(rc.EndTime), Until: sendmail.FormatTime(now.Add(frozen))})
+			}
+		}
+		if len(rcs) == 0 || len(rcs) < conf.BatchSize {
+			break
+		}
+	}
+	for {
+		rcs := db.ClientRetentionExpired(endBefore, kind_retention, now.Add(-frozen), conf.BatchSize)
+		for _, rc := range rcs {
+			removed, contactEmail, endTime := db.ClientRetentionRemove(rc.NodeId, endBefore)
+			if !removed {
+				continue
+			}
+			log.Infof("removed files of client [%s], package ended at %s", rc.NodeId, endTime)
+			if db.ClientNoticeRecord(rc.NodeId, kind_retention, db.RetentionRemoved, endTime) {
+				send(contactEmail, rc.Locale, &sendmail.RetentionData{State: "removed", EndTime: sendmail.FormatTime(endTime)})
+			}
+		}
+		if len(rcs) == 0 || len(rcs) < conf.BatchSize {
+			break
+		}
+	}
+}
+
+func send(email string, locale string, data *sendmail.RetentionData) {
+	if err := sendmail.SendTemplate(email, locale, sendmail.TemplateRetention, data); err != nil {
+		log.Warnf("send retention notice to %s failed: %s", email, err)
+	}
+}
@@ -0,0 +1,154 @@
+// Package discovery tells nodes which trackers and collectors to talk to, from
+// the TRACKER table and the configured servers, leaving out the ones failing
+// health checks.
+//
+// A node is sent the servers of its own network first, by the key of the
+// failure domain db of the provider chooser, which is the autonomous system
+// number rather than a geographic region. The load of the servers is not
+// measured, they are spread by their static weight only.
+package discovery
+
+import (
+	"fmt"
+	"math/rand"
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	chooser "nebula-tracker/metadata/provider_chooser"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const default_weight = 100
+
+const health_check_timeout = 2 * time.Second
+
+var runner *cronjob.Runner
+
+var healthy atomic.Value
+
+func StartAutoUpdate() {
+	runner = cronjob.New()
+	runner.Run("update servers", update)
+	runner.Add("30 * * * * *", "update servers", update)
+	runner.Start()
+}
+
+func StopAutoUpdate() {
+	runner.Stop()
+}
+
+func update() {
+	conf := config.GetTrackerConfig().Discovery
+	all := db.ServerFindAll()
+	all = append(all, parseServers(conf.Trackers, db.ServerCategoryTracker)...)
+	all = append(all, parseServers(conf.Collectors, db.ServerCategoryCollector)...)
+	healthy.Store(check(all))
+}
+
+// parseServers parses the comma separated host:port of the config.
+func parseServers(str string, category string) []*db.ServerInfo {
+	res := make([]*db.ServerInfo, 0, 4)
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(s)
+		if err != nil {
+			log.Warnf("invalid %s server %s in config: %s", category, s, err)
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 32)
+		if err != nil {
+			log.Warnf("invalid %s server %s in config: %s", category, s, err)
+			continue
+		}
+		res = append(res, &db.ServerInfo{Server: host, Port: uint32(port), Category: category, Weight: default_weight})
+	}
+	return res
+}
+
+// check returns the servers accepting tcp connections.
+func check(all []*db.ServerInfo) []*db.ServerInfo {
+	ok := make([]bool, len(all))
+	var wg sync.WaitGroup
+	for i, si := range all {
+		wg.Add(1)
+		go func(i int, si *db.ServerInfo) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", si.Server, si.Port), health_check_timeout)
+			if err != nil {
+				log.Warnf("%s server %s:%d unhealthy: %s", si.Category, si.Server, si.Port, err)
+				return
+			}
+			conn.Close()
+			ok[i] = true
+		}(i, si)
+	}
+	wg.Wait()
+	res := make([]*db.ServerInfo, 0, len(all))
+	for i, si := range all {
+		if ok[i] {
+			res = append(res, si)
+		}
+	}
+	return res
+}
+
+// Servers returns at most max healthy servers of the category for a node
+// connecting from ip, the ones of its ASN first, each group in random order
+// weighted by the server weight.
+func Servers(category string, ip string) []*db.ServerInfo {
+	all, _ := healthy.Load().([]*db.ServerInfo)
+	candidates := make([]*db.ServerInfo, 0, len(all))
+	for _, si := range all {
+		if si.Category == category {
+			candidates = append(candidates, si)
+		}
+	}
+	return order(candidates, chooser.Asn(ip), config.GetTrackerConfig().Discovery.MaxServers)
+}
+
+func order(servers []*db.ServerInfo, asn string, max int) []*db.ServerInfo {
+	local := make([]*db.ServerInfo, 0, len(servers))
+	other := make([]*db.ServerInfo, 0, len(servers))
+	for _, si := range servers {
+		if len(asn) > 0 && si.Asn == asn {
+			local = append(local, si)
+		} else {
+			other = append(other, si)
+		}
+	}
+	res := append(weightedShuffle(local), weightedShuffle(other)...)
+	if len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+func weightedShuffle(servers []*db.ServerInfo) []*db.ServerInfo {
+	res := make([]*db.ServerInfo, 0, len(servers))
+	left := append([]*db.ServerInfo(nil), servers...)
+	sum := 0
+	for _, si := range left {
+		sum += si.Weight
+	}
+	for len(left) > 0 {
+		r := rand.Intn(sum)
+		i := 0
+		for ; r >= left[i].Weight; i++ {
+			r -= left[i].Weight
+		}
+		res = append(res, left[i])
+		sum -= left[i].Weight
+		left = append(left[:i], left[i+1:]...)
+	}
+	return res
+}
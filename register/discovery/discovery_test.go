@@ -0,0 +1,45 @@
+package discovery
+
+import (
+	"nebula-tracker/db"
+	"testing"
+)
+
+func TestParseServers(t *testing.T) {
+	res := parseServers(" 10.0.0.1:6677,bad, tracker.samos.io:6677,,10.0.0.2:x", db.ServerCategoryTracker)
+	if len(res) != 2 {
+		t.Fatalf("failed: %d", len(res))
+	}
+	if res[0].Server != "10.0.0.1" || res[0].Port != 6677 || res[1].Server != "tracker.samos.io" || res[1].Weight != default_weight {
+		t.Errorf("failed: %+v %+v", res[0], res[1])
+	}
+}
+
+func TestOrder(t *testing.T) {
+	servers := []*db.ServerInfo{&db.ServerInfo{Server: "a", Asn: "4134", Weight: 1},
+		&db.ServerInfo{Server: "b", Asn: "7018", Weight: 1},
+		&db.ServerInfo{Server: "c", Asn: "4134", Weight: 1},
+		&db.ServerInfo{Server: "d", Weight: 1}}
+	for i := 0; i < 20; i++ {
+		res := order(servers, "4134", 3)
+		if len(res) != 3 || res[0].Asn != "4134" || res[1].Asn != "4134" {
+			t.Errorf("failed: %s %s %s", res[0].Server, res[1].Server, res[2].Server)
+		}
+	}
+	if res := order(servers, "", 10); len(res) != 4 {
+		t.Errorf("failed: %d", len(res))
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	servers := []*db.ServerInfo{&db.ServerInfo{Server: "a", Weight: 1}, &db.ServerInfo{Server: "b", Weight: 99}}
+	first := 0
+	for i := 0; i < 1000; i++ {
+		if weightedShuffle(servers)[0].Server == "b" {
+			first++
+		}
+	}
+	if first < 900 {
+		t.Errorf("failed: %d", first)
+	}
+}
@@ -0,0 +1,111 @@
+// Package billing computes the earnings of providers per day, from the bytes
+// stored on them over time and the traffic they served, scaled by their
+// availability, and pays them out in batches executed by the teller.
+//
+// There are no proof of storage results yet, the availability measured by the
+// probes of the provider chooser only shows a provider is online, not that it
+// keeps the blocks. Earnings are therefore only accrued, no payout batch is
+// created unless Billing.PayoutEnabled is set.
+package billing
+
+import (
+	"math"
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"nebula-tracker/register/provider/uptime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const period = 24 * time.Hour
+
+// the periods computed at most in one run when catching up
+const max_catch_up = 30
+
+const tb_day = 1e12 * 24
+
+const gb = 1e9
+
+var runner *cronjob.Runner
+
+func StartAutoBill() {
+	conf := config.GetTrackerConfig().Billing
+	runner = cronjob.New()
+	runner.Add(conf.CronSpec, "bill", bill)
+	runner.Add(conf.PayoutCronSpec, "payout", payout)
+	runner.Start()
+}
+
+func StopAutoBill() {
+	runner.Stop()
+}
+
+// bill computes the earnings of every period ended since the last one computed.
+func bill() {
+	conf := config.GetTrackerConfig().Billing
+	now := time.Now().UTC().Truncate(period)
+	start := now.Add(-period)
+	if found, end := db.ProviderEarningLastEnd(); found && end.Before(start) {
+		start = end
+		if now.Sub(start) > max_catch_up*period {
+			start = now.Add(-max_catch_up * period)
+		}
+	}
+	for ; start.Before(now); start = start.Add(period) {
+		earnings := compute(&conf, start, start.Add(period))
+		db.ProviderSaveEarnings(earnings)
+		log.Infof("computed earnings of %d providers for period from %s", len(earnings), start.Format("2006-01-02"))
+	}
+}
+
+func compute(conf *config.Billing, start time.Time, end time.Time) []*db.ProviderEarning {
+	byteHours := db.ProviderByteHours(start, end)
+	traffic := db.ProviderRetrieveTraffic(conf.CollectorDbName, start, end)
+	uptimes := db.ProviderUptimesBetween(start, end)
+	nodeIds := make(map[string]bool, len(byteHours)+len(traffic))
+	for nodeId := range byteHours {
+		nodeIds[nodeId] = true
+	}
+	for nodeId := range traffic {
+		nodeIds[nodeId] = true
+	}
+	res := make([]*db.ProviderEarning, 0, len(nodeIds))
+	for nodeId := range nodeIds {
+		availability := 1.0
+		if us, ok := uptimes[nodeId]; ok {
+			availability = uptime.Availability(us.Success, us.Fail)
+		}
+		pe := &db.ProviderEarning{NodeId: nodeId,
+			Kind:         db.EarningKindPeriod,
+			PeriodStart:  start,
+			PeriodEnd:    end,
+			ByteHours:    byteHours[nodeId],
+			Traffic:      traffic[nodeId],
+			Availability: availability}
+		pe.Amount, pe.Held = earning(conf, pe.ByteHours, pe.Traffic, availability)
+		res = append(res, pe)
+	}
+	return res
+}
+
+// earning returns the amount earned and the part of it held back.
+func earning(conf *config.Billing, byteHours float64, traffic uint64, availability float64) (amount uint64, held uint64) {
+	value := byteHours/tb_day*float64(conf.StoragePricePerTbDay) + float64(traffic)/gb*float64(conf.TrafficPricePerGb)
+	amount = uint64(math.Floor(value * availability))
+	held = amount * uint64(conf.HoldbackPercent) / 100
+	return
+}
+
+func payout() {
+	conf := config.GetTrackerConfig().Billing
+	if !conf.PayoutEnabled {
+		log.Info("payout skipped, it is not enabled until earnings are backed by proof of storage")
+		return
+	}
+	batchId, payouts := db.ProviderCreatePayoutBatch(uint64(conf.MinPayout), time.Now())
+	if len(payouts) > 0 {
+		log.Infof("created payout batch %s of %d providers", batchId, len(payouts))
+	}
+}
@@ -0,0 +1,23 @@
+package billing
+
+import (
+	"nebula-tracker/config"
+	"testing"
+)
+
+func TestEarning(t *testing.T) {
+	conf := &config.Billing{StoragePricePerTbDay: 1000000, TrafficPricePerGb: 100000, HoldbackPercent: 25}
+	// 1TB stored a whole day and 10GB served
+	amount, held := earning(conf, 1e12*24, 10*1e9, 1)
+	if amount != 2000000 || held != 500000 {
+		t.Errorf("failed: %d %d", amount, held)
+	}
+	amount, held = earning(conf, 1e12*24, 10*1e9, 0.5)
+	if amount != 1000000 || held != 250000 {
+		t.Errorf("failed: %d %d", amount, held)
+	}
+	amount, held = earning(conf, 0, 0, 1)
+	if amount != 0 || held != 0 {
+		t.Errorf("failed: %d %d", amount, held)
+	}
+}
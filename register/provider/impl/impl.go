@@ -5,12 +5,19 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"nebula-tracker/config"
 	"nebula-tracker/db"
-	"nebula-tracker/register/random"
+	chooser "nebula-tracker/metadata/provider_chooser"
+	"nebula-tracker/register/discovery"
+	"nebula-tracker/register/provider/speedtest"
+	"nebula-tracker/register/provider/uptime"
 	"nebula-tracker/register/sendmail"
+	"nebula-tracker/register/verifycode"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -111,7 +118,6 @@ func (self *ProviderRegisterService) Register(ctx context.Context, req *pb.Regis
 	if err != nil {
 		return &pb.RegisterResp{Code: 11, ErrMsg: "decrypt BillEmailEnc error: " + err.Error()}, nil
 	}
-	email_re := regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 	if !email_re.MatchString(string(billEmail)) {
 		return &pb.RegisterResp{Code: 12, ErrMsg: "Bill Email is invalid."}, nil
 	}
@@ -175,6 +181,22 @@ func (self *ProviderRegisterService) Register(ctx context.Context, req *pb.Regis
 	if err != nil {
 		return &pb.RegisterResp{Code: 27, ErrMsg: "ping failed, error: " + err.Error()}, nil
 	}
+	measuredUp, measuredDown, err := speedtest.Measure(&db.ProviderInfo{NodeId: nodeIdStr, PublicKey: publicKey, Port: req.Port, Host: string(host), DynamicDomain: string(dynamicDomain)})
+	if err != nil {
+		return &pb.RegisterResp{Code: 29, ErrMsg: "speed test failed, error: " + err.Error()}, nil
+	}
+	stConf := config.GetTrackerConfig().SpeedTest
+	if measuredUp < uint64(stConf.MinUpBandwidth) {
+		return &pb.RegisterResp{Code: 30, ErrMsg: fmt.Sprintf("measured upload bandwidth %d is too low", measuredUp)}, nil
+	}
+	if measuredDown < uint64(stConf.MinDownBandwidth) {
+		return &pb.RegisterResp{Code: 31, ErrMsg: fmt.Sprintf("measured download bandwidth %d is too low", measuredDown)}, nil
+	}
+	if chooser.Misreported(&db.ProviderInfo{UpBandwidth: req.UpBandwidth, DownBandwidth: req.DownBandwidth,
+		MeasuredUpBandwidth: measuredUp, MeasuredDownBandwidth: measuredDown}) {
+		return &pb.RegisterResp{Code: 32, ErrMsg: fmt.Sprintf("measured bandwidth %d up and %d down is far below the declared %d up and %d down",
+			measuredUp, measuredDown, req.UpBandwidth, req.DownBandwidth)}, nil
+	}
 	storageVolume := []uint64{req.MainStorageVolume}
 	if req.ExtraStorageVolume != nil && len(req.ExtraStorageVolume) > 0 {
 		storageVolume = make([]uint64, 1, 1+len(req.ExtraStorageVolume))
@@ -183,10 +205,11 @@ func (self *ProviderRegisterService) Register(ctx context.Context, req *pb.Regis
 			storageVolume[i+1] = v
 		}
 	}
-	randomCode := random.RandomStr(8)
+	randomCode, codeHash := verifycode.New(nodeIdStr)
 	db.ProviderRegister(nodeIdStr, publicKey, pubKey, string(billEmail), encryptKey, string(walletAddress), storageVolume, req.UpBandwidth,
 		req.DownBandwidth, req.TestUpBandwidth, req.TestDownBandwidth, req.Availability,
-		req.Port, string(host), string(dynamicDomain), randomCode)
+		req.Port, string(host), string(dynamicDomain), codeHash)
+	db.ProviderSaveMeasuredBandwidth(nodeIdStr, measuredUp, measuredDown)
 	self.sendVerifyCodeToBillEmail(nodeIdStr, string(billEmail), randomCode)
 	return &pb.RegisterResp{Code: 0}, nil
 }
@@ -199,18 +222,49 @@ func pingProvider(client provider_pb.ProviderServiceClient) error {
 }
 
 func (self *ProviderRegisterService) sendVerifyCodeToBillEmail(nodeId string, email string, randomCode string) {
-	sendmail.Send(email, "Nebula Provider Register Bill Email Verify Code", fmt.Sprintf("verify code is %s, sent at %s",
-		randomCode, time.Now().UTC().Format("2006-01-02 15:04:05 UTC")))
+	sendmail.SendTemplate(email, "", sendmail.TemplateVerifyCode, &sendmail.VerifyCodeData{Purpose: sendmail.PurposeBillEmail, Code: randomCode,
+		Time: sendmail.FormatTime(time.Now())})
 }
 
-func (self *ProviderRegisterService) reGenerateVerifyCode(nodeId string, email string) {
-	randomCode := random.RandomStr(8)
-	db.ProviderUpdateVerifyCode(nodeId, randomCode)
+// reGenerateVerifyCode sends a new verify code unless one was sent just now.
+func (self *ProviderRegisterService) reGenerateVerifyCode(nodeId string, email string) bool {
+	if !verifycode.MaySend(verifycode.NodeKey(nodeId), verifycode.EmailKey(email)) {
+		return false
+	}
+	randomCode, codeHash := verifycode.New(nodeId)
+	db.ProviderUpdateVerifyCode(nodeId, codeHash)
 	self.sendVerifyCodeToBillEmail(nodeId, email, randomCode)
+	return true
 }
 
 const verify_sign_expired = 15
 
+// signedReq is a request signed by the provider it is sent from.
+type signedReq interface {
+	GetNodeId() []byte
+	GetTimestamp() uint64
+	VerifySign(pubKey *rsa.PublicKey) error
+}
+
+// verifyProviderReq checks the request is recent and signed by the registered
+// provider it names, and returns the node id of the provider.
+func verifyProviderReq(req signedReq) (string, error) {
+	pubKey := db.ProviderGetPubKey(req.GetNodeId())
+	if pubKey == nil {
+		return "", status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	interval := time.Now().Unix() - int64(req.GetTimestamp())
+	if interval > verify_sign_expired || interval < 0-verify_sign_expired {
+		return "", status.Error(codes.Unauthenticated, "auth info expired， please check your system time")
+	}
+	if err := req.VerifySign(pubKey); err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "verify sign failed， error: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(req.GetNodeId()), nil
+}
+
+var email_re = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
 func (self *ProviderRegisterService) VerifyBillEmail(ctx context.Context, req *pb.VerifyBillEmailReq) (*pb.VerifyBillEmailResp, error) {
 	if req.NodeId == nil {
 		return &pb.VerifyBillEmailResp{Code: 2, ErrMsg: "NodeId is required"}, nil
@@ -237,14 +291,21 @@ func (self *ProviderRegisterService) VerifyBillEmail(ctx context.Context, req *p
 	if emailVerified {
 		return &pb.VerifyBillEmailResp{Code: 7, ErrMsg: "already verified contact email"}, nil
 	}
-	if req.VerifyCode != randomCode {
-		self.reGenerateVerifyCode(nodeIdStr, billEmail)
-		return &pb.VerifyBillEmailResp{Code: 8, ErrMsg: "wrong verified code, will send verify email again"}, nil
+	keys := []string{verifycode.NodeKey(nodeIdStr), verifycode.EmailKey(billEmail)}
+	if verifycode.Locked(keys...) {
+		return &pb.VerifyBillEmailResp{Code: 11, ErrMsg: "too many wrong verify codes, please try again later"}, nil
+	}
+	if !verifycode.Match(randomCode, nodeIdStr, req.VerifyCode) {
+		verifycode.Fail(keys...)
+		return &pb.VerifyBillEmailResp{Code: 8, ErrMsg: "wrong verified code"}, nil
 	}
 	if subM := time.Now().Sub(sendTime).Minutes(); subM > 120 {
-		self.reGenerateVerifyCode(nodeIdStr, billEmail)
-		return &pb.VerifyBillEmailResp{Code: 9, ErrMsg: "verify code expired, will send verify email again"}, nil
+		if self.reGenerateVerifyCode(nodeIdStr, billEmail) {
+			return &pb.VerifyBillEmailResp{Code: 9, ErrMsg: "verify code expired, will send verify email again"}, nil
+		}
+		return &pb.VerifyBillEmailResp{Code: 9, ErrMsg: "verify code expired, please resend verify code later"}, nil
 	}
+	verifycode.Succeed(keys...)
 	db.ProviderUpdateEmailVerified(nodeIdStr)
 	return &pb.VerifyBillEmailResp{Code: 0}, nil
 }
@@ -269,7 +330,9 @@ func (self *ProviderRegisterService) ResendVerifyCode(ctx context.Context, req *
 	if emailVerified {
 		return nil, status.Error(codes.AlreadyExists, "already verified！")
 	}
-	self.reGenerateVerifyCode(nodeIdStr, billEmail)
+	if !self.reGenerateVerifyCode(nodeIdStr, billEmail) {
+		return nil, status.Error(codes.ResourceExhausted, "verify code sent just now, please try again later")
+	}
 	return &pb.ResendVerifyCodeResp{Success: true}, nil
 }
 
@@ -294,13 +357,29 @@ func (self *ProviderRegisterService) AddExtraStorage(ctx context.Context, req *p
 }
 
 func (self *ProviderRegisterService) GetTrackerServer(ctx context.Context, req *pb.GetTrackerServerReq) (*pb.GetTrackerServerResp, error) {
-	// TODO
-	return nil, nil
+	if _, err := verifyProviderReq(req); err != nil {
+		return nil, err
+	}
+	ip, _ := getClientIp(ctx)
+	servers := discovery.Servers(db.ServerCategoryTracker, ip)
+	resp := &pb.GetTrackerServerResp{Server: make([]*pb.TrackerServer, 0, len(servers))}
+	for _, si := range servers {
+		resp.Server = append(resp.Server, &pb.TrackerServer{Server: si.Server, Port: si.Port})
+	}
+	return resp, nil
 }
 
 func (self *ProviderRegisterService) GetCollectorServer(ctx context.Context, req *pb.GetCollectorServerReq) (*pb.GetCollectorServerResp, error) {
-	// TODO
-	return nil, nil
+	if _, err := verifyProviderReq(req); err != nil {
+		return nil, err
+	}
+	ip, _ := getClientIp(ctx)
+	servers := discovery.Servers(db.ServerCategoryCollector, ip)
+	resp := &pb.GetCollectorServerResp{Server: make([]*pb.CollectorServer, 0, len(servers))}
+	for _, si := range servers {
+		resp.Server = append(resp.Server, &pb.CollectorServer{Server: si.Server, Port: si.Port})
+	}
+	return resp, nil
 }
 
 func (self *ProviderRegisterService) RefreshIp(ctx context.Context, req *pb.RefreshIpReq) (*pb.RefreshIpResp, error) {
@@ -339,3 +418,256 @@ func (self *ProviderRegisterService) RefreshIp(ctx context.Context, req *pb.Refr
 		return &pb.RefreshIpResp{}, nil
 	}
 }
+
+const heartbeat_max_endpoints = 8
+
+func (self *ProviderRegisterService) Heartbeat(ctx context.Context, req *pb.HeartbeatReq) (*pb.HeartbeatResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.ProviderVersion) > 32 {
+		return nil, status.Error(codes.InvalidArgument, "provider version is too long")
+	}
+	if len(req.Endpoint) > heartbeat_max_endpoints {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d endpoints", heartbeat_max_endpoints)
+	}
+	for _, ep := range req.Endpoint {
+		if err := checkEndpoint(ep); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid endpoint %s， error: %s", ep, err)
+		}
+	}
+	hb := &db.ProviderHeartbeat{NodeId: nodeIdStr,
+		FreeVolume:   req.FreeVolume,
+		UsedVolume:   req.UsedVolume,
+		MaxFileSize:  req.MaxFileSize,
+		Version:      req.ProviderVersion,
+		Endpoints:    req.Endpoint,
+		LastModified: time.Now().UTC()}
+	db.ProviderSaveHeartbeat(hb)
+	chooser.Heartbeat(hb)
+	return &pb.HeartbeatResp{IntervalSec: uint32(config.GetTrackerConfig().Chooser.HeartbeatIntervalSec)}, nil
+}
+
+func checkEndpoint(ep string) error {
+	if len(ep) > 64 {
+		return errors.New("too long")
+	}
+	host, portStr, err := net.SplitHostPort(ep)
+	if err != nil {
+		return err
+	}
+	if len(host) == 0 {
+		return errors.New("host is required")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("port must between 1 to 65535")
+	}
+	return nil
+}
+
+func (self *ProviderRegisterService) GetUptimeStats(ctx context.Context, req *pb.GetUptimeStatsReq) (*pb.GetUptimeStatsResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	_, declared := db.ProviderGetAvailability(nodeIdStr)
+	stats := uptime.Stats(nodeIdStr, time.Now())
+	resp := &pb.GetUptimeStatsResp{DeclaredAvailability: declared, Stat: make([]*pb.UptimeStat, 0, len(stats))}
+	for _, st := range stats {
+		resp.Stat = append(resp.Stat, &pb.UptimeStat{Days: st.Days, Success: st.Success, Fail: st.Fail, Availability: st.Availability})
+	}
+	if st := uptime.SlaStat(stats); st != nil {
+		resp.Breached = uptime.Breached(declared, st.Success, st.Fail)
+	}
+	return resp, nil
+}
+
+// payouts go to a changed wallet address only after this, leaving the owner
+// time to notice a change made with a stolen key
+const wallet_cooling_off = 72 * time.Hour
+
+func (self *ProviderRegisterService) UpdateProfile(ctx context.Context, req *pb.UpdateProfileReq) (*pb.UpdateProfileResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	pi := db.ProviderFindOne(nodeIdStr)
+	if pi == nil {
+		return nil, status.Error(codes.InvalidArgument, "this node id is not been registered")
+	}
+	var walletAddress, billEmail []byte
+	if len(req.WalletAddressEnc) > 0 {
+		if walletAddress, err = self.decrypt(req.WalletAddressEnc); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "decrypt WalletAddressEnc error: %s", err)
+		}
+		if len(walletAddress) == 0 || len(walletAddress) > 64 {
+			return nil, status.Error(codes.InvalidArgument, "wallet address is invalid")
+		}
+	}
+	if len(req.BillEmailEnc) > 0 {
+		if billEmail, err = self.decrypt(req.BillEmailEnc); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "decrypt BillEmailEnc error: %s", err)
+		}
+		if !email_re.MatchString(string(billEmail)) {
+			return nil, status.Error(codes.InvalidArgument, "Bill Email is invalid.")
+		}
+	}
+	bandwidthChanged := req.UpBandwidth > 0 || req.DownBandwidth > 0 || req.TestUpBandwidth > 0 || req.TestDownBandwidth > 0
+	if bandwidthChanged {
+		if req.UpBandwidth < 1000000 || req.TestUpBandwidth < 500000 {
+			return nil, status.Error(codes.OutOfRange, "upload bandwidth is too low")
+		}
+		if req.DownBandwidth < 4000000 || req.TestDownBandwidth < 2000000 {
+			return nil, status.Error(codes.OutOfRange, "download bandwidth is too low")
+		}
+	}
+	addressChanged := req.Port > 0 || len(req.HostEnc) > 0 || len(req.DynamicDomainEnc) > 0
+	// a field not given keeps its current value
+	host, dynamicDomain := []byte(pi.Host), []byte(pi.DynamicDomain)
+	port := pi.Port
+	if addressChanged {
+		if req.Port > 65535 {
+			return nil, status.Error(codes.OutOfRange, "port must between 1 to 65535.")
+		}
+		if req.Port > 0 {
+			port = req.Port
+		}
+		if len(req.HostEnc) > 0 {
+			if host, err = self.decrypt(req.HostEnc); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "decrypt HostEnc error: %s", err)
+			}
+		}
+		if len(req.DynamicDomainEnc) > 0 {
+			if dynamicDomain, err = self.decrypt(req.DynamicDomainEnc); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "decrypt DynamicDomainEnc error: %s", err)
+			}
+		}
+		if len(host) == 0 && len(dynamicDomain) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "host or dynamic domain is required")
+		}
+		addr := fmt.Sprintf("%s:%d", db.ProviderInfo{Host: string(host), DynamicDomain: string(dynamicDomain)}.Server(), port)
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "can not connect to %s, error: %s", addr, err)
+		}
+		defer conn.Close()
+		if err = pingProvider(provider_pb.NewProviderServiceClient(conn)); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "ping %s failed, error: %s", addr, err)
+		}
+	}
+	resp := &pb.UpdateProfileResp{}
+	if addressChanged {
+		db.ProviderUpdateAddress(nodeIdStr, port, string(host), string(dynamicDomain))
+		chooser.Reload()
+	}
+	if bandwidthChanged {
+		db.ProviderUpdateBandwidth(nodeIdStr, req.UpBandwidth, req.DownBandwidth, req.TestUpBandwidth, req.TestDownBandwidth)
+	}
+	if len(walletAddress) > 0 && string(walletAddress) != db.ProviderWalletAddressAt(nodeIdStr, time.Now()) {
+		effective := time.Now().Add(wallet_cooling_off)
+		db.ProviderChangeWalletAddress(nodeIdStr, string(walletAddress), effective)
+		resp.WalletEffectiveTime = uint64(effective.Unix())
+	}
+	if len(billEmail) > 0 && string(billEmail) != pi.BillEmail {
+		randomCode, codeHash := verifycode.New(nodeIdStr)
+		db.ProviderChangeBillEmail(nodeIdStr, string(billEmail), codeHash)
+		// within the cooldown the code is kept unsent, ResendVerifyCode sends a new one later
+		if verifycode.MaySend(verifycode.NodeKey(nodeIdStr), verifycode.EmailKey(string(billEmail))) {
+			self.sendVerifyCodeToBillEmail(nodeIdStr, string(billEmail), randomCode)
+		}
+		resp.BillEmailVerifyRequired = true
+	}
+	return resp, nil
+}
+
+func (self *ProviderRegisterService) ListStorageVolume(ctx context.Context, req *pb.ListStorageVolumeReq) (*pb.StorageVolumeResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	_, volumes := db.ProviderGetStorageVolume(nodeIdStr)
+	return storageVolumeResp(nodeIdStr, volumes), nil
+}
+
+func (self *ProviderRegisterService) ResizeStorageVolume(ctx context.Context, req *pb.ResizeStorageVolumeReq) (*pb.StorageVolumeResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Volume <= 10000000000 {
+		return nil, status.Error(codes.OutOfRange, "storage volume must more than 10G")
+	}
+	volumes, err := db.ProviderResizeStorageVolume(nodeIdStr, int(req.Index), req.Volume)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	chooser.Reload()
+	return storageVolumeResp(nodeIdStr, volumes), nil
+}
+
+func (self *ProviderRegisterService) RemoveStorageVolume(ctx context.Context, req *pb.RemoveStorageVolumeReq) (*pb.StorageVolumeResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := db.ProviderRemoveStorageVolume(nodeIdStr, int(req.Index))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	chooser.Reload()
+	return storageVolumeResp(nodeIdStr, volumes), nil
+}
+
+// storageVolumeResp reports the volumes with the usage, the blocks over the
+// declared volume are migrated by the repair job.
+func storageVolumeResp(nodeId string, volumes []uint64) *pb.StorageVolumeResp {
+	resp := &pb.StorageVolumeResp{Volume: volumes}
+	if su := db.ProviderStorageUsage(nodeId); su != nil {
+		resp.Declared, resp.Used = su.Declared, su.Used
+	}
+	return resp
+}
+
+// Exit starts the graceful exit of the provider, no more blocks are placed on
+// it and the stored ones migrate to other providers. Calling it again reports
+// the progress.
+func (self *ProviderRegisterService) Exit(ctx context.Context, req *pb.ExitReq) (*pb.ExitResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	_, st := db.ProviderGetStatus(nodeIdStr)
+	if st != db.ProviderStatusExiting {
+		if _, err := db.ProviderChangeStatus(nodeIdStr, db.ProviderStatusExiting, "provider", "graceful exit"); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		chooser.Exclude(nodeIdStr)
+	}
+	count, size := db.BlockRemainingOnProvider(nodeIdStr)
+	return &pb.ExitResp{RemainingBlocks: count, RemainingBytes: size}, nil
+}
+
+const stats_days = 7
+
+func (self *ProviderRegisterService) ProviderStats(ctx context.Context, req *pb.ProviderStatsReq) (*pb.ProviderStatsResp, error) {
+	nodeIdStr, err := verifyProviderReq(req)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().Add(-stats_days * 24 * time.Hour)
+	resp := &pb.ProviderStatsResp{Days: stats_days}
+	resp.Blocks, resp.Bytes = db.BlockRemainingOnProvider(nodeIdStr)
+	success, fail := db.ProviderUptimeSince(nodeIdStr, since)
+	resp.Probes, resp.FailedProbes = success+fail, fail
+	resp.Availability = uptime.Availability(success, fail)
+	as := db.ProviderActionStatsSince(config.GetTrackerConfig().Billing.CollectorDbName, nodeIdStr, since)
+	resp.StoreSuccess, resp.StoreFail, resp.StoreTraffic = as.StoreSuccess, as.StoreFail, as.StoreTraffic
+	resp.RetrieveSuccess, resp.RetrieveFail, resp.RetrieveTraffic = as.RetrieveSuccess, as.RetrieveFail, as.RetrieveTraffic
+	resp.Available, resp.SelectionShare, resp.BandwidthRank = chooser.Share(nodeIdStr)
+	resp.Earned, resp.Held, resp.Paid = db.ProviderEarningSummary(nodeIdStr)
+	// there are no proof of storage audits yet
+	resp.AuditMeasured, resp.AuditPassRate = false, 0
+	return resp, nil
+}
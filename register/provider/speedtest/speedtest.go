@@ -0,0 +1,64 @@
+// Package speedtest measures the bandwidth of providers by pushing a test
+// payload to them and pulling it back through Store and Retrieve, at register
+// and periodically afterwards.
+package speedtest
+
+import (
+	"crypto/rand"
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	chooser "nebula-tracker/metadata/provider_chooser"
+	client "nebula-tracker/metadata/provider_client"
+	"runtime/debug"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Measure runs a speed test against the provider, returning the measured
+// bandwidth in bits per second.
+func Measure(pi *db.ProviderInfo) (up uint64, down uint64, err error) {
+	conf := config.GetTrackerConfig().SpeedTest
+	payload := make([]byte, conf.PayloadSize)
+	if _, err = rand.Read(payload); err != nil {
+		return
+	}
+	return client.SpeedTest(pi, payload, time.Duration(conf.TimeoutSec)*time.Second)
+}
+
+var runner *cronjob.Runner
+
+func StartAutoTest() {
+	runner = cronjob.Start(config.GetTrackerConfig().SpeedTest.CronSpec, "speed test", testAll)
+}
+
+func StopAutoTest() {
+	runner.Stop()
+}
+
+// testAll tests the providers one after another, running them concurrently
+// would measure the link of the tracker instead.
+func testAll() {
+	for _, pi := range db.ProviderFindAll() {
+		test(&pi)
+	}
+}
+
+func test(pi *db.ProviderInfo) {
+	defer func() {
+		if er := recover(); er != nil {
+			log.Errorf("speed test provider [%s] Panic Error: %s, detail: %s", pi.NodeId, er, string(debug.Stack()))
+		}
+	}()
+	up, down, err := Measure(pi)
+	if err != nil {
+		log.Warnf("speed test provider [%s] failed: %s", pi.NodeId, err)
+		return
+	}
+	db.ProviderSaveMeasuredBandwidth(pi.NodeId, up, down)
+	pi.MeasuredUpBandwidth, pi.MeasuredDownBandwidth = up, down
+	if chooser.BandwidthRank(pi) < 1 {
+		log.Warnf("provider [%s] measured up %d down %d bps, far below declared up %d down %d bps", pi.NodeId, up, down, pi.UpBandwidth, pi.DownBandwidth)
+	}
+}
@@ -0,0 +1,83 @@
+// Package uptime computes the availability of providers from the probes of the
+// provider chooser and checks it against the availability they declared.
+package uptime
+
+import (
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Periods are the rolling windows availability is computed over, in days.
+var Periods = []uint32{1, 7, 30}
+
+const sla_period = 30
+
+// a month of probes every 3 minutes is about 14400, below this the figures
+// say too little to flag a provider
+const sla_min_probes = 1000
+
+const day = 24 * time.Hour
+
+type Stat struct {
+	Days         uint32
+	Success      uint64
+	Fail         uint64
+	Availability float64
+}
+
+func Availability(success uint64, fail uint64) float64 {
+	if success+fail == 0 {
+		return 1
+	}
+	return float64(success) / float64(success+fail)
+}
+
+// Breached tells whether the availability measured is below the declared one,
+// only when enough probes were made.
+func Breached(declared float64, success uint64, fail uint64) bool {
+	return success+fail >= sla_min_probes && Availability(success, fail) < declared
+}
+
+func Stats(nodeId string, now time.Time) []*Stat {
+	res := make([]*Stat, 0, len(Periods))
+	for _, days := range Periods {
+		success, fail := db.ProviderUptimeSince(nodeId, now.Add(-time.Duration(days)*day))
+		res = append(res, &Stat{Days: days, Success: success, Fail: fail, Availability: Availability(success, fail)})
+	}
+	return res
+}
+
+// SlaStat returns the stat of the period the declared availability is checked against.
+func SlaStat(stats []*Stat) *Stat {
+	for _, st := range stats {
+		if st.Days == sla_period {
+			return st
+		}
+	}
+	return nil
+}
+
+var runner *cronjob.Runner
+
+func StartAutoCheck() {
+	runner = cronjob.Start("0 30 0 * * *", "uptime check", check)
+}
+
+func StopAutoCheck() {
+	runner.Stop()
+}
+
+func check() {
+	now := time.Now().UTC()
+	for _, us := range db.ProviderUptimeSummaries(now.Add(-sla_period * day)) {
+		if Breached(us.Declared, us.Success, us.Fail) {
+			actual := Availability(us.Success, us.Fail)
+			db.ProviderSaveSlaBreach(us.NodeId, us.Declared, actual, us.Success+us.Fail)
+			log.Warnf("provider [%s] availability %.4f of last %d days is below declared %.4f", us.NodeId, actual, sla_period, us.Declared)
+		}
+	}
+	db.ProviderUptimePrune(now.Add(-(sla_period + 1) * day))
+}
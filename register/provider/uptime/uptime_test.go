@@ -0,0 +1,39 @@
+package uptime
+
+import (
+	"testing"
+)
+
+func TestAvailability(t *testing.T) {
+	if Availability(0, 0) != 1 {
+		t.Error("failed")
+	}
+	if Availability(98, 2) != 0.98 {
+		t.Errorf("failed: %f", Availability(98, 2))
+	}
+	if Availability(0, 5) != 0 {
+		t.Error("failed")
+	}
+}
+
+func TestBreached(t *testing.T) {
+	if Breached(0.98, 90, 10) {
+		t.Error("failed, too few probes")
+	}
+	if !Breached(0.98, 9000, 1000) {
+		t.Error("failed")
+	}
+	if Breached(0.98, 9900, 100) {
+		t.Error("failed")
+	}
+}
+
+func TestSlaStat(t *testing.T) {
+	stats := []*Stat{&Stat{Days: 1}, &Stat{Days: 7}, &Stat{Days: 30, Success: 3}}
+	if st := SlaStat(stats); st == nil || st.Success != 3 {
+		t.Error("failed")
+	}
+	if SlaStat(stats[:2]) != nil {
+		t.Error("failed")
+	}
+}
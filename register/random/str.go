@@ -1,6 +1,7 @@
 package random
 
 import (
+	crypto_rand "crypto/rand"
 	math_rand "math/rand"
 	"time"
 )
@@ -19,3 +20,16 @@ func RandomStr(strlen int) string {
 	}
 	return string(result)
 }
+
+// SecureRandomStr reads crypto/rand, for codes which grant access on their own.
+func SecureRandomStr(strlen int) string {
+	const chars = "abcdefghijkmnpqrstuvwxyz0123456789"
+	result := make([]byte, strlen)
+	if _, err := crypto_rand.Read(result); err != nil {
+		panic(err)
+	}
+	for i := range result {
+		result[i] = chars[int(result[i])%len(chars)]
+	}
+	return string(result)
+}
@@ -0,0 +1,68 @@
+package sendmail
+
+// builtinTemplates are the templates by locale and name, a template of the
+// same name under the TemplateDir of the Mail config overrides them.
+var builtinTemplates = map[string]map[string]string{
+	"en": {
+		TemplateVerifyCode: `
+{{define "purpose"}}{{if eq .Purpose "contact_email"}}Client Register Contact Email{{else if eq .Purpose "new_contact_email"}}Client New Contact Email{{else if eq .Purpose "delete_account"}}Client Delete Account{{else if eq .Purpose "add_device"}}Client Add Device{{else if eq .Purpose "key_recovery"}}Client Key Recovery{{else if eq .Purpose "bill_email"}}Provider Register Bill Email{{end}}{{end}}
+{{define "notice"}}{{if eq .Purpose "delete_account"}}all your files will be removed and the account can not be recovered once deleted, please ignore this email if you did not request it{{else if eq .Purpose "add_device"}}device {{.Device}} asked to join your account, please ignore this email if it is not your device{{else if eq .Purpose "key_recovery"}}all the devices of your account will be revoked once a key is recovered, please ignore this email if you did not request it{{end}}{{end}}
+{{define "subject"}}Nebula {{template "purpose" .}} Verify Code{{end}}
+{{define "text"}}verify code is {{.Code}}, sent at {{.Time}}
+{{template "notice" .}}{{end}}
+{{define "html"}}<html><body><p>Verify code is <b>{{.Code}}</b>, sent at {{.Time}}.</p><p>{{template "notice" .}}</p></body></html>{{end}}`,
+		TemplateOrder: `
+{{define "event"}}{{if eq .Event "created"}}Created{{else if eq .Event "paid"}}Paid{{else if eq .Event "cancelled"}}Cancelled{{else if eq .Event "renewed"}}Renewed{{else if eq .Event "renew_failed"}}Renewal Failed{{else}}{{.Event}}{{end}}{{end}}
+{{define "subject"}}Nebula Order {{template "event" .}}{{end}}
+{{define "text"}}{{if eq .Event "renew_failed"}}your package {{.Package}} could not be renewed automatically at {{.Time}}, the balance is {{.Balance}} short of the amount {{.TotalAmount}}, please recharge in time to keep your files{{else if eq .Event "renewed"}}your package {{.Package}} was renewed automatically at {{.Time}} by order {{.OrderId}}, amount {{.TotalAmount}}, balance left {{.Balance}}{{else}}order {{.OrderId}} of {{.Quantity}} x {{.Package}}, total amount {{.TotalAmount}}, {{if eq .Event "created"}}was created{{else if eq .Event "paid"}}was paid{{else if eq .Event "cancelled"}}was cancelled{{else}}{{.Event}}{{end}} at {{.Time}}{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}.</p></body></html>{{end}}`,
+		TemplateExpiry: `
+{{define "subject"}}Nebula Package {{if gt .DaysLeft 0}}Expiring{{else}}Expired{{end}}{{end}}
+{{define "text"}}{{if gt .DaysLeft 0}}your package expires in {{.DaysLeft}} days, at {{.EndTime}}, please renew it in time to keep your files{{else}}your package expired at {{.EndTime}}, please renew it to keep your files{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}.</p></body></html>{{end}}`,
+		TemplateQuota: `
+{{define "resource"}}{{if eq .Resource "volume"}}storage volume{{else if eq .Resource "netflow"}}netflow{{else if eq .Resource "up_netflow"}}upload netflow{{else if eq .Resource "down_netflow"}}download netflow{{else}}{{.Resource}}{{end}}{{end}}
+{{define "subject"}}Nebula {{template "resource" .}} {{.Percent}}% used{{end}}
+{{define "text"}}you have used {{.Percent}}% of the {{template "resource" .}} of your package, {{.Used}}MB of {{.Total}}MB{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}.</p></body></html>{{end}}`,
+		TemplateRetention: `
+{{define "subject"}}Nebula Files {{if eq .State "grace"}}Read Only{{else if eq .State "frozen"}}Frozen{{else}}Removed{{end}}{{end}}
+{{define "text"}}{{if eq .State "grace"}}your package expired at {{.EndTime}}, your files can only be listed and retrieved until {{.Until}}, please renew it to keep using them{{else if eq .State "frozen"}}your package expired at {{.EndTime}}, your files are frozen and will be removed at {{.Until}} unless you renew it{{else}}your package expired at {{.EndTime}}, your files have been removed{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}.</p></body></html>{{end}}`,
+		TemplateAccount: `
+{{define "subject"}}Nebula Client {{if eq .Event "contact_email_change_requested"}}Contact Email Change Requested{{else if eq .Event "contact_email_changed"}}Contact Email Changed{{else if eq .Event "key_recovered"}}Key Recovered{{else}}{{.Event}}{{end}}{{end}}
+{{define "text"}}{{if eq .Event "contact_email_change_requested"}}a change of your contact email to {{.NewEmail}} was requested at {{.Time}}, this address stays in use until the new one is verified{{else if eq .Event "contact_email_changed"}}your contact email was changed to {{.NewEmail}} at {{.Time}}, this address will not receive any more emails{{else if eq .Event "key_recovered"}}a new key was put in use for your account at {{.Time}}, all the former devices are revoked{{else}}{{.Event}} at {{.Time}}{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}.</p></body></html>{{end}}`,
+	},
+	"zh": {
+		TemplateVerifyCode: `
+{{define "purpose"}}{{if eq .Purpose "contact_email"}}客户端注册联系邮箱{{else if eq .Purpose "new_contact_email"}}客户端新联系邮箱{{else if eq .Purpose "delete_account"}}客户端注销账户{{else if eq .Purpose "add_device"}}客户端添加设备{{else if eq .Purpose "key_recovery"}}客户端密钥恢复{{else if eq .Purpose "bill_email"}}存储节点注册账单邮箱{{end}}{{end}}
+{{define "notice"}}{{if eq .Purpose "delete_account"}}账户注销后所有文件将被删除且无法恢复，如非本人操作请忽略此邮件{{else if eq .Purpose "add_device"}}设备 {{.Device}} 申请加入您的账户，如非您的设备请忽略此邮件{{else if eq .Purpose "key_recovery"}}密钥恢复后账户的所有设备将被吊销，如非本人操作请忽略此邮件{{end}}{{end}}
+{{define "subject"}}Nebula {{template "purpose" .}}验证码{{end}}
+{{define "text"}}验证码为 {{.Code}}，发送于 {{.Time}}
+{{template "notice" .}}{{end}}
+{{define "html"}}<html><body><p>验证码为 <b>{{.Code}}</b>，发送于 {{.Time}}。</p><p>{{template "notice" .}}</p></body></html>{{end}}`,
+		TemplateOrder: `
+{{define "event"}}{{if eq .Event "created"}}已创建{{else if eq .Event "paid"}}已支付{{else if eq .Event "cancelled"}}已取消{{else if eq .Event "renewed"}}已自动续费{{else if eq .Event "renew_failed"}}自动续费失败{{else}}{{.Event}}{{end}}{{end}}
+{{define "subject"}}Nebula 订单{{template "event" .}}{{end}}
+{{define "text"}}{{if eq .Event "renew_failed"}}您的套餐 {{.Package}} 于 {{.Time}} 自动续费失败，余额比金额 {{.TotalAmount}} 少 {{.Balance}}，请及时充值以保留您的文件{{else if eq .Event "renewed"}}您的套餐 {{.Package}} 已于 {{.Time}} 通过订单 {{.OrderId}} 自动续费，金额 {{.TotalAmount}}，余额 {{.Balance}}{{else}}订单 {{.OrderId}}（{{.Package}} x {{.Quantity}}，总金额 {{.TotalAmount}}）于 {{.Time}} {{template "event" .}}{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}。</p></body></html>{{end}}`,
+		TemplateExpiry: `
+{{define "subject"}}Nebula 套餐{{if gt .DaysLeft 0}}即将到期{{else}}已到期{{end}}{{end}}
+{{define "text"}}{{if gt .DaysLeft 0}}您的套餐将在 {{.DaysLeft}} 天后（{{.EndTime}}）到期，请及时续费以保留您的文件{{else}}您的套餐已于 {{.EndTime}} 到期，请续费以保留您的文件{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}。</p></body></html>{{end}}`,
+		TemplateQuota: `
+{{define "resource"}}{{if eq .Resource "volume"}}存储空间{{else if eq .Resource "netflow"}}流量{{else if eq .Resource "up_netflow"}}上传流量{{else if eq .Resource "down_netflow"}}下载流量{{else}}{{.Resource}}{{end}}{{end}}
+{{define "subject"}}Nebula {{template "resource" .}}已使用 {{.Percent}}%{{end}}
+{{define "text"}}您的套餐{{template "resource" .}}已使用 {{.Percent}}%（{{.Used}}MB / {{.Total}}MB）{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}。</p></body></html>{{end}}`,
+		TemplateRetention: `
+{{define "subject"}}Nebula 文件{{if eq .State "grace"}}已只读{{else if eq .State "frozen"}}已冻结{{else}}已删除{{end}}{{end}}
+{{define "text"}}{{if eq .State "grace"}}您的套餐已于 {{.EndTime}} 到期，{{.Until}} 之前您的文件仅可查看和下载，请续费以继续使用{{else if eq .State "frozen"}}您的套餐已于 {{.EndTime}} 到期，您的文件已冻结，如不续费将于 {{.Until}} 删除{{else}}您的套餐已于 {{.EndTime}} 到期，您的文件已被删除{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}。</p></body></html>{{end}}`,
+		TemplateAccount: `
+{{define "subject"}}Nebula 客户端{{if eq .Event "contact_email_change_requested"}}联系邮箱变更申请{{else if eq .Event "contact_email_changed"}}联系邮箱已变更{{else if eq .Event "key_recovered"}}密钥已恢复{{else}}{{.Event}}{{end}}{{end}}
+{{define "text"}}{{if eq .Event "contact_email_change_requested"}}您于 {{.Time}} 申请将联系邮箱变更为 {{.NewEmail}}，新邮箱验证之前仍使用此邮箱{{else if eq .Event "contact_email_changed"}}您的联系邮箱已于 {{.Time}} 变更为 {{.NewEmail}}，此邮箱将不再收到邮件{{else if eq .Event "key_recovered"}}您的账户已于 {{.Time}} 启用新密钥，之前的所有设备均已吊销{{else}}{{.Event}}，{{.Time}}{{end}}{{end}}
+{{define "html"}}<html><body><p>{{template "text" .}}。</p></body></html>{{end}}`,
+	},
+}
@@ -1,32 +1,139 @@
 package sendmail
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"nebula-tracker/config"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-func dial(addr string) (*tls.Conn, error) {
-	return tls.Dial("tcp", addr, nil)
+// Message is an email with a plain text body, and an html one if Html is not
+// empty.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	Html    string
+	// it holds a secret such as a verify code when set, it is retried only till
+	// then and dropped from the queue undelivered afterwards
+	Expire time.Time
+}
+
+// Mailer delivers emails, it is chosen by the Sender of the Mail config.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+var mailer Mailer
+var mailerLock sync.Mutex
+
+func currentMailer() Mailer {
+	mailerLock.Lock()
+	defer mailerLock.Unlock()
+	if mailer == nil {
+		conf := config.GetTrackerConfig().Mail
+		switch conf.Sender {
+		case "outbox":
+			mailer = &OutboxMailer{Dir: conf.OutboxDir}
+		case "smtp":
+			mailer = &SmtpMailer{}
+		default:
+			log.Warnf("unknown mail sender [%s], using smtp", conf.Sender)
+			mailer = &SmtpMailer{}
+		}
+	}
+	return mailer
+}
+
+// SetMailer replaces the mailer chosen by the config, mostly for tests.
+func SetMailer(m Mailer) {
+	mailerLock.Lock()
+	defer mailerLock.Unlock()
+	mailer = m
+}
+
+func fromAddress() *mail.Address {
+	// from address must be same as authorization user.
+	return &mail.Address{Address: config.GetTrackerConfig().Smtps.Username}
+}
+
+func composeMsg(from string, to string, msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if msg.Html == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ contentType, body string }{{"text/plain", msg.Text}, {"text/html", msg.Html}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"}})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func composeMsg(from string, to string, subject string, body string) (message string) {
-	// Setup headers
-	headers := make(map[string]string)
-	headers["From"] = from
-	headers["To"] = to
-	headers["Subject"] = subject
-	// Setup message
-	for k, v := range headers {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
 	}
-	message += "\r\n" + body
-	return
+	return qw.Close()
 }
 
+// Send delivers a plain text email, see SendMessage.
 func Send(toAddr string, subject string, body string) (err error) {
+	return SendMessage(&Message{To: toAddr, Subject: subject, Text: body})
+}
+
+// SendMessage delivers the email with the mailer of the config. Once the retry
+// queue is started, an email failed to be delivered is queued and retried
+// later till it expires, the error is returned only if it is not queued.
+func SendMessage(msg *Message) error {
+	err := currentMailer().Send(msg)
+	if err == nil || !queueing {
+		return err
+	}
+	log.Warnf("send mail to %s failed, will retry later: %s", msg.To, err)
+	enqueue(msg, err)
+	return nil
+}
+
+func dial(addr string) (*tls.Conn, error) {
+	return tls.Dial("tcp", addr, nil)
+}
+
+// SmtpMailer delivers emails through the SMTPS server of the Smtps config.
+type SmtpMailer struct{}
+
+func (self *SmtpMailer) Send(msg *Message) (err error) {
 	conf := config.GetTrackerConfig().Smtps
 	// get SSL connection
 	conn, err := dial(fmt.Sprintf("%s:%d", conf.Host, conf.Port))
@@ -38,6 +145,7 @@ func Send(toAddr string, subject string, body string) (err error) {
 	if err != nil {
 		return
 	}
+	defer smtpClient.Close()
 	// Set up authentication information.
 	auth := smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)
 	// auth the smtp client
@@ -45,9 +153,9 @@ func Send(toAddr string, subject string, body string) (err error) {
 	if err != nil {
 		return
 	}
-	// set To && From address, note that from address must be same as authorization user.
-	from := mail.Address{Address: conf.Username}
-	to := mail.Address{Address: toAddr}
+	// set To && From address
+	from := fromAddress()
+	to := mail.Address{Address: msg.To}
 	err = smtpClient.Mail(from.Address)
 	if err != nil {
 		return
@@ -56,15 +164,18 @@ func Send(toAddr string, subject string, body string) (err error) {
 	if err != nil {
 		return
 	}
+	// compose message body
+	message, err := composeMsg(from.String(), to.String(), msg)
+	if err != nil {
+		return
+	}
 	// Get the writer from SMTP client
 	writer, err := smtpClient.Data()
 	if err != nil {
 		return
 	}
-	// compose message body
-	message := composeMsg(from.String(), to.String(), subject, body)
 	// write message to recp
-	_, err = writer.Write([]byte(message))
+	_, err = writer.Write(message)
 	if err != nil {
 		return
 	}
@@ -2,6 +2,10 @@ package sendmail
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,3 +17,78 @@ func Test(t *testing.T) {
 	Send(email, "Nebula Client Register Contact Email Verify Code", fmt.Sprintf("verify code is %s, sent at %s",
 		randomCode, time.Now().UTC().Format("2006-01-02 15:04:05 UTC")))
 }
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetMailer(&OutboxMailer{Dir: dir})
+	defer SetMailer(nil)
+	err = SendTemplate("test@email.com", "en", TemplateVerifyCode, &VerifyCodeData{Purpose: PurposeDeleteAccount, Code: "abcd1234", Time: FormatTime(time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one email in outbox, got %d, %v", len(files), err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(b)
+	for _, s := range []string{"To: <test@email.com>", "Subject: Nebula Client Delete Account Verify Code", "multipart/alternative", "abcd1234", "<b>abcd1234</b>"} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("expected %q in email:\n%s", s, msg)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	msg, err := Render("zh", TemplateQuota, &QuotaData{Resource: "volume", Used: 90, Total: 100, Percent: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Nebula 存储空间已使用 90%" {
+		t.Errorf("unexpected subject %s", msg.Subject)
+	}
+	msg, err = Render("fr", TemplateExpiry, &ExpiryData{EndTime: "2018-01-02 03:04:05 UTC", DaysLeft: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "your package expires in 3 days, at 2018-01-02 03:04:05 UTC, please renew it in time to keep your files" {
+		t.Errorf("unexpected text %s", msg.Text)
+	}
+	msg, err = Render("en", TemplateOrder, &OrderData{Event: "renew_failed", Package: "basic package", Quantity: 1, TotalAmount: 15000000, Balance: 5000000, Time: "2018-01-02 03:04:05 UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Nebula Order Renewal Failed" || !strings.Contains(msg.Text, "the balance is 5000000 short of the amount 15000000") {
+		t.Errorf("unexpected email %s: %s", msg.Subject, msg.Text)
+	}
+	msg, err = Render("zh", TemplateAccount, &AccountData{Event: "contact_email_changed", NewEmail: "new@email.com", Time: "2018-01-02 03:04:05 UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Nebula 客户端联系邮箱已变更" || !strings.Contains(msg.Text, "new@email.com") {
+		t.Errorf("unexpected email %s: %s", msg.Subject, msg.Text)
+	}
+	if _, err = Render("en", "no_such_template", nil); err == nil {
+		t.Error("expected error for unknown template")
+	}
+}
+
+func TestValidLocale(t *testing.T) {
+	for _, l := range []string{"", "en", "zh_CN", "pt-BR"} {
+		if !ValidLocale(l) {
+			t.Errorf("expected %q valid", l)
+		}
+	}
+	for _, l := range []string{"../en", "en/zh", "zh CN", "abcdefghijklmnopq"} {
+		if ValidLocale(l) {
+			t.Errorf("expected %q invalid", l)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package sendmail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OutboxMailer writes every email as an .eml file under Dir instead of
+// delivering it, for tests and running without network.
+type OutboxMailer struct {
+	Dir string
+}
+
+func (self *OutboxMailer) Send(msg *Message) error {
+	if err := os.MkdirAll(self.Dir, 0700); err != nil {
+		return err
+	}
+	to := mail.Address{Address: msg.To}
+	message, err := composeMsg(fromAddress().String(), to.String(), msg)
+	if err != nil {
+		return err
+	}
+	// the bodies may hold verify codes, readable by the tracker only
+	return ioutil.WriteFile(filepath.Join(self.Dir, outboxFilename(msg.To)), message, 0600)
+}
+
+func outboxFilename(to string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, to)
+	return fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), name)
+}
@@ -0,0 +1,65 @@
+package sendmail
+
+import (
+	"nebula-tracker/config"
+	"nebula-tracker/cronjob"
+	"nebula-tracker/db"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a claimed email is left alone by the other trackers for this long
+const claim_lease = 10 * time.Minute
+
+var runner *cronjob.Runner
+
+// emails failed to be delivered are queued only after StartAutoRetry, so the
+// package works without a database
+var queueing = false
+
+// StartAutoRetry queues the emails failed to be delivered in the database and
+// retries them by the RetryCronSpec of the Mail config.
+func StartAutoRetry() {
+	queueing = true
+	runner = cronjob.Start(config.GetTrackerConfig().Mail.RetryCronSpec, "retry mail", retry)
+}
+
+func StopAutoRetry() {
+	runner.Stop()
+	queueing = false
+}
+
+func enqueue(msg *Message, err error) {
+	db.MailEnqueue(msg.To, msg.Subject, msg.Text, msg.Html, err.Error(), time.Now().Add(backoff(1)), msg.Expire)
+}
+
+// backoff doubles from a minute after each failed attempt, up to an hour.
+func backoff(attempts int) time.Duration {
+	if attempts > 7 {
+		return time.Hour
+	}
+	d := time.Minute << uint(attempts-1)
+	if d > time.Hour {
+		return time.Hour
+	}
+	return d
+}
+
+func retry() {
+	conf := config.GetTrackerConfig().Mail
+	m := currentMailer()
+	for _, qm := range db.MailClaimDue(conf.RetryBatchSize, claim_lease) {
+		err := m.Send(&Message{To: qm.Recipient, Subject: qm.Subject, Text: qm.TextBody, Html: qm.HtmlBody})
+		if err == nil {
+			db.MailDequeue(qm.Id)
+			continue
+		}
+		if qm.Attempts+1 >= conf.MaxAttempts {
+			log.Errorf("give up sending mail [%s] to %s after %d attempts: %s", qm.Subject, qm.Recipient, qm.Attempts+1, err)
+			db.MailDequeue(qm.Id)
+			continue
+		}
+		db.MailRetryLater(qm.Id, err.Error(), time.Now().Add(backoff(qm.Attempts+1)))
+	}
+}
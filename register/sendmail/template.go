@@ -0,0 +1,202 @@
+package sendmail
+
+import (
+	"bytes"
+	"fmt"
+	html_template "html/template"
+	"io/ioutil"
+	"nebula-tracker/config"
+	"os"
+	"path/filepath"
+	"sync"
+	text_template "text/template"
+	"time"
+)
+
+// Templates define "subject", "text" and "html", executed with the data noted.
+const (
+	TemplateVerifyCode = "verify_code" // *VerifyCodeData
+	TemplateOrder      = "order"       // *OrderData
+	TemplateExpiry     = "expiry"      // *ExpiryData
+	TemplateQuota      = "quota"       // *QuotaData
+	TemplateRetention  = "retention"   // *RetentionData
+	TemplateAccount    = "account"     // *AccountData
+)
+
+// Purposes of verify codes.
+const (
+	PurposeContactEmail    = "contact_email"
+	PurposeNewContactEmail = "new_contact_email"
+	PurposeDeleteAccount   = "delete_account"
+	PurposeAddDevice       = "add_device"
+	PurposeKeyRecovery     = "key_recovery"
+	PurposeBillEmail       = "bill_email"
+)
+
+type VerifyCodeData struct {
+	Purpose string
+	Code    string
+	Time    string
+	Device  string // name of the device asking to join, for PurposeAddDevice
+}
+
+// OrderData is about an order, Event is one of created, paid, cancelled,
+// renewed and renew_failed, Balance is left after a renewal or short of the
+// amount when it failed.
+type OrderData struct {
+	Event       string
+	OrderId     string
+	Package     string
+	Quantity    uint32
+	TotalAmount uint64
+	Balance     uint64
+	Time        string
+}
+
+type ExpiryData struct {
+	EndTime  string
+	DaysLeft int // 0 or less once expired
+}
+
+// QuotaData is about the usage of one resource of the package, Resource is
+// one of volume, netflow, up_netflow and down_netflow, Used and Total are in
+// MB.
+type QuotaData struct {
+	Resource string
+	Used     uint64
+	Total    uint64
+	Percent  int
+}
+
+// RetentionData is about the files of a package ended at EndTime, State is
+// one of grace, frozen and removed, Until is when the state ends.
+type RetentionData struct {
+	State   string
+	EndTime string
+	Until   string
+}
+
+// AccountData is about a change of the account, Event is one of
+// contact_email_change_requested, contact_email_changed and key_recovered,
+// NewEmail is the contact email changed to.
+type AccountData struct {
+	Event    string
+	NewEmail string
+	Time     string
+}
+
+// FormatTime formats the time the way all the emails show it.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+// ValidLocale tells whether a locale given by a client may name a directory of
+// templates, such as en or zh_CN, empty is valid for the Locale of the config.
+func ValidLocale(locale string) bool {
+	if len(locale) > 16 {
+		return false
+	}
+	for _, r := range locale {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+type parsedTemplate struct {
+	text *text_template.Template
+	html *html_template.Template
+}
+
+var templateCache = make(map[string]*parsedTemplate)
+var templateLock sync.Mutex
+
+// loadTemplate looks up the template of the locale in the TemplateDir of the
+// Mail config first, then in the built-in ones, nil if neither has it.
+func loadTemplate(locale string, name string) (*parsedTemplate, error) {
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	key := locale + "/" + name
+	if pt, ok := templateCache[key]; ok {
+		return pt, nil
+	}
+	var src string
+	if dir := config.GetTrackerConfig().Mail.TemplateDir; dir != "" {
+		b, err := ioutil.ReadFile(filepath.Join(dir, locale, name+".tmpl"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		src = string(b)
+	}
+	if src == "" {
+		src = builtinTemplates[locale][name]
+	}
+	if src == "" {
+		return nil, nil
+	}
+	text, err := text_template.New(key).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	html, err := html_template.New(key).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	pt := &parsedTemplate{text: text, html: html}
+	templateCache[key] = pt
+	return pt, nil
+}
+
+// Render executes the template of the locale, falling back to the Locale of
+// the Mail config and then to en. The returned message has no recipient.
+func Render(locale string, name string, data interface{}) (*Message, error) {
+	var pt *parsedTemplate
+	var err error
+	for _, l := range []string{locale, config.GetTrackerConfig().Mail.Locale, "en"} {
+		if l == "" {
+			continue
+		}
+		if pt, err = loadTemplate(l, name); err != nil {
+			return nil, err
+		}
+		if pt != nil {
+			break
+		}
+	}
+	if pt == nil {
+		return nil, fmt.Errorf("mail template %s not found", name)
+	}
+	var subject, text, html bytes.Buffer
+	if err = pt.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err = pt.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, err
+	}
+	if pt.html.Lookup("html") != nil {
+		if err = pt.html.ExecuteTemplate(&html, "html", data); err != nil {
+			return nil, err
+		}
+	}
+	return &Message{Subject: subject.String(), Text: text.String(), Html: html.String()}, nil
+}
+
+// a verify code is accepted for 120 minutes after it was sent, the email is not
+// retried longer
+const verify_code_expire = 120 * time.Minute
+
+// SendTemplate renders the template of the locale, empty for the Locale of
+// the Mail config, and sends it, see SendMessage. A verify code is retried
+// only as long as it is accepted.
+func SendTemplate(toAddr string, locale string, name string, data interface{}) error {
+	msg, err := Render(locale, name, data)
+	if err != nil {
+		return err
+	}
+	msg.To = toAddr
+	if name == TemplateVerifyCode {
+		msg.Expire = time.Now().Add(verify_code_expire)
+	}
+	return SendMessage(msg)
+}
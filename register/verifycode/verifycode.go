@@ -0,0 +1,81 @@
+// Package verifycode generates the codes emailed to clients and providers and
+// keeps only their hashes. Guessing is limited by counters of wrong codes per
+// node and per email, and resending by a cooldown, both kept in the database
+// so they hold across trackers.
+package verifycode
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"nebula-tracker/config"
+	"nebula-tracker/db"
+	"nebula-tracker/register/random"
+)
+
+const code_length = 8
+
+// New returns a code for the subject, usually a node id, and the hash of it
+// to save.
+func New(subject string) (code string, hash string) {
+	code = random.SecureRandomStr(code_length)
+	return code, Hash(subject, code)
+}
+
+func Hash(subject string, code string) string {
+	sum := sha256.Sum256([]byte(subject + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Match compares the code with the saved hash in constant time.
+func Match(hash string, subject string, code string) bool {
+	if hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(Hash(subject, code))) == 1
+}
+
+func NodeKey(nodeId string) string {
+	return "node:" + nodeId
+}
+
+func EmailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+// IpKey limits the guesses of unauthenticated requests by the address they
+// come from.
+func IpKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Locked tells whether any of the keys made too many wrong guesses.
+func Locked(keys ...string) bool {
+	return db.VerifyAttemptLocked(keys)
+}
+
+// Fail counts a wrong guess of each key.
+func Fail(keys ...string) {
+	conf := config.GetTrackerConfig().VerifyCode
+	now := time.Now()
+	for _, key := range keys {
+		db.VerifyAttemptFail(key, now.Add(-time.Duration(conf.FailureWindowMin)*time.Minute), conf.MaxFailures, now.Add(time.Duration(conf.LockoutMin)*time.Minute))
+	}
+}
+
+// Succeed clears the wrong guesses of each key.
+func Succeed(keys ...string) {
+	for _, key := range keys {
+		db.VerifyAttemptReset(key)
+	}
+}
+
+// MaySend tells whether a code can be sent for all of the keys, recording it
+// as sent for every key if so, and for none otherwise.
+func MaySend(keys ...string) bool {
+	before := time.Now().Add(-time.Duration(config.GetTrackerConfig().VerifyCode.ResendCooldownSec) * time.Second)
+	return db.VerifySendAllowed(keys, before)
+}
@@ -0,0 +1,23 @@
+package verifycode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+	code, hash := New("node-a")
+	assert.Equal(code_length, len(code))
+	assert.Equal(64, len(hash))
+	assert.True(Match(hash, "node-a", code))
+	assert.False(Match(hash, "node-b", code))
+	assert.False(Match(hash, "node-a", code+"x"))
+	assert.False(Match("", "node-a", code))
+}
+
+func TestEmailKey(t *testing.T) {
+	assert.Equal(t, EmailKey("Foo@Example.com"), EmailKey("foo@example.com"))
+	assert.NotEqual(t, NodeKey("foo@example.com"), EmailKey("foo@example.com"))
+}
@@ -5,7 +5,7 @@ create table IF NOT EXISTS CLIENT(
     EMAIL_VERIFIED BOOL DEFAULT false,
     CREATION TIMESTAMPTZ NOT NULL,
     LAST_MODIFIED TIMESTAMPTZ NOT NULL,
-    RANDOM_CODE STRING(8) DEFAULT NULL,
+    RANDOM_CODE STRING(64) DEFAULT NULL,
     SEND_TIME TIMESTAMPTZ DEFAULT NULL,
     ACTIVE BOOL NOT NULL DEFAULT true,
     REMOVED BOOL NOT NULL DEFAULT false,
@@ -18,11 +18,43 @@ create table IF NOT EXISTS CLIENT(
     NETFLOW INT NOT NULL default 0,
     UP_NETFLOW INT NOT NULL default 0,
     DOWN_NETFLOW INT NOT NULL default 0,
-    END_TIME TIMESTAMPTZ DEFAULT NULL
+    END_TIME TIMESTAMPTZ DEFAULT NULL,
+    DELETE_CODE STRING(64) DEFAULT NULL,
+    DELETE_CODE_TIME TIMESTAMPTZ DEFAULT NULL,
+    REMOVE_TIME TIMESTAMPTZ DEFAULT NULL,
+    NEW_CONTACT_EMAIL STRING(128) DEFAULT NULL,
+    NEW_EMAIL_CODE STRING(64) DEFAULT NULL,
+    NEW_EMAIL_SEND_TIME TIMESTAMPTZ DEFAULT NULL,
+    EMAIL_CHANGE_ATTEMPTS INT NOT NULL DEFAULT 0,
+    EMAIL_CHANGE_SINCE TIMESTAMPTZ DEFAULT NULL,
+    KEY_REVOKED BOOL NOT NULL DEFAULT false,
+    RECOVERY_CODE_HASH STRING(64) DEFAULT NULL,
+    RECOVERY_EMAIL_CODE STRING(64) DEFAULT NULL,
+    RECOVERY_SEND_TIME TIMESTAMPTZ DEFAULT NULL,
+    AUTO_RENEW BOOL NOT NULL DEFAULT false,
+    NEXT_ORDER_ID UUID DEFAULT NULL,
+    -- of the emails to the client, NULL for the Locale of the Mail config
+    LOCALE STRING(16) DEFAULT NULL
 );
 
 CREATE INDEX RECHARGE_ADDRESS ON CLIENT (RECHARGE_ADDRESS);
 
+-- devices other than the one registered the account, sharing its files, packages and usage
+create table IF NOT EXISTS CLIENT_DEVICE(
+    NODE_ID STRING(30) NOT NULL PRIMARY KEY,
+    ACCOUNT_ID STRING(30) NOT NULL REFERENCES CLIENT (NODE_ID),
+    PUBLIC_KEY BYTES NOT NULL,
+    NAME STRING(64) NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    LAST_MODIFIED TIMESTAMPTZ NOT NULL,
+    APPROVED BOOL NOT NULL DEFAULT false,
+    RANDOM_CODE STRING(64) DEFAULT NULL,
+    SEND_TIME TIMESTAMPTZ DEFAULT NULL,
+    REVOKED BOOL NOT NULL DEFAULT false,
+    REVOKE_TIME TIMESTAMPTZ DEFAULT NULL,
+    INDEX CLIENT_DEVICE_ACCOUNT_ID(ACCOUNT_ID)
+);
+
 create table IF NOT EXISTS CLIENT_USAGE_AMOUNT(
     NODE_ID STRING(30) NOT NULL PRIMARY KEY REFERENCES CLIENT (NODE_ID),
     CREATION TIMESTAMPTZ NOT NULL,
@@ -37,5 +69,47 @@ create table IF NOT EXISTS TRACKER(
     ID SERIAL PRIMARY KEY,
     SERVER STRING(64) NOT NULL,
     PORT INT NOT NULL,  
-    CATEGORY STRING(32)
+    CATEGORY STRING(32),
+    -- key of the server network in the failure domain db, the autonomous
+    -- system number with an ASN db
+    ASN STRING(32) DEFAULT NULL,
+    -- static share of the nodes sent to it, the load is not measured
+    WEIGHT INT NOT NULL DEFAULT 100,
+    ACTIVE BOOL NOT NULL DEFAULT true
+);
+
+-- attempts of verify codes per node or email, shared by clients and providers
+create table IF NOT EXISTS VERIFY_ATTEMPT(
+    KEY STRING(200) NOT NULL PRIMARY KEY,
+    FAILURES INT NOT NULL DEFAULT 0,
+    WINDOW_START TIMESTAMPTZ DEFAULT NULL,
+    LOCKED_UNTIL TIMESTAMPTZ DEFAULT NULL,
+    LAST_SEND TIMESTAMPTZ DEFAULT NULL
+);
+
+-- emails failed to be delivered, retried by every tracker
+create table IF NOT EXISTS MAIL_QUEUE(
+    ID SERIAL PRIMARY KEY,
+    RECIPIENT STRING(254) NOT NULL,
+    SUBJECT STRING NOT NULL,
+    TEXT_BODY STRING NOT NULL,
+    HTML_BODY STRING DEFAULT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    LAST_MODIFIED TIMESTAMPTZ NOT NULL,
+    ATTEMPTS INT NOT NULL DEFAULT 0,
+    NEXT_TRY TIMESTAMPTZ NOT NULL,
+    LAST_ERROR STRING DEFAULT NULL,
+    -- an email holding a secret is dropped undelivered after it
+    EXPIRE_TIME TIMESTAMPTZ DEFAULT NULL,
+    INDEX MAIL_QUEUE_NEXT_TRY(NEXT_TRY)
+);
+
+-- notifications sent to clients, once per threshold and package period
+create table IF NOT EXISTS CLIENT_NOTICE(
+    NODE_ID STRING(30) NOT NULL REFERENCES CLIENT (NODE_ID),
+    KIND STRING(32) NOT NULL,
+    THRESHOLD INT NOT NULL,
+    PERIOD_END TIMESTAMPTZ NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (NODE_ID, KIND, THRESHOLD, PERIOD_END)
 );
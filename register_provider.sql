@@ -2,6 +2,7 @@ create table IF NOT EXISTS PROVIDER(
     NODE_ID STRING(30) NOT NULL PRIMARY KEY, 
     PUBLIC_KEY BYTES NOT NULL,
     BILL_EMAIL STRING(128) NOT NULL,
+    NEW_BILL_EMAIL STRING(128) DEFAULT NULL,
     EMAIL_VERIFIED BOOL DEFAULT false,
     ENCRYPT_KEY BYTES NOT NULL, 
     WALLET_ADDRESS STRING(64) NOT NULL,
@@ -10,6 +11,9 @@ create table IF NOT EXISTS PROVIDER(
     DOWN_BANDWIDTH INT NOT NULL,
     TEST_UP_BANDWIDTH INT NOT NULL,
     TEST_DOWN_BANDWIDTH INT NOT NULL,
+    MEASURED_UP_BANDWIDTH INT DEFAULT NULL,
+    MEASURED_DOWN_BANDWIDTH INT DEFAULT NULL,
+    MEASURED_TIME TIMESTAMPTZ DEFAULT NULL,
     AVAILABILITY FLOAT NOT NULL,
     PORT INT NOT NULL,
     HOST STRING(32) DEFAULT NULL,
@@ -17,8 +21,89 @@ create table IF NOT EXISTS PROVIDER(
     STORAGE_VOLUME int[] NOT NULL,
     CREATION TIMESTAMPTZ NOT NULL,
     LAST_MODIFIED TIMESTAMPTZ NOT NULL,
-    RANDOM_CODE STRING(8) DEFAULT NULL,
+    RANDOM_CODE STRING(64) DEFAULT NULL,
     SEND_TIME TIMESTAMPTZ DEFAULT NULL,
     ACTIVE BOOL NOT NULL DEFAULT true,
-    REMOVED BOOL NOT NULL DEFAULT false
-);
\ No newline at end of file
+    REMOVED BOOL NOT NULL DEFAULT false,
+    STATUS INT NOT NULL DEFAULT 0
+);
+
+create table IF NOT EXISTS PROVIDER_ADMIN_LOG(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    NODE_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    FROM_STATUS INT NOT NULL,
+    TO_STATUS INT NOT NULL,
+    OPERATOR STRING(64) NOT NULL,
+    REASON STRING(512) NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    INDEX PROVIDER_ADMIN_LOG_NODE_ID(NODE_ID)
+);
+create table IF NOT EXISTS PROVIDER_WALLET_LOG(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    NODE_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    FROM_ADDRESS STRING(64) NOT NULL,
+    TO_ADDRESS STRING(64) NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    EFFECTIVE TIMESTAMPTZ NOT NULL,
+    INDEX PROVIDER_WALLET_LOG_NODE_ID(NODE_ID,EFFECTIVE)
+);
+create table IF NOT EXISTS PROVIDER_HEARTBEAT(
+    NODE_ID STRING(30) NOT NULL PRIMARY KEY REFERENCES PROVIDER (NODE_ID),
+    FREE_VOLUME INT NOT NULL,
+    USED_VOLUME INT NOT NULL,
+    MAX_FILE_SIZE INT NOT NULL,
+    VERSION STRING(32) NOT NULL,
+    ENDPOINTS STRING[] DEFAULT NULL,
+    LAST_MODIFIED TIMESTAMPTZ NOT NULL
+);
+
+create table IF NOT EXISTS PROVIDER_UPTIME(
+    NODE_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    HOUR TIMESTAMPTZ NOT NULL,
+    SUCCESS INT NOT NULL DEFAULT 0,
+    FAIL INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (NODE_ID, HOUR)
+);
+
+create table IF NOT EXISTS PROVIDER_SLA_BREACH(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    NODE_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    DECLARED FLOAT NOT NULL,
+    ACTUAL FLOAT NOT NULL,
+    PROBES INT NOT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    INDEX PROVIDER_SLA_BREACH_NODE_ID(NODE_ID)
+);
+
+create table IF NOT EXISTS PROVIDER_EARNING(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    NODE_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    KIND INT NOT NULL,
+    PERIOD_START TIMESTAMPTZ NOT NULL,
+    PERIOD_END TIMESTAMPTZ NOT NULL,
+    BYTE_HOURS FLOAT NOT NULL,
+    TRAFFIC INT NOT NULL,
+    AVAILABILITY FLOAT NOT NULL,
+    AMOUNT INT NOT NULL,
+    HELD INT NOT NULL,
+    PAYOUT_ID UUID DEFAULT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    UNIQUE (NODE_ID,PERIOD_START,KIND),
+    INDEX PROVIDER_EARNING_PAYOUT_ID(PAYOUT_ID)
+);
+create table IF NOT EXISTS PROVIDER_PAYOUT_BATCH(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    CREATION TIMESTAMPTZ NOT NULL
+);
+create table IF NOT EXISTS PROVIDER_PAYOUT(
+    ID UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    BATCH_ID UUID NOT NULL REFERENCES PROVIDER_PAYOUT_BATCH (ID),
+    NODE_ID STRING(30) NOT NULL REFERENCES PROVIDER (NODE_ID),
+    WALLET_ADDRESS STRING(64) NOT NULL,
+    AMOUNT INT NOT NULL,
+    PAID BOOL NOT NULL DEFAULT false,
+    TRANSACTION_ID STRING(128) DEFAULT NULL,
+    PAID_TIME TIMESTAMPTZ DEFAULT NULL,
+    CREATION TIMESTAMPTZ NOT NULL,
+    INDEX PROVIDER_PAYOUT_PAID(PAID)
+);